@@ -3,6 +3,9 @@ package main
 import (
 	config "github.com/poddworks/machine/config"
 	mach "github.com/poddworks/machine/lib/machine"
+	"github.com/poddworks/machine/lib/runlog"
+	"github.com/poddworks/machine/lib/ssh"
+	"github.com/poddworks/machine/lib/vault"
 
 	"github.com/poddworks/machine/driver/aws"
 	"github.com/poddworks/machine/driver/generic"
@@ -17,7 +20,9 @@ import (
 	"os"
 	path "path/filepath"
 	"regexp"
+	"strings"
 	"text/template"
+	"time"
 )
 
 func ListInstanceCommand() cli.Command {
@@ -113,7 +118,7 @@ func IPCommand() cli.Command {
 			if !ok {
 				return cli.NewExitError("error/instance-not-found", 1)
 			}
-			if instMeta.DockerHost == nil {
+			if instMeta.DockerHost == nil && !instMeta.SSHOnly {
 				return cli.NewExitError("error/instance-not-available", 1)
 			} else {
 				fmt.Println(instMeta.Host)
@@ -153,6 +158,14 @@ func EnvCommand() cli.Command {
 				if !ok {
 					return cli.NewExitError("error/instance-not-found", 1)
 				}
+				if instMeta.SSHOnly {
+					fmt.Printf("unset DOCKER_TLS_VERIFY DOCKER_CERT_PATH\n")
+					fmt.Printf("export DOCKER_HOST=%s\n", instMeta.TunnelDockerHost(name))
+					fmt.Printf("export MACHINE_NAME=%s\n", name)
+					fmt.Printf("# machine tunnel %s\n", name)
+					fmt.Printf("# eval $(machine env %s)\n", name)
+					return nil
+				}
 				fmt.Printf("export DOCKER_TLS_VERIFY=1\n")
 				fmt.Printf("export DOCKER_CERT_PATH=%s\n", config.Config.Certpath)
 				fmt.Printf("export DOCKER_HOST=%s\n", instMeta.DockerHostName())
@@ -198,8 +211,16 @@ func ExecCommand() cli.Command {
 		Name:  "exec",
 		Usage: "Invoke command on remote host via SSH",
 		Flags: []cli.Flag{
-			cli.BoolFlag{Name: "dryrun", Usage: "Enable Dry Run"},
+			cli.BoolFlag{Name: "dryrun, check", Usage: "Report what would change, with diff, without changing it"},
 			cli.StringSliceFlag{Name: "host", Usage: "Remote host to run command in"},
+			cli.StringSliceFlag{Name: "target", Usage: "Instance or inventory name, group, or label selector key=value"},
+			cli.StringFlag{Name: "inventory", EnvVar: "MACHINE_INVENTORY", Usage: "Inventory of hosts and groups, YAML or INI"},
+			cli.IntFlag{Name: "forks", Value: 10, Usage: "Run on at most this many hosts at a time, 0 for no limit"},
+			cli.StringFlag{Name: "vault-key-file", EnvVar: "MACHINE_VAULT_KEY_FILE", Usage: "File holding password of vault encrypted files, asked when not given"},
+		},
+		Before: func(c *cli.Context) error {
+			ssh.Vault = vault.New(vaultPassword(c.String("vault-key-file"), "Vault password: ", false))
+			return nil
 		},
 		Subcommands: []cli.Command{
 			{
@@ -216,10 +237,30 @@ func ExecCommand() cli.Command {
 				Action: runScript,
 			},
 			{
-				Name:   "playbook",
-				Usage:  "Go through the playbook",
+				Name:  "playbook",
+				Usage: "Go through the playbook",
+				Flags: []cli.Flag{
+					cli.StringSliceFlag{Name: "var", Usage: "Set playbook variable as key=value"},
+					cli.StringFlag{Name: "vars-file", Usage: "Load playbook variables from YAML file"},
+					cli.StringFlag{Name: "resume", Usage: "Carry on hosts of earlier run from where they stopped"},
+					cli.StringFlag{Name: "start-at", Usage: "Start at the playbook section of this name"},
+				},
 				Action: runPlaybook,
 			},
+			{
+				Name:  "logs",
+				Usage: "Replay log of earlier run, or list runs when none given",
+				Flags: []cli.Flag{
+					cli.StringFlag{Name: "host", Usage: "Replay for this host only"},
+				},
+				Action: runLogs,
+				BashComplete: func(c *cli.Context) {
+					ids, _ := runlog.List(config.Config.Runs)
+					for _, id := range ids {
+						fmt.Fprint(c.App.Writer, id, " ")
+					}
+				},
+			},
 		},
 		BashComplete: func(c *cli.Context) {
 			for _, cmd := range c.App.Commands {
@@ -229,6 +270,66 @@ func ExecCommand() cli.Command {
 	}
 }
 
+func FactsCommand() cli.Command {
+	return cli.Command{
+		Name:  "facts",
+		Usage: "Gather facts of remote host and print them as JSON",
+		Flags: []cli.Flag{
+			cli.BoolFlag{Name: "cached", Usage: "Print facts cached by the last run instead of gathering"},
+			cli.StringFlag{Name: "inventory", EnvVar: "MACHINE_INVENTORY", Usage: "Inventory of hosts and groups, YAML or INI"},
+		},
+		Action: runFacts,
+		BashComplete: func(c *cli.Context) {
+			for name, _ := range mach.InstList {
+				fmt.Fprint(c.App.Writer, name, " ")
+			}
+		},
+	}
+}
+
+func VaultCommand() cli.Command {
+	return cli.Command{
+		Name:  "vault",
+		Usage: "Encrypt secrets for playbooks with AES-GCM",
+		Flags: []cli.Flag{
+			cli.StringFlag{Name: "vault-key-file", EnvVar: "MACHINE_VAULT_KEY_FILE", Usage: "File holding vault password, asked when not given"},
+		},
+		Subcommands: []cli.Command{
+			{
+				Name:   "create",
+				Usage:  "Write new encrypted file in $EDITOR",
+				Action: runVaultCreate,
+			},
+			{
+				Name:   "edit",
+				Usage:  "Edit encrypted file in $EDITOR",
+				Action: runVaultEdit,
+			},
+			{
+				Name:   "encrypt",
+				Usage:  "Encrypt files in place",
+				Action: runVaultEncrypt,
+			},
+			{
+				Name:  "decrypt",
+				Usage: "Decrypt files in place",
+				Flags: []cli.Flag{
+					cli.StringFlag{Name: "output", Usage: "Write to this file instead, - for standard output"},
+				},
+				Action: runVaultDecrypt,
+			},
+			{
+				Name:  "rekey",
+				Usage: "Encrypt files again under new password",
+				Flags: []cli.Flag{
+					cli.StringFlag{Name: "new-key-file", Usage: "File holding new vault password, asked when not given"},
+				},
+				Action: runVaultRekey,
+			},
+		},
+	}
+}
+
 func SSHCommand() cli.Command {
 	return cli.Command{
 		Name:        "ssh",
@@ -250,11 +351,105 @@ func SSHCommand() cli.Command {
 			}
 
 			inst := mach.NewHost()
+			inst.HostKey = info.HostKey
+			if len(info.Bastion) > 0 && len(inst.Bastion) == 0 {
+				inst.Bastion = info.Bastion
+			}
 			if err := inst.Shell(info.Host); err != nil {
 				return cli.NewExitError("error/failed-to-login", 1)
-			} else {
-				return nil
 			}
+
+			// Record host key presented on login
+			info.HostKey = inst.HostKey
+			mach.InstList.Dump()
+
+			return nil
+		},
+		BashComplete: func(c *cli.Context) {
+			for name, _ := range mach.InstList {
+				fmt.Fprint(c.App.Writer, name, " ")
+			}
+		},
+	}
+}
+
+func TunnelCommand() cli.Command {
+	return cli.Command{
+		Name:  "tunnel",
+		Usage: "Forward ports and Docker socket over SSH",
+		Flags: []cli.Flag{
+			cli.StringFlag{Name: "docker", Usage: "Local port or unix socket to forward to remote Docker socket"},
+			cli.StringSliceFlag{Name: "L", Usage: "Forward local [bind_address:]port or socket to remote host:hostport or socket"},
+			cli.StringSliceFlag{Name: "R", Usage: "Forward remote [bind_address:]port to local host:hostport or socket"},
+		},
+		Action: func(c *cli.Context) error {
+			var (
+				name = c.Args().First()
+
+				local, remote []ssh.Forward
+			)
+
+			if name == "" {
+				// Search for MACHINE_NAME for enabled/active instance
+				name = os.Getenv("MACHINE_NAME")
+			}
+
+			info, ok := mach.InstList[name]
+			if !ok {
+				return cli.NewExitError("error/instance-not-found", 1)
+			}
+
+			for _, spec := range c.StringSlice("L") {
+				f, err := ssh.ParseForward(spec)
+				if err != nil {
+					return cli.NewExitError("error/invalid-forward", 1)
+				}
+				local = append(local, f)
+			}
+			for _, spec := range c.StringSlice("R") {
+				f, err := ssh.ParseForward(spec)
+				if err != nil {
+					return cli.NewExitError("error/invalid-forward", 1)
+				}
+				remote = append(remote, f)
+			}
+
+			// Docker socket is forwarded unless only other forwards are asked for
+			if c.IsSet("docker") || len(local)+len(remote) == 0 {
+				var endpoint = c.String("docker")
+				if regexp.MustCompile(`^[0-9]+$`).MatchString(endpoint) {
+					endpoint = "localhost:" + endpoint
+				}
+				info.DockerTunnel = endpoint
+				if endpoint == "" {
+					endpoint = mach.TunnelSocket(name)
+					if err := os.MkdirAll(path.Dir(endpoint), 0700); err != nil {
+						return cli.NewExitError("error/failed-to-create-tunnel-dir", 1)
+					}
+				}
+				local = append(local, ssh.Forward{Listen: endpoint, Dial: "/var/run/docker.sock"})
+				fmt.Printf("# export DOCKER_HOST=%s\n", info.TunnelDockerHost(name))
+			}
+
+			inst := mach.NewHost()
+			inst.HostKey = info.HostKey
+			if len(info.Bastion) > 0 && len(inst.Bastion) == 0 {
+				inst.Bastion = info.Bastion
+			}
+
+			ctx, cancel := interruptContext()
+			defer cancel()
+
+			err := inst.Tunnel(ctx, info.Host, local, remote)
+
+			// Record host key presented and Docker tunnel endpoint
+			info.HostKey = inst.HostKey
+			mach.InstList.Dump()
+
+			if err != nil {
+				return cli.NewExitError("error/failed-to-tunnel", 1)
+			}
+			return nil
 		},
 		BashComplete: func(c *cli.Context) {
 			for name, _ := range mach.InstList {
@@ -376,11 +571,18 @@ func TlsCommand() cli.Command {
 						// Tell host provisioner whether to reuse old Docker Daemon config
 						inst := mach.NewDockerHost()
 						inst.SetProvision(isNew)
+						inst.HostKey = info.HostKey
+						if len(info.Bastion) > 0 && len(inst.Bastion) == 0 {
+							inst.Bastion = info.Bastion
+						}
 
 						if err := inst.InstallDockerEngineCertificate(info.Host, info.AltHost...); err != nil {
 							return cli.NewExitError("error/failed-to-install-docker-cert", 1)
 						}
 
+						// Record host key presented during install
+						info.HostKey = inst.HostKey
+
 						// Force set instance running state
 						info.State = "running"
 					}
@@ -402,6 +604,121 @@ func TlsCommand() cli.Command {
 	}
 }
 
+// signSSHKeys signs each public key file named in c.Args() with sign, writing
+// certificate next to it as OpenSSH expects
+func signSSHKeys(c *cli.Context, defaultValidity time.Duration, sign func(certpath string, pubKey []byte, keyId string, principals []string, validity time.Duration) ([]byte, error)) error {
+	if len(c.Args()) == 0 {
+		return cli.NewExitError("error/required-public-key-missing", 1)
+	}
+	var validity = defaultValidity
+	if valid := c.String("valid"); valid != "" {
+		d, err := time.ParseDuration(valid)
+		if err != nil {
+			return cli.NewExitError("error/invalid-validity", 1)
+		}
+		validity = d
+	}
+	for _, pubFile := range c.Args() {
+		pubKey, err := ioutil.ReadFile(pubFile)
+		if err != nil {
+			return cli.NewExitError("error/public-key-not-found", 1)
+		}
+		signed, err := sign(config.Config.Certpath, pubKey, c.String("id"), c.StringSlice("principal"), validity)
+		if err != nil {
+			return cli.NewExitError("error/failed-to-sign-public-key", 1)
+		}
+		certFile := strings.TrimSuffix(pubFile, ".pub") + "-cert.pub"
+		if err = ioutil.WriteFile(certFile, signed, 0644); err != nil {
+			return cli.NewExitError("error/failed-to-write-ssh-cert", 1)
+		}
+		fmt.Println(certFile)
+	}
+	return nil
+}
+
+func SSHCACommand() cli.Command {
+	var signFlags = []cli.Flag{
+		cli.StringSliceFlag{Name: "principal", Usage: "User or host name certificate is valid for"},
+		cli.StringFlag{Name: "valid", Usage: "Certificate lifetime, e.g. 12h"},
+		cli.StringFlag{Name: "id", Usage: "Key identity recorded in certificate"},
+	}
+	return cli.Command{
+		Name:  "ssh-ca",
+		Usage: "Manage SSH certificate authority",
+		Subcommands: []cli.Command{
+			{
+				Name:  "bootstrap",
+				Usage: "Generate SSH CA keypair",
+				Action: func(c *cli.Context) error {
+					if _, err := os.Stat(path.Join(config.Config.Certpath, cert.SSH_CA_KEY)); err == nil {
+						return cli.NewExitError("error/ssh-ca-exists", 1)
+					}
+					if cert.GenerateSSHCA(config.Config.Certpath) != nil {
+						return cli.NewExitError("error/failed-to-bootstrap-ssh-ca", 1)
+					}
+					return nil
+				},
+			},
+			{
+				Name:  "sign-user",
+				Usage: "Sign user public key with SSH CA",
+				Flags: signFlags,
+				Action: func(c *cli.Context) error {
+					return signSSHKeys(c, cert.SSH_USER_CERT_VALIDITY, cert.SignSSHUserCertificate)
+				},
+			},
+			{
+				Name:  "sign-host",
+				Usage: "Sign host public key with SSH CA",
+				Flags: signFlags,
+				Action: func(c *cli.Context) error {
+					if len(c.StringSlice("principal")) == 0 {
+						return cli.NewExitError("error/required-principal-missing", 1)
+					}
+					return signSSHKeys(c, cert.SSH_HOST_CERT_VALIDITY, cert.SignSSHHostCertificate)
+				},
+			},
+			{
+				Name:  "install",
+				Usage: "Sign host keys and install SSH certificate on target",
+				Action: func(c *cli.Context) error {
+					if len(c.Args()) == 0 {
+						return cli.NewExitError("error/required-instances-missing", 1)
+					}
+					defer mach.InstList.Dump()
+
+					for _, name := range c.Args() {
+						info, ok := mach.InstList[name]
+						if !ok {
+							return cli.NewExitError("error/instances-not-found", 1)
+						}
+
+						inst := mach.NewHost()
+						inst.HostKey = info.HostKey
+						if len(info.Bastion) > 0 && len(inst.Bastion) == 0 {
+							inst.Bastion = info.Bastion
+						}
+
+						if err := inst.InstallSSHCertificate(info.Host, info.AltHost...); err != nil {
+							return cli.NewExitError("error/failed-to-install-ssh-cert", 1)
+						}
+
+						// Record host key presented during install
+						info.HostKey = inst.HostKey
+					}
+
+					return nil
+				},
+				BashComplete: func(c *cli.Context) {
+					for name, _ := range mach.InstList {
+						fmt.Fprint(c.App.Writer, name, " ")
+					}
+				},
+			},
+		},
+	}
+}
+
 func RecipeCommand() cli.Command {
 	return cli.Command{
 		Name:  "recipe",
@@ -1,32 +1,127 @@
 package main
 
 import (
+	config "github.com/poddworks/machine/config"
+	mach "github.com/poddworks/machine/lib/machine"
+
 	"github.com/jeffjen/yaml"
+	"github.com/poddworks/machine/lib/runlog"
 	"github.com/poddworks/machine/lib/ssh"
+	"github.com/poddworks/machine/lib/vault"
 
 	"github.com/urfave/cli"
+	"golang.org/x/net/context"
 
 	"fmt"
 	"io"
 	"os"
+	"os/signal"
+	path "path/filepath"
+	"sort"
 	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// Least time between progress lines of a file being sent
+	PROGRESS_INTERVAL = 2 * time.Second
 )
 
-func parseArgs(c *cli.Context) (user, key, port string, hosts []string) {
-	return c.GlobalString("user"), c.GlobalString("cert"), c.GlobalString("port"), c.GlobalStringSlice("host")
+// parseArgs reports connection settings, leaving port empty unless given
+// explicitly so that ~/.ssh/config may supply it
+func parseArgs(c *cli.Context) (user, key, port string) {
+	if c.GlobalIsSet("port") {
+		port = c.GlobalString("port")
+	}
+	return c.GlobalString("user"), c.GlobalString("cert"), port
+}
+
+// newCommander connects to host, verifying against host key and dialing
+// through bastion recorded for a known instance.  The host "local" runs on
+// this machine instead.
+func newCommander(sshCfg ssh.Config, host string) ssh.Commander {
+	if host == ssh.LOCAL {
+		return ssh.NewLocalBecome(config.Config.Become)
+	}
+	sshCfg.Server = host
+	sshCfg.Identities = config.Config.Identities
+	sshCfg.HostKeyMode = config.Config.HostKeyMode
+	sshCfg.KnownHosts = config.Config.KnownHosts
+	sshCfg.HostCAFile = config.Config.HostCAFile
+	sshCfg.Become = config.Config.Become
+	sshCfg.Jump, _ = ssh.ParseProxyJump(config.Config.Bastion)
+	if _, inst := mach.InstList.FindByHost(host); inst != nil {
+		sshCfg.HostKey = inst.HostKey
+		if len(sshCfg.Jump) == 0 {
+			sshCfg.Jump = inst.Bastion
+		}
+	}
+	return ssh.New(sshCfg)
+}
+
+// interruptContext is cancelled on the first SIGINT so that remote commands
+// are torn down instead of left running; a second SIGINT exits right away
+func interruptContext() (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(context.Background())
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt)
+	go func() {
+		select {
+		case <-sig:
+			fmt.Fprintln(os.Stderr, "Interrupted, stopping remote tasks")
+			cancel()
+		case <-ctx.Done():
+		}
+		signal.Stop(sig)
+	}()
+	return ctx, cancel
+}
+
+// startRun opens the log of this exec run; exec goes on unrecorded when it
+// cannot be opened
+func startRun() *runlog.Run {
+	run, err := runlog.New(config.Config.Runs)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Unable to record run -", err)
+		return nil
+	}
+	fmt.Fprintln(os.Stderr, "Run", run.Id, "- replay with: machine exec logs", run.Id)
+	run.Mask = secrets.Mask
+	return run
+}
+
+// recordHostKey saves host key verified by cmdr to its known instance
+func recordHostKey(cmdr ssh.Commander) {
+	host, _ := cmdr.Host()
+	if _, inst := mach.InstList.FindByHost(host); inst != nil && inst.HostKey == "" {
+		inst.HostKey = cmdr.HostKey()
+	}
 }
 
 func runCmd(c *cli.Context) error {
 	var (
-		cmd                    = strings.Join(c.Args(), " ")
-		collect                = make(chan error)
-		dryrun                 = c.GlobalBool("dryrun")
-		user, key, port, hosts = parseArgs(c)
+		cmd             = strings.Join(c.Args(), " ")
+		check           = c.GlobalBool("dryrun")
+		user, key, port = parseArgs(c)
 
 		sshCfg   = ssh.Config{User: user, Key: key, Port: port}
 		playbook = ssh.Recipe{}
 	)
 
+	defer mach.InstList.Dump()
+
+	_, targets, err := parseTargets(c)
+	if err != nil {
+		return cli.NewExitError(err.Error(), 1)
+	}
+
+	ctx, cancel := interruptContext()
+	defer cancel()
+
+	run := startRun()
+	defer run.Close()
+
 	playbook.Provision = append(playbook.Provision, ssh.Provision{
 		Name:    "Running one command",
 		Ok2fail: false,
@@ -35,16 +130,9 @@ func runCmd(c *cli.Context) error {
 		},
 	})
 
-	var errCnt = 0
-	for _, host := range hosts {
-		sshCfg.Server = host
-		go exec(collect, dryrun, ssh.New(sshCfg), &playbook)
-	}
-	for chk := 0; chk < len(hosts); chk++ {
-		if e := <-collect; e != nil {
-			errCnt++
-		}
-	}
+	errCnt := fanOut(c.GlobalInt("forks"), targets, func(t target, collect chan<- error) {
+		exec(ctx, collect, check, run, nil, t.commander(sshCfg), &playbook, runlog.Start(0))
+	})
 	if errCnt > 0 {
 		return cli.NewExitError("One or more task failed", 1)
 	}
@@ -54,16 +142,28 @@ func runCmd(c *cli.Context) error {
 
 func runScript(c *cli.Context) error {
 	var (
-		scripts                = c.Args()
-		collect                = make(chan error)
-		sudo                   = c.Bool("sudo")
-		dryrun                 = c.GlobalBool("dryrun")
-		user, key, port, hosts = parseArgs(c)
+		scripts         = c.Args()
+		sudo            = c.Bool("sudo")
+		check           = c.GlobalBool("dryrun")
+		user, key, port = parseArgs(c)
 
 		sshCfg   = ssh.Config{User: user, Key: key, Port: port}
 		playbook = ssh.Recipe{}
 	)
 
+	defer mach.InstList.Dump()
+
+	_, targets, err := parseTargets(c)
+	if err != nil {
+		return cli.NewExitError(err.Error(), 1)
+	}
+
+	ctx, cancel := interruptContext()
+	defer cancel()
+
+	run := startRun()
+	defer run.Close()
+
 	for _, script := range scripts {
 		playbook.Provision = append(playbook.Provision, ssh.Provision{
 			Name:    fmt.Sprintf("Running script %s", script),
@@ -74,16 +174,9 @@ func runScript(c *cli.Context) error {
 		})
 	}
 
-	var errCnt = 0
-	for _, host := range hosts {
-		sshCfg.Server = host
-		go exec(collect, dryrun, ssh.New(sshCfg), &playbook)
-	}
-	for chk := 0; chk < len(hosts); chk++ {
-		if e := <-collect; e != nil {
-			errCnt++
-		}
-	}
+	errCnt := fanOut(c.GlobalInt("forks"), targets, func(t target, collect chan<- error) {
+		exec(ctx, collect, check, run, nil, t.commander(sshCfg), &playbook, runlog.Start(0))
+	})
 	if errCnt > 0 {
 		return cli.NewExitError("One or more task failed", 1)
 	}
@@ -93,53 +186,300 @@ func runScript(c *cli.Context) error {
 
 func runPlaybook(c *cli.Context) error {
 	var (
-		collect                = make(chan error)
-		dryrun                 = c.GlobalBool("dryrun")
-		user, key, port, hosts = parseArgs(c)
+		check           = c.GlobalBool("dryrun")
+		forks           = c.GlobalInt("forks")
+		user, key, port = parseArgs(c)
 
 		sshCfg = ssh.Config{User: user, Key: key, Port: port}
 	)
 
-	if len(c.Args()) == 0 {
+	defer mach.InstList.Dump()
+
+	inv, targets, err := parseTargets(c)
+	if err != nil {
+		return cli.NewExitError(err.Error(), 1)
+	}
+
+	ctx, cancel := interruptContext()
+	defer cancel()
+
+	run := startRun()
+	defer run.Close()
+
+	summary := newRecap()
+	defer summary.print()
+
+	known := newFactCache()
+
+	var (
+		file    = c.Args().First()
+		resume  *runlog.State
+		startAt = c.String("start-at")
+		started = startAt == ""
+	)
+
+	if id := c.String("resume"); id != "" {
+		if resume, err = runlog.ReadState(config.Config.Runs, id); err == runlog.ErrRunNotFound {
+			return cli.NewExitError("error/run-not-found", 1)
+		} else if err == runlog.ErrNoProgress {
+			return cli.NewExitError("error/run-not-resumable", 1)
+		} else if err != nil {
+			return cli.NewExitError("error/failed-to-read-run", 1)
+		}
+		if file == "" {
+			file = resume.Playbook
+		}
+		if len(targets) == 0 {
+			// Pick up on every host of the run resumed
+			for host := range resume.Hosts {
+				targets = append(targets, target{Host: host})
+			}
+			sort.Slice(targets, func(i, j int) bool { return targets[i].Host < targets[j].Host })
+		}
+		if !check {
+			// Hosts left behind remain resumable from this run
+			for host, at := range resume.Hosts {
+				run.Mark(host, at)
+			}
+		}
+	}
+
+	if file == "" {
 		return cli.NewExitError("No playbook specified", 1)
 	}
 
-	r, err := os.Open(c.Args()[0])
+	vars, err := parseVars(c.String("vars-file"), c.StringSlice("var"))
 	if err != nil {
+		return cli.NewExitError(err.Error(), 1)
+	}
+
+	if _, err = os.Stat(file); err != nil {
 		return cli.NewExitError("error/playbook-not-found", 1)
 	}
-	defer r.Close()
+	docs, err := ssh.LoadPlaybook(file)
+	if err != nil {
+		return cli.NewExitError(err.Error(), 1)
+	}
+	for _, playbook := range docs {
+		if err = playbook.CheckNotify(); err != nil {
+			return cli.NewExitError(err.Error(), 1)
+		}
+	}
 
-	var decoder = yaml.NewDecoder(r)
-	defer decoder.Close()
-	for {
-		playbook := new(ssh.Recipe)
-		if err = decoder.Decode(playbook); err != nil {
-			if err == io.EOF {
-				break
-			} else {
-				return cli.NewExitError("Deocoding playbook content error", 1)
+	if abs, err := path.Abs(file); err == nil && !check {
+		run.SetPlaybook(abs)
+	}
+
+	for doc, playbook := range docs {
+		var begin = runlog.Start(doc)
+		if !started {
+			for idx, p := range playbook.Provision {
+				if p.Name == startAt {
+					started, begin.Provision = true, idx
+					break
+				}
+			}
+			if !started {
+				continue // ahead of the section started at
+			}
+		}
+		var hosts = targets
+		if len(playbook.Hosts) > 0 {
+			matched, err := selectTargets(inv, playbook.Hosts)
+			if err != nil {
+				return cli.NewExitError(err.Error(), 1)
+			}
+			if len(targets) > 0 {
+				// command line limits the play
+				if matched, err = limitTargets(matched, targets); err != nil {
+					return cli.NewExitError(err.Error(), 1)
+				}
+			}
+			hosts = matched
+		}
+		if playbook.Connection == ssh.LOCAL {
+			hosts = []target{{Host: ssh.LOCAL}} // run once on this machine
+		}
+		size, err := playbook.BatchSize(len(hosts))
+		if err != nil {
+			return cli.NewExitError(err.Error(), 1)
+		}
+		play := func(t target, collect chan<- error) {
+			var (
+				cmdr   = t.commander(sshCfg)
+				layers = []map[string]interface{}{playbook.Vars, t.Vars, vars}
+				from   = begin
+			)
+			if resume != nil {
+				host, _ := cmdr.Host()
+				at, ok := resume.Hosts[host]
+				if !ok || at.Document > doc {
+					cmdr.Close()
+					collect <- nil // not in the run resumed, or done with it
+					return
+				}
+				if at.Document == doc {
+					from = at.Resumed()
+				}
+			}
+			// fail gives up on host before playbook starts, leaving it
+			// resumable from where it was to begin
+			fail := func(err error) {
+				host, _ := cmdr.Host()
+				say(os.Stderr, host, "-", err)
+				summary.add(host, ssh.NewResult(nil, nil, nil, err))
+				if at := from; !check {
+					at.Failed, at.Error = true, err.Error()
+					run.Mark(host, at)
+				}
+				cmdr.Close()
+				collect <- err
+			}
+			if playbook.GatherFacts == nil || *playbook.GatherFacts {
+				hostFacts, err := known.get(ctx, cmdr, t)
+				if err != nil {
+					fail(fmt.Errorf("Unable to gather facts: %v", err))
+					return
+				}
+				layers = append([]map[string]interface{}{{"facts": hostFacts}}, layers...)
+			}
+			rendered, err := playbook.Render(t.vars(layers...))
+			if err != nil {
+				fail(err)
+				return
 			}
+			exec(ctx, collect, check, run, summary, cmdr, rendered, from)
 		}
-		var errCnt = 0
-		for _, host := range hosts {
-			sshCfg.Server = host
-			go exec(collect, dryrun, ssh.New(sshCfg), playbook)
+		// Roll through hosts batch by batch, stopping once too many fail
+		var errCnt, done = 0, 0
+		for start := 0; start < len(hosts); start += size {
+			end := start + size
+			if end > len(hosts) {
+				end = len(hosts)
+			}
+			if size < len(hosts) {
+				fmt.Fprintln(os.Stderr, "Batch", start/size+1, "-", end-start, "of", len(hosts), "hosts")
+			}
+			failed := fanOut(forks, hosts[start:end], play)
+			if errCnt, done = errCnt+failed, end; ctx.Err() != nil {
+				break
+			}
+			if playbook.Aborts(failed, end-start) {
+				if end < len(hosts) {
+					fmt.Fprintln(os.Stderr, "Too many hosts failed, skipping", len(hosts)-end, "hosts left")
+				}
+				break
+			}
 		}
-		for chk := 0; chk < len(hosts); chk++ {
-			if e := <-collect; e != nil {
-				errCnt++
+		if !check && resume == nil {
+			// Hosts of batches skipped remain resumable from the start;
+			// those of a run resumed were recorded as they were
+			for _, t := range hosts[done:] {
+				cmdr := t.commander(sshCfg)
+				host, _ := cmdr.Host()
+				cmdr.Close()
+				run.Mark(host, begin)
 			}
 		}
 		if errCnt > 0 {
 			return cli.NewExitError("One or more task failed", 1)
 		}
 	}
+	if !started {
+		return cli.NewExitError("error/section-not-found", 1)
+	}
+
+	return nil
+}
+
+// fanOut runs task on each of hosts, at most forks at a time unless forks is
+// 0, and reports how many failed.  task reports its outcome through collect.
+func fanOut(forks int, hosts []target, task func(t target, collect chan<- error)) (errCnt int) {
+	var (
+		collect = make(chan error)
+		slots   chan struct{}
+	)
+	if forks > 0 {
+		slots = make(chan struct{}, forks)
+	}
+	for _, t := range hosts {
+		go func(t target) {
+			if slots != nil {
+				slots <- struct{}{}
+				defer func() { <-slots }()
+			}
+			task(t, collect)
+		}(t)
+	}
+	for chk := 0; chk < len(hosts); chk++ {
+		if e := <-collect; e != nil {
+			errCnt++
+		}
+	}
+	return errCnt
+}
+
+// parseVars loads variables from vars file, decrypting it when vault
+// encrypted, then applies each key=value assignment on top
+func parseVars(varsFile string, assigns []string) (map[string]interface{}, error) {
+	var vars = make(map[string]interface{})
+	if varsFile != "" {
+		content, err := ssh.Vault.ReadFile(varsFile)
+		if err != nil {
+			return nil, err
+		}
+		if err = yaml.Unmarshal(content, &vars); err != nil {
+			return nil, fmt.Errorf("Unable to parse %s: %v", varsFile, err)
+		}
+		if vault.IsEncryptedFile(varsFile) {
+			secrets.AddValues(vars) // keep them out of output and run log
+		}
+	}
+	for _, assign := range assigns {
+		kv := strings.SplitN(assign, "=", 2)
+		if len(kv) != 2 || kv[0] == "" {
+			return nil, fmt.Errorf("error/invalid-var: %s", assign)
+		}
+		vars[kv[0]] = kv[1]
+	}
+	return vars, nil
+}
+
+func runLogs(c *cli.Context) error {
+	var (
+		id   = c.Args().First()
+		host = c.String("host")
+	)
+
+	if id == "" {
+		ids, err := runlog.List(config.Config.Runs)
+		if err != nil {
+			return cli.NewExitError("error/failed-to-list-runs", 1)
+		}
+		for _, id := range ids {
+			fmt.Println(id)
+		}
+		return nil
+	}
+
+	records, err := runlog.Read(config.Config.Runs, id, host)
+	if err == runlog.ErrRunNotFound {
+		return cli.NewExitError("error/run-not-found", 1)
+	} else if err != nil {
+		return cli.NewExitError("error/failed-to-read-run", 1)
+	}
+	for _, rec := range records {
+		fmt.Println(rec.Format(host == ""))
+	}
 
 	return nil
 }
 
-func exec(collect chan<- error, dryrun bool, cmdr ssh.Commander, playbook *ssh.Recipe) {
+// exec runs playbook through cmdr, tallying how each step went in summary
+// when given.  In check mode archives and modules report what they would
+// change, and commands and scripts are skipped.  Steps before from are taken
+// as done; where the host got to is recorded in run for resuming.
+func exec(ctx context.Context, collect chan<- error, check bool, run *runlog.Run, summary *recap, cmdr ssh.Commander, playbook *ssh.Recipe, from runlog.Progress) {
 	var (
 		// place holder for command output
 		text string
@@ -149,73 +489,465 @@ func exec(collect chan<- error, dryrun bool, cmdr ssh.Commander, playbook *ssh.R
 	)
 
 	defer cmdr.Close()
+	defer recordHostKey(cmdr)
+
+	// Handlers notified by steps that changed something, and those that ran
+	var notified, handled = make(map[string]bool), make(map[string]bool)
+	for _, name := range from.Notified {
+		notified[name] = true
+	}
+	for _, name := range from.Handled {
+		handled[name] = true
+	}
+
+	notify := func(changed bool, names ssh.Names) {
+		for _, name := range names {
+			notified[name] = notified[name] || changed
+		}
+	}
+
+	// send transfers archive a, or in check mode compares it with what is on
+	// remote, recording how it went.  Archive notifying handlers is sent
+	// only when it differs from remote, so that they fire on change alone.
+	send := func(provision string, a ssh.Archive) error {
+		var (
+			action = fmt.Sprintf("send %s %s", a.Source(cmdr), a.Dest())
+			begin  = time.Now()
+			label  = provision
 
-	for _, a := range playbook.Archive {
-		fmt.Println(host, "-", "sending", "-", a.Source(cmdr), "-", a.Dest())
-		if dryrun {
-			continue // skip ahead
+			changed = true
+			diff    string
+			err     error
+		)
+		if label == "" {
+			label = "sending"
 		}
-		if a.Skip {
-			continue // skip ahead
+		run.Log(runlog.Record{Host: host, Provision: provision, Action: action, Event: runlog.EVENT_START})
+		if check {
+			changed, diff, err = a.Check(ctx, cmdr)
+		} else if len(a.Notify) > 0 {
+			if changed, diff, err = a.Check(ctx, cmdr); err == nil && changed {
+				err = a.SendProgress(cmdr, sendProgress(host, label))
+			}
 		} else {
-			if err := a.Send(cmdr); err != nil {
-				fmt.Fprintln(os.Stderr, host, "-", err)
-				collect <- err
-				return
+			err = a.SendProgress(cmdr, sendProgress(host, label))
+		}
+		for _, line := range strings.Split(strings.TrimSuffix(diff, "\n"), "\n") {
+			if line != "" {
+				say(os.Stdout, host, "-", label, "-", line)
+				run.Log(runlog.Record{Host: host, Provision: provision, Action: action, Event: runlog.EVENT_OUTPUT, Stream: "stdout", Text: line})
+			}
+		}
+		run.Log(exitRecord(host, provision, action, begin, nil, err))
+		summary.add(host, ssh.Result{"failed": err != nil, "changed": changed, "skipped": false})
+		notify(err == nil && changed, a.Notify)
+		return err
+	}
+
+	// act runs step a once, recording how it went
+	act := func(provision string, a ssh.Action) (ssh.Result, error) {
+		var (
+			action = a.Command()
+			begin  = time.Now()
+
+			stdout, stderr []string
+			outcome        *ssh.ExitStatus
+		)
+		run.Log(runlog.Record{Host: host, Provision: provision, Action: action, Event: runlog.EVENT_START})
+		respStream, err := a.ActContext(ctx, cmdr)
+		if err != nil {
+			say(os.Stderr, host, "-", provision, "-", err)
+			run.Log(exitRecord(host, provision, action, begin, nil, err))
+			return a.Result(nil, nil, nil, err), err
+		}
+		for output := range respStream {
+			text, err = output.Data()
+			status, exited := output.Exit()
+			if exited && a.Accept(status) {
+				err = nil // exit code marked as okay for this action
+			}
+			if output.Source() == 0 {
+				if exited {
+					outcome = &status
+				}
+				run.Log(exitRecord(host, provision, action, begin, outcome, err))
+			}
+			if err != nil {
+				say(os.Stderr, host, "-", provision, "-", err)
+				// steam will end because error state delivers last
+			} else if output.Source() == ssh.STDERR {
+				say(os.Stderr, host, "-", provision, "-", text)
+				run.Log(runlog.Record{Host: host, Provision: provision, Action: action, Event: runlog.EVENT_OUTPUT, Stream: "stderr", Text: text})
+				stderr = append(stderr, text)
+			} else if output.Source() == ssh.STDOUT {
+				say(os.Stdout, host, "-", provision, "-", text)
+				run.Log(runlog.Record{Host: host, Provision: provision, Action: action, Event: runlog.EVENT_OUTPUT, Stream: "stdout", Text: text})
+				stdout = append(stdout, text)
 			}
 		}
+		return a.Result(stdout, stderr, outcome, err), err
 	}
 
-	for _, p := range playbook.Provision {
-		fmt.Println(host, "-", "playbook section", "-", p.Name)
-		if dryrun {
-			continue // skip ahead
+	// attempt runs step a until it is done or out of retries
+	attempt := func(provision string, a ssh.Action) (ssh.Result, error) {
+		retries, delay, err := a.RetryPolicy()
+		if err != nil {
+			say(os.Stderr, host, "-", provision, "-", err)
+			return ssh.NewResult(nil, nil, nil, err), err
 		}
+		for {
+			result, err := act(provision, a)
+			done, derr := a.Done(result)
+			if derr != nil {
+				say(os.Stderr, host, "-", provision, "-", derr)
+				return result, derr
+			}
+			if done || ctx.Err() != nil {
+				return result, err
+			}
+			if retries == 0 {
+				if err == nil {
+					err = ssh.ErrUntilNotMet
+					say(os.Stderr, host, "-", provision, "-", err)
+				}
+				return result, err
+			}
+			say(os.Stderr, host, "-", provision, "-", "retrying in", delay, "-", retries, "attempts left")
+			select {
+			case <-time.After(delay):
+			case <-ctx.Done():
+				return result, ctx.Err()
+			}
+			retries--
+		}
+	}
+
+	// Variables of this host, gaining results registered along the way,
+	// including those of the run resumed
+	var (
+		vars       = playbook.Variables()
+		registered = make(map[string]interface{})
+	)
+	for name, result := range from.Registered {
+		registered[name] = ssh.RestoreResult(result)
+		if vars != nil {
+			vars[name] = registered[name]
+		}
+	}
+
+	// Where this host is at in the playbook, recorded for resuming along
+	// with handlers notified and results registered to get there
+	var at = from
+
+	save := func() {
+		if check {
+			return
+		}
+		at.Notified, at.Handled = setNames(notified), setNames(handled)
+		at.Registered = make(map[string]interface{}, len(registered))
+		for name, result := range registered {
+			at.Registered[name] = result // copied, as run saves all hosts at once
+		}
+		run.Mark(host, at)
+	}
+
+	mark := func(provision, action int) {
+		at.Provision, at.Action = provision, action
+		save()
+	}
+
+	// section runs provision block p at index idx, playbook section or
+	// handler alike, from action first on
+	section := func(kind string, idx int, p ssh.Provision, first int) error {
+		say(os.Stdout, host, "-", kind, "-", p.Name)
+		mark(idx, first)
 		if p.Skip {
-			continue // skip ahead
+			return nil // skip ahead
+		}
+		var scope = p.Variables(vars)
+		if ok, err := p.Applies(scope); err != nil {
+			say(os.Stderr, host, "-", p.Name, "-", err)
+			summary.add(host, ssh.NewResult(nil, nil, nil, err))
+			return err
+		} else if !ok {
+			say(os.Stdout, host, "-", p.Name, "-", "skipped")
+			return nil // condition not met
 		}
 		for _, a := range p.Archive {
-			fmt.Println(host, "-", p.Name, "-", "sending", "-", a.Source(cmdr), "-", a.Dest())
+			if first > 0 {
+				break // sent before the action resumed from
+			}
+			say(os.Stdout, host, "-", p.Name, "-", "sending", "-", a.Source(cmdr), "-", a.Dest())
 			if a.Skip {
+				summary.add(host, ssh.SkippedResult())
 				continue // skip ahead
 			} else {
-				if err := a.Send(cmdr); err != nil {
-					fmt.Fprintln(os.Stderr, host, "-", err)
-					collect <- err
-					return
+				if err := ctx.Err(); err != nil {
+					return err
+				}
+				if err := send(p.Name, a); err != nil {
+					say(os.Stderr, host, "-", err)
+					return err
 				}
 			}
 		}
-		for _, a := range p.Action {
-			fmt.Println(host, "-", p.Name, "-", a.Command())
-			if a.Skip {
-				continue // skip ahead
-			} else {
-				respStream, err := a.Act(cmdr)
-				if err != nil {
-					fmt.Fprintln(os.Stderr, host, "-", p.Name, "-", err)
-					collect <- err
-					return
+		for jdx, a := range p.Action {
+			if jdx < first {
+				continue // done in an earlier run
+			}
+			mark(idx, jdx)
+			steps, err := a.Expand(scope)
+			if err != nil {
+				say(os.Stderr, host, "-", p.Name, "-", err)
+				summary.add(host, ssh.NewResult(nil, nil, nil, err))
+				return err
+			}
+			var (
+				results []ssh.Result
+				abort   error
+			)
+			for _, step := range steps {
+				say(os.Stdout, host, "-", p.Name, "-", step.Command())
+				if step.Skip {
+					results = append(results, ssh.SkippedResult())
+					continue // skip ahead
 				}
-				for output := range respStream {
-					text, err = output.Data()
-					if err != nil {
-						fmt.Fprintln(os.Stderr, host, "-", p.Name, "-", err)
-						// steam will end because error state delivers last
-					} else {
-						fmt.Println(host, "-", p.Name, "-", text)
+				if ok, err := step.Applies(); err != nil {
+					say(os.Stderr, host, "-", p.Name, "-", err)
+					results, abort = append(results, ssh.NewResult(nil, nil, nil, err)), err
+					break
+				} else if !ok {
+					say(os.Stdout, host, "-", p.Name, "-", "skipped")
+					results = append(results, ssh.SkippedResult())
+					continue // condition not met
+				}
+				if check {
+					if step.Module() == nil {
+						say(os.Stdout, host, "-", p.Name, "-", "skipped in check mode")
+						results = append(results, ssh.SkippedResult())
+						continue // command may change anything
 					}
+					step = step.CheckMode()
 				}
-				// abort if action failed and its not okay to fail
-				if err != nil && !p.Ok2fail {
-					collect <- err
-					return
+				result, err := attempt(p.Name, step)
+				results = append(results, result)
+				// abort if action failed and its not okay to fail, or
+				// playbook was interrupted
+				if err != nil && (!p.Ok2fail || ctx.Err() != nil) {
+					abort = err
+					break
 				}
 			}
+			summary.add(host, a.Registered(results))
+			notify(abort == nil && a.Registered(results).Changed(), a.Notify)
+			if abort != nil {
+				return abort
+			}
+			if a.Register != "" {
+				registered[a.Register] = a.Registered(results)
+			}
+			if a.Register != "" && vars != nil {
+				vars[a.Register], scope[a.Register] = a.Registered(results), a.Registered(results)
+			}
 		}
 		// Wipe the slate for this provision block
-		p.Clean(cmdr)
+		if !check {
+			p.Clean(cmdr)
+		}
+		return nil
+	}
+
+	// play goes through playbook from where this host is at
+	play := func() error {
+		if from.Provision < 0 {
+			mark(-1, 0)
+			for _, a := range playbook.Archive {
+				say(os.Stdout, host, "-", "sending", "-", a.Source(cmdr), "-", a.Dest())
+				if a.Skip {
+					summary.add(host, ssh.SkippedResult())
+					continue // skip ahead
+				}
+				if err := ctx.Err(); err != nil {
+					return err
+				}
+				if err := send("", a); err != nil {
+					say(os.Stderr, host, "-", err)
+					return err
+				}
+			}
+		}
+		for idx, p := range playbook.Provision {
+			var first = 0
+			if idx < from.Provision {
+				continue // done in an earlier run
+			} else if idx == from.Provision {
+				first = from.Action
+			}
+			if err := section("playbook section", idx, p, first); err != nil {
+				return err
+			}
+		}
+
+		// Handlers run once each at the end, in the order they are listed
+		for {
+			h, ok := playbook.NextHandler(notified, handled)
+			if !ok {
+				break
+			}
+			var first = 0
+			if h.Name == from.Handler {
+				first = from.Action
+			}
+			at.Handler = h.Name
+			if err := section("running handler", len(playbook.Provision), h, first); err != nil {
+				return err
+			}
+			handled[h.Name] = true
+		}
+		return nil
+	}
+
+	if err := play(); err != nil {
+		at.Failed, at.Error = true, err.Error()
+		save()
+		collect <- err
+		return
+	}
+	if !check {
+		run.Mark(host, runlog.Start(at.Document+1))
 	}
 
 	collect <- nil // mark end of playbook
 }
+
+// setNames lists names in set, sorted
+func setNames(set map[string]bool) (names []string) {
+	for name, ok := range set {
+		if ok {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return
+}
+
+// sendProgress prints how far each file sent to host got, every
+// PROGRESS_INTERVAL while it is under way and once more when it is done, so
+// that large transfers do not look stuck.  Files taking less time go by
+// without a word.
+func sendProgress(host, label string) func(name string, done, size int64) {
+	var (
+		name        string
+		start, last time.Time
+		finished    bool
+	)
+	return func(file string, done, size int64) {
+		var now = time.Now()
+		if file != name {
+			name, start, last, finished = file, now, now, false
+		}
+		if finished || now.Sub(last) < PROGRESS_INTERVAL && (done < size || now.Sub(start) < PROGRESS_INTERVAL) {
+			return
+		}
+		last, finished = now, done >= size
+		var percent int64 = 100
+		if size > 0 {
+			percent = done * 100 / size
+		}
+		say(os.Stdout, host, "-", label, "-", file, "-", fmt.Sprintf("%s of %s (%d%%)", byteSize(done), byteSize(size), percent))
+	}
+}
+
+// byteSize formats n bytes in the largest unit it makes at least one of
+func byteSize(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%dB", n)
+	}
+	var (
+		value  = float64(n) / unit
+		suffix = 0
+	)
+	for ; value >= unit && suffix < 3; suffix++ {
+		value /= unit
+	}
+	return fmt.Sprintf("%.1f%ciB", value, "KMGT"[suffix])
+}
+
+// say prints a line to w as fmt.Fprintln does, with secrets masked
+func say(w io.Writer, a ...interface{}) {
+	fmt.Fprint(w, secrets.Mask(fmt.Sprintln(a...)))
+}
+
+// recap tallies how steps went on each host, for the summary at the end of a
+// playbook; nil recap tallies nothing
+type recap struct {
+	sync.Mutex
+
+	counts map[string]*tally
+}
+
+type tally struct {
+	ok, changed, failed, skipped int
+}
+
+func newRecap() *recap {
+	return &recap{counts: make(map[string]*tally)}
+}
+
+// add counts step that ended with result on host
+func (r *recap) add(host string, result ssh.Result) {
+	if r == nil {
+		return
+	}
+	r.Lock()
+	defer r.Unlock()
+	t, ok := r.counts[host]
+	if !ok {
+		t = new(tally)
+		r.counts[host] = t
+	}
+	switch {
+	case result.Failed():
+		t.failed++
+	case result.Skipped():
+		t.skipped++
+	case result.Changed():
+		t.changed++
+	default:
+		t.ok++
+	}
+}
+
+// print reports counts of each host
+func (r *recap) print() {
+	r.Lock()
+	defer r.Unlock()
+	var hosts = make([]string, 0, len(r.counts))
+	for host := range r.counts {
+		hosts = append(hosts, host)
+	}
+	sort.Strings(hosts)
+	for _, host := range hosts {
+		t := r.counts[host]
+		fmt.Println(host, "-", "summary", "-", fmt.Sprintf("ok=%d changed=%d failed=%d skipped=%d", t.ok, t.changed, t.failed, t.skipped))
+	}
+}
+
+// exitRecord describes how an action or transfer begun at begin ended
+func exitRecord(host, provision, action string, begin time.Time, status *ssh.ExitStatus, err error) runlog.Record {
+	rec := runlog.Record{
+		Host:      host,
+		Provision: provision,
+		Action:    action,
+		Event:     runlog.EVENT_EXIT,
+		Duration:  time.Since(begin).Seconds(),
+	}
+	if status != nil {
+		rec.ExitCode, rec.Signal = &status.Code, status.Signal
+	}
+	if err != nil {
+		rec.Error = err.Error()
+	}
+	return rec
+}
@@ -0,0 +1,723 @@
+package main
+
+import (
+	"github.com/poddworks/machine/config"
+	"github.com/poddworks/machine/lib/runlog"
+	"github.com/poddworks/machine/lib/ssh"
+	"github.com/poddworks/machine/lib/ssh/sshtest"
+	"github.com/poddworks/machine/lib/vault"
+
+	"github.com/urfave/cli"
+	cryptossh "golang.org/x/crypto/ssh"
+	"golang.org/x/net/context"
+
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Record of what stand-in sudo was asked to run, see TestMain
+var sudoRecord string
+
+func init() {
+	// Keep user's OpenSSH client config out of the way
+	ssh.UserConfigFile = os.DevNull
+}
+
+// TestMain puts stand-in sudo(8) ahead in PATH, recording its arguments and
+// failing, so that no test escalates on the machine running it
+func TestMain(m *testing.M) {
+	dir, err := ioutil.TempDir("", "sudo")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	sudoRecord = filepath.Join(dir, "record")
+	stub := fmt.Sprintf("#!/bin/sh\necho \"$@\" >> '%s'\nexit 1\n", sudoRecord)
+	if err = ioutil.WriteFile(filepath.Join(dir, "sudo"), []byte(stub), 0755); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	os.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+	code := m.Run()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+// execOptions are what exec takes besides commander and playbook; the zero
+// value runs the whole playbook without run log or summary
+type execOptions struct {
+	check   bool
+	run     *runlog.Run
+	summary *recap
+	from    *runlog.Progress // nil for the beginning
+}
+
+func runTestExec(cmdr ssh.Commander, playbook *ssh.Recipe, opts execOptions) error {
+	var from = runlog.Start(0)
+	if opts.from != nil {
+		from = *opts.from
+	}
+	collect := make(chan error, 1)
+	exec(context.Background(), collect, opts.check, opts.run, opts.summary, cmdr, playbook, from)
+	return <-collect
+}
+
+func TestExec(t *testing.T) {
+	srv, err := sshtest.NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	host, port := srv.Host()
+	newTestCommander := func() ssh.Commander {
+		return ssh.New(ssh.Config{
+			User:     srv.User,
+			Password: srv.Password,
+			Server:   host,
+			Port:     port,
+			HostKey:  ssh.Fingerprint(srv.HostKey),
+		})
+	}
+
+	src := filepath.Join(srv.Dir, "src.txt")
+	ioutil.WriteFile(src, []byte("payload"), 0644)
+	playbook := &ssh.Recipe{
+		Archive: []ssh.Archive{
+			{Src: src, Dst: "dst.txt", Dir: filepath.Join(srv.Dir, "out")},
+		},
+		Provision: []ssh.Provision{
+			{Name: "tolerated", Ok2fail: true, Action: []ssh.Action{{Cmd: "exit 1"}}},
+			{Name: "accepted", Action: []ssh.Action{{Cmd: "exit 3", Okcodes: []int{3}}}},
+			{Name: "marker", Action: []ssh.Action{{Cmd: "touch marker"}}},
+		},
+	}
+	if err = runTestExec(newTestCommander(), playbook, execOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := ioutil.ReadFile(filepath.Join(srv.Dir, "out", "dst.txt")); string(data) != "payload" {
+		t.Errorf("archive not sent, got %q", data)
+	}
+	if _, err = os.Stat(filepath.Join(srv.Dir, "marker")); err != nil {
+		t.Errorf("playbook did not run to the end: %v", err)
+	}
+
+	playbook = &ssh.Recipe{
+		Provision: []ssh.Provision{
+			{Name: "failing", Action: []ssh.Action{{Cmd: "exit 2"}}},
+			{Name: "unreached", Action: []ssh.Action{{Cmd: "touch unreached"}}},
+		},
+	}
+	if err = runTestExec(newTestCommander(), playbook, execOptions{}); err == nil {
+		t.Error("expected failing action to abort playbook")
+	}
+	if _, err = os.Stat(filepath.Join(srv.Dir, "unreached")); !os.IsNotExist(err) {
+		t.Error("expected playbook to stop at failing action")
+	}
+}
+
+func TestExecLocal(t *testing.T) {
+	dir, err := ioutil.TempDir("", "local")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	marker := filepath.Join(dir, "marker")
+	playbook := &ssh.Recipe{
+		Provision: []ssh.Provision{
+			{Name: "local", Action: []ssh.Action{{Cmd: "touch " + marker}}},
+		},
+	}
+	if err = runTestExec(ssh.NewLocal(), playbook, execOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = os.Stat(marker); err != nil {
+		t.Errorf("local action did not run: %v", err)
+	}
+	if called, _ := ioutil.ReadFile(sudoRecord); len(called) > 0 {
+		t.Errorf("expected local playbook to run without sudo, got sudo %s", called)
+	}
+}
+
+func TestExecControl(t *testing.T) {
+	dir, err := ioutil.TempDir("", "control")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	counter := filepath.Join(dir, "counter")
+	playbook, err := (&ssh.Recipe{
+		Provision: []ssh.Provision{
+			{Name: "detect", Action: []ssh.Action{
+				{Cmd: "echo manager", Register: "role"},
+				{Cmd: "echo tick >> " + counter + "; wc -l < " + counter, Register: "ticks", Until: `contains .ticks.stdout "2"`, Delay: "10ms"},
+				{Cmd: "echo tick >> " + counter + "; test $(wc -l < " + counter + ") -ge 4", Retries: 2, Delay: "10ms"},
+			}},
+			{Name: "manager", When: `eq .role.stdout "manager"`, Action: []ssh.Action{
+				{Cmd: "touch " + dir + "/{{.item}}", Loop: []interface{}{"a", "b", "c"}, When: `ne .item "c"`, Register: "touched"},
+				{Cmd: "touch " + dir + "/registered", When: "not .touched.failed"},
+			}},
+			{Name: "worker", When: `eq .role.stdout "worker"`, Action: []ssh.Action{
+				{Cmd: "touch " + dir + "/worker"},
+			}},
+		},
+	}).Render(map[string]interface{}{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = runTestExec(ssh.NewLocal(), playbook, execOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	for name, want := range map[string]bool{"a": true, "b": true, "c": false, "registered": true, "worker": false} {
+		if _, err := os.Stat(filepath.Join(dir, name)); (err == nil) != want {
+			t.Errorf("expected %s to exist: %v", name, want)
+		}
+	}
+	if data, _ := ioutil.ReadFile(counter); strings.Count(string(data), "tick") != 4 {
+		t.Errorf("unexpected number of attempts %q", data)
+	}
+
+	playbook, _ = (&ssh.Recipe{
+		Provision: []ssh.Provision{
+			{Name: "never", Action: []ssh.Action{{Cmd: "echo no", Register: "out", Until: `eq .out.stdout "yes"`, Retries: 1, Delay: "10ms"}}},
+		},
+	}).Render(map[string]interface{}{})
+	if err = runTestExec(ssh.NewLocal(), playbook, execOptions{}); err != ssh.ErrUntilNotMet {
+		t.Errorf("expected ErrUntilNotMet, got %v", err)
+	}
+}
+
+func TestExecCheck(t *testing.T) {
+	dir, err := ioutil.TempDir("", "check")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var (
+		src    = filepath.Join(dir, "app.conf")
+		dest   = filepath.Join(dir, "etc")
+		limits = filepath.Join(dir, "limits.conf")
+		marker = filepath.Join(dir, "marker")
+	)
+	ioutil.WriteFile(src, []byte("port=8080\n"), 0644)
+	ioutil.WriteFile(limits, []byte("# limits\n"), 0644)
+	os.Mkdir(dest, 0755)
+	playbook, err := (&ssh.Recipe{
+		Archive: []ssh.Archive{{Src: src, Dir: dest}},
+		Provision: []ssh.Provision{
+			{Name: "configure", Action: []ssh.Action{
+				{Modules: ssh.Modules{LineInFile: &ssh.LineInFileModule{Path: limits, Line: "* - nofile 100000"}}},
+				{Cmd: "touch " + marker},
+			}},
+		},
+	}).Render(map[string]interface{}{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	summary := newRecap()
+	if err = runTestExec(ssh.NewLocal(), playbook, execOptions{check: true, summary: summary}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = os.Stat(filepath.Join(dest, "app.conf")); !os.IsNotExist(err) {
+		t.Error("archive sent in check mode")
+	}
+	if data, _ := ioutil.ReadFile(limits); string(data) != "# limits\n" {
+		t.Errorf("module changed file in check mode %q", data)
+	}
+	if _, err = os.Stat(marker); !os.IsNotExist(err) {
+		t.Error("command run in check mode")
+	}
+	if got := *summary.counts[ssh.LOCAL]; got != (tally{changed: 2, skipped: 1}) {
+		t.Errorf("unexpected tally in check mode %+v", got)
+	}
+
+	if err = runTestExec(ssh.NewLocal(), playbook, execOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	summary = newRecap()
+	if err = runTestExec(ssh.NewLocal(), playbook, execOptions{check: true, summary: summary}); err != nil {
+		t.Fatal(err)
+	}
+	if got := *summary.counts[ssh.LOCAL]; got != (tally{ok: 2, skipped: 1}) {
+		t.Errorf("unexpected tally after run %+v", got)
+	}
+}
+
+func TestExecHandlers(t *testing.T) {
+	dir, err := ioutil.TempDir("", "handlers")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var (
+		src    = filepath.Join(dir, "daemon.json")
+		dest   = filepath.Join(dir, "etc")
+		limits = filepath.Join(dir, "limits.conf")
+		count  = filepath.Join(dir, "count")
+	)
+	ioutil.WriteFile(src, []byte("{}\n"), 0644)
+	os.Mkdir(dest, 0755)
+	playbook, err := (&ssh.Recipe{
+		Archive: []ssh.Archive{{Src: src, Dir: dest, Notify: ssh.Names{"restart"}}},
+		Provision: []ssh.Provision{
+			{Name: "configure", Action: []ssh.Action{
+				{Modules: ssh.Modules{LineInFile: &ssh.LineInFileModule{Path: limits, Line: "* - nofile 100000", Create: true}}, Notify: ssh.Names{"restart"}},
+			}},
+		},
+		Handlers: []ssh.Provision{
+			{Name: "unused", Action: []ssh.Action{{Cmd: "false"}}},
+			{Name: "restart", Action: []ssh.Action{{Cmd: "echo restart >> " + count, Shell: true}}},
+		},
+	}).Render(map[string]interface{}{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = playbook.CheckNotify(); err != nil {
+		t.Fatal(err)
+	}
+
+	for run := 0; run < 2; run++ {
+		if err = runTestExec(ssh.NewLocal(), playbook, execOptions{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if data, _ := ioutil.ReadFile(count); string(data) != "restart\n" {
+		t.Errorf("expected handler to run once, got %q", data)
+	}
+
+	playbook.Provision[0].Action[0].Notify = ssh.Names{"reload"}
+	if err = playbook.CheckNotify(); err == nil || !strings.Contains(err.Error(), "reload") {
+		t.Errorf("expected unknown handler, got %v", err)
+	}
+}
+
+func TestFanOut(t *testing.T) {
+	var (
+		hosts = make([]target, 6)
+		mu    sync.Mutex
+
+		running, most int
+	)
+	errCnt := fanOut(2, hosts, func(t target, collect chan<- error) {
+		mu.Lock()
+		if running++; running > most {
+			most = running
+		}
+		mu.Unlock()
+		time.Sleep(10 * time.Millisecond)
+		mu.Lock()
+		running--
+		mu.Unlock()
+		collect <- ssh.ErrNoModule
+	})
+	if errCnt != len(hosts) {
+		t.Errorf("expected %d failed, got %d", len(hosts), errCnt)
+	}
+	if most != 2 {
+		t.Errorf("expected 2 hosts at a time, got %d", most)
+	}
+}
+
+func TestExecRunLog(t *testing.T) {
+	root, err := ioutil.TempDir("", "runs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	run, err := runlog.New(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	playbook := &ssh.Recipe{
+		Provision: []ssh.Provision{
+			{Name: "greet", Action: []ssh.Action{{Cmd: "echo hello; echo oops >&2; exit 3", Okcodes: []int{3}}}},
+		},
+	}
+	if err = runTestExec(ssh.NewLocal(), playbook, execOptions{run: run}); err != nil {
+		t.Fatal(err)
+	}
+	run.Close()
+
+	if ids, _ := runlog.List(root); len(ids) != 1 || ids[0] != run.Id {
+		t.Errorf("expected run %s listed, got %q", run.Id, ids)
+	}
+	records, err := runlog.Read(root, run.Id, ssh.LOCAL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var events []string
+	for _, rec := range records {
+		if rec.Host != ssh.LOCAL || rec.Provision != "greet" {
+			t.Errorf("unexpected record %+v", rec)
+		}
+		events = append(events, rec.Event+":"+rec.Stream+":"+rec.Text)
+	}
+	if len(events) == 4 {
+		sort.Strings(events[1:3]) // streams are relayed independently
+	}
+	if got := strings.Join(events, ","); got != "start::,output:stderr:oops,output:stdout:hello,exit::" {
+		t.Errorf("unexpected events %s", got)
+	}
+	if last := records[len(records)-1]; last.ExitCode == nil || *last.ExitCode != 3 || last.Error != "" {
+		t.Errorf("expected accepted exit code 3 recorded, got %+v", last)
+	}
+	transcript, _ := ioutil.ReadFile(filepath.Join(run.Dir, ssh.LOCAL+runlog.TRANSCRIPT_EXT))
+	if !strings.Contains(string(transcript), "greet - ! oops") {
+		t.Errorf("unexpected transcript %q", transcript)
+	}
+	if _, err = runlog.Read(root, "missing", ""); err != runlog.ErrRunNotFound {
+		t.Errorf("expected ErrRunNotFound, got %v", err)
+	}
+}
+
+func TestExecResume(t *testing.T) {
+	root, err := ioutil.TempDir("", "runs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	var (
+		log  = filepath.Join(root, "steps")
+		gate = filepath.Join(root, "gate")
+	)
+	playbook := &ssh.Recipe{
+		Provision: []ssh.Provision{
+			{Name: "first", Action: []ssh.Action{{Cmd: "echo first >> " + log, Shell: true}}},
+			{Name: "second", Action: []ssh.Action{
+				{Cmd: "echo second >> " + log, Shell: true},
+				{Cmd: "test -e " + gate + " && echo gated >> " + log, Shell: true},
+				{Cmd: "echo third >> " + log, Shell: true},
+			}},
+		},
+	}
+
+	run, err := runlog.New(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	run.SetPlaybook("compose.yml")
+	if err = runTestExec(ssh.NewLocal(), playbook, execOptions{run: run}); err == nil {
+		t.Fatal("expected playbook to fail at the gate")
+	}
+	run.Close()
+	state, err := runlog.ReadState(root, run.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	at := state.Hosts[ssh.LOCAL]
+	if state.Playbook != "compose.yml" || at.Document != 0 || at.Provision != 1 || at.Action != 1 || !at.Failed {
+		t.Fatalf("unexpected progress %+v of %+v", at, state)
+	}
+
+	ioutil.WriteFile(gate, nil, 0644)
+	resumed, err := runlog.New(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resumed.Close()
+	from := at.Resumed()
+	if err = runTestExec(ssh.NewLocal(), playbook, execOptions{run: resumed, from: &from}); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := ioutil.ReadFile(log); string(data) != "first\nsecond\ngated\nthird\n" {
+		t.Errorf("unexpected steps %q", data)
+	}
+	if state, err = runlog.ReadState(root, resumed.Id); err != nil || !reflect.DeepEqual(state.Hosts[ssh.LOCAL], runlog.Start(1)) {
+		t.Errorf("expected host done with document, got %+v, %v", state, err)
+	}
+
+	if _, err = runlog.ReadState(root, "missing"); err != runlog.ErrRunNotFound {
+		t.Errorf("expected ErrRunNotFound, got %v", err)
+	}
+}
+
+func TestExecResumeHandlers(t *testing.T) {
+	root, err := ioutil.TempDir("", "runs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	var (
+		limits = filepath.Join(root, "limits.conf")
+		count  = filepath.Join(root, "count")
+		gate   = filepath.Join(root, "gate")
+		ready  = filepath.Join(root, "ready")
+	)
+	playbook, err := (&ssh.Recipe{
+		Provision: []ssh.Provision{
+			{Name: "configure", Action: []ssh.Action{
+				{Cmd: "echo manager", Register: "role"},
+				{Modules: ssh.Modules{LineInFile: &ssh.LineInFileModule{Path: limits, Line: "* - nofile 100000", Create: true}}, Notify: ssh.Names{"restart"}},
+				{Cmd: "test -e " + gate, Shell: true},
+			}},
+		},
+		Handlers: []ssh.Provision{
+			{Name: "restart", Action: []ssh.Action{
+				{Cmd: "echo restart >> " + count, Shell: true, When: `and (eq .role.rc 0) (eq (index .role.stdout_lines 0) "manager")`},
+				{Cmd: "test -e " + ready, Shell: true},
+				{Cmd: "echo restarted >> " + count, Shell: true},
+			}},
+		},
+	}).Render(map[string]interface{}{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// resume runs playbook from where the last run left off, as read back
+	// from its progress file
+	var last string
+	resume := func() (runlog.Progress, error) {
+		var from = runlog.Start(0)
+		if last != "" {
+			state, err := runlog.ReadState(root, last)
+			if err != nil {
+				t.Fatal(err)
+			}
+			from = state.Hosts[ssh.LOCAL].Resumed()
+		}
+		run, err := runlog.New(root)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer run.Close()
+		err = runTestExec(ssh.NewLocal(), playbook, execOptions{run: run, from: &from})
+		state, serr := runlog.ReadState(root, run.Id)
+		if serr != nil {
+			t.Fatal(serr)
+		}
+		last = run.Id
+		return state.Hosts[ssh.LOCAL], err
+	}
+
+	// Change notifying handler goes by before the failure
+	at, err := resume()
+	if err == nil {
+		t.Fatal("expected playbook to fail at the gate")
+	}
+	if at.Provision != 0 || at.Action != 2 || !reflect.DeepEqual(at.Notified, []string{"restart"}) || at.Registered["role"] == nil {
+		t.Fatalf("unexpected progress %+v", at)
+	}
+
+	// Handler notified in the earlier run fails part way
+	ioutil.WriteFile(gate, nil, 0644)
+	if at, err = resume(); err == nil {
+		t.Fatal("expected handler to fail")
+	}
+	if at.Provision != 1 || at.Handler != "restart" || at.Action != 1 || len(at.Handled) > 0 {
+		t.Fatalf("unexpected progress %+v", at)
+	}
+	if data, _ := ioutil.ReadFile(count); string(data) != "restart\n" {
+		t.Errorf("expected notified handler to run, got %q", data)
+	}
+
+	// Handler carries on from the action it failed at
+	ioutil.WriteFile(ready, nil, 0644)
+	if at, err = resume(); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(at, runlog.Start(1)) {
+		t.Errorf("expected host done with document, got %+v", at)
+	}
+	if data, _ := ioutil.ReadFile(count); string(data) != "restart\nrestarted\n" {
+		t.Errorf("unexpected handler steps %q", data)
+	}
+}
+
+func TestExecResumeUnreachable(t *testing.T) {
+	srv, err := sshtest.NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	root, err := ioutil.TempDir("", "runs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	saved := *config.Config
+	defer func(exit func(int), sock string) {
+		*config.Config, cli.OsExiter = saved, exit
+		os.Setenv("SSH_AUTH_SOCK", sock)
+	}(cli.OsExiter, os.Getenv("SSH_AUTH_SOCK"))
+	config.Config.Runs, config.Config.Facts = filepath.Join(root, "runs"), filepath.Join(root, "facts")
+	config.Config.HostKeyMode = ssh.HostKeyInsecure
+	cli.OsExiter = func(int) {}
+	os.Setenv("SSH_AUTH_SOCK", "")
+
+	var (
+		log      = filepath.Join(root, "hosts")
+		key, _   = filepath.Abs(filepath.Join("lib", "ssh", "testdata", "id_ed25519"))
+		file     = filepath.Join(root, "playbook.yml")
+		host, pt = srv.Host()
+	)
+	ioutil.WriteFile(file, []byte("provision:\n- name: mark\n  action:\n    - cmd: echo {{.Host}} >> "+log+"\n"), 0644)
+	machine := func(args ...string) error {
+		app := cli.NewApp()
+		app.Flags = []cli.Flag{cli.StringFlag{Name: "user"}, cli.StringFlag{Name: "cert"}, cli.StringFlag{Name: "port"}}
+		app.Commands = []cli.Command{ExecCommand()}
+		return app.Run(append([]string{"machine", "--user", srv.User, "--cert", key, "--port", pt}, args...))
+	}
+
+	// Host refusing the key fails on connect, while local goes through
+	if err = machine("exec", "--host", ssh.LOCAL, "--host", host, "playbook", file); err == nil {
+		t.Fatal("expected run to fail on unreachable host")
+	}
+	ids, _ := runlog.List(config.Config.Runs)
+	if len(ids) != 1 {
+		t.Fatalf("unexpected runs %v", ids)
+	}
+	state, err := runlog.ReadState(config.Config.Runs, ids[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if at := state.Hosts[host]; !at.Failed || !reflect.DeepEqual(at.Resumed(), runlog.Start(0)) {
+		t.Errorf("expected %s resumable from start, got %+v", host, at)
+	}
+	if data, _ := ioutil.ReadFile(log); string(data) != "local\n" {
+		t.Errorf("unexpected hosts run %q", data)
+	}
+
+	// Once reachable, resuming runs it and leaves local be
+	pub, err := ioutil.ReadFile(key + ".pub")
+	if err != nil {
+		t.Fatal(err)
+	}
+	authorized, _, _, _, err := cryptossh.ParseAuthorizedKey(pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv.Authorize(authorized)
+	if err = machine("exec", "playbook", "--resume", ids[0]); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := ioutil.ReadFile(log); string(data) != "local\n"+host+"\n" {
+		t.Errorf("unexpected hosts run %q", data)
+	}
+}
+
+func TestParseVars(t *testing.T) {
+	varsFile, err := ioutil.TempFile("", "vars")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(varsFile.Name())
+	varsFile.WriteString("region: us-west-2\nport: 80\n")
+	varsFile.Close()
+
+	vars, err := parseVars(varsFile.Name(), []string{"port=8080", "opts=a=b"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if vars["region"] != "us-west-2" || vars["port"] != "8080" || vars["opts"] != "a=b" {
+		t.Errorf("unexpected vars %v", vars)
+	}
+	if _, err = parseVars("", []string{"novalue"}); err == nil {
+		t.Error("expected error for assignment without value")
+	}
+
+	merged := target{Host: "10.0.0.1"}.vars(map[string]interface{}{"port": 80, "Host": "ignored"}, vars)
+	if merged["port"] != "8080" || merged["Host"] != "10.0.0.1" {
+		t.Errorf("unexpected host vars %v", merged)
+	}
+}
+
+func TestExecVault(t *testing.T) {
+	root, err := ioutil.TempDir("", "runs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	defer func(v *vault.Vault, m *vault.Masker) { ssh.Vault, secrets = v, m }(ssh.Vault, secrets)
+
+	ssh.Vault, secrets = vault.New(func() ([]byte, error) { return []byte("secret"), nil }), new(vault.Masker)
+	content, err := ssh.Vault.Encrypt([]byte("db_password: hunter22\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	varsFile := filepath.Join(root, "secrets.yml")
+	ioutil.WriteFile(varsFile, content, 0600)
+	vars, err := parseVars(varsFile, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if vars["db_password"] != "hunter22" {
+		t.Fatalf("unexpected vars %v", vars)
+	}
+
+	run, err := runlog.New(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	run.Mask = secrets.Mask
+	playbook, err := (&ssh.Recipe{
+		Provision: []ssh.Provision{
+			{Name: "login", Action: []ssh.Action{{Cmd: "echo password is {{.db_password}}", Register: "login"}}},
+			{Name: "stop", Action: []ssh.Action{{Cmd: "false"}}},
+		},
+	}).Render(vars)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = runTestExec(ssh.NewLocal(), playbook, execOptions{run: run}); err == nil {
+		t.Fatal("expected playbook to stop")
+	}
+	run.Close()
+
+	// Registered output kept for resuming is masked too
+	state, err := runlog.ReadState(root, run.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	progress, _ := json.Marshal(state)
+	if strings.Contains(string(progress), "hunter22") || !strings.Contains(string(progress), "password is "+vault.MASK) {
+		t.Errorf("unexpected progress %s", progress)
+	}
+
+	records, err := runlog.Read(root, run.Id, ssh.LOCAL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	transcript, _ := ioutil.ReadFile(filepath.Join(run.Dir, ssh.LOCAL+runlog.TRANSCRIPT_EXT))
+	for _, rec := range records {
+		if strings.Contains(rec.Action+rec.Text, "hunter22") {
+			t.Errorf("expected secret masked in %+v", rec)
+		}
+	}
+	if strings.Contains(string(transcript), "hunter22") || !strings.Contains(string(transcript), "password is "+vault.MASK) {
+		t.Errorf("unexpected transcript %q", transcript)
+	}
+}
+
+func TestByteSize(t *testing.T) {
+	var cases = map[int64]string{
+		0:                "0B",
+		1023:             "1023B",
+		1536:             "1.5KiB",
+		50 * 1024 * 1024: "50.0MiB",
+		3 << 30:          "3.0GiB",
+		5 << 40:          "5.0TiB",
+		(1 << 50) * 2:    "2048.0TiB",
+	}
+	for n, want := range cases {
+		if got := byteSize(n); got != want {
+			t.Errorf("%d: expected %s, got %s", n, want, got)
+		}
+	}
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	config "github.com/poddworks/machine/config"
+	mach "github.com/poddworks/machine/lib/machine"
+
+	"github.com/poddworks/machine/lib/facts"
+	"github.com/poddworks/machine/lib/inventory"
+	"github.com/poddworks/machine/lib/ssh"
+
+	"github.com/urfave/cli"
+	"golang.org/x/net/context"
+
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+)
+
+// factCache holds facts gathered in this run, gathering each target once and
+// caching them under ~/.machine/facts for later
+type factCache struct {
+	sync.Mutex
+
+	facts map[string]facts.Facts
+}
+
+func newFactCache() *factCache {
+	return &factCache{facts: make(map[string]facts.Facts)}
+}
+
+// get returns facts of t, gathering them through cmdr the first time
+func (fc *factCache) get(ctx context.Context, cmdr ssh.Commander, t target) (facts.Facts, error) {
+	var name = t.factsName()
+	fc.Lock()
+	known, ok := fc.facts[name]
+	fc.Unlock()
+	if ok {
+		return known, nil
+	}
+	gathered, err := facts.Gather(ctx, cmdr)
+	if err != nil {
+		return nil, err
+	}
+	fc.Lock()
+	fc.facts[name] = gathered
+	fc.Unlock()
+	if err = facts.Save(config.Config.Facts, name, gathered); err != nil {
+		fmt.Fprintln(os.Stderr, "Unable to cache facts -", err)
+	}
+	return gathered, nil
+}
+
+// factsName names t in the facts cache: instance or inventory name, or else
+// its address
+func (t target) factsName() string {
+	if t.Name != "" {
+		return t.Name
+	}
+	if name, inst := mach.InstList.FindByHost(t.Host); inst != nil {
+		return name
+	}
+	return t.Host
+}
+
+func runFacts(c *cli.Context) error {
+	var (
+		name            = c.Args().First()
+		user, key, port = parseArgs(c)
+
+		sshCfg = ssh.Config{User: user, Key: key, Port: port}
+		inv    *inventory.Inventory
+	)
+
+	defer mach.InstList.Dump()
+
+	if name == "" {
+		// Search for MACHINE_NAME for enabled/active instance
+		name = os.Getenv("MACHINE_NAME")
+	}
+
+	if file := c.String("inventory"); file != "" {
+		var err error
+		if inv, err = inventory.Load(file); err != nil {
+			return cli.NewExitError(err.Error(), 1)
+		}
+	}
+
+	var targets = []target{{Host: ssh.LOCAL}}
+	if name != ssh.LOCAL {
+		var err error
+		if targets, err = selectTargets(inv, []string{name}); err != nil {
+			return cli.NewExitError(err.Error(), 1)
+		}
+	}
+
+	ctx, cancel := interruptContext()
+	defer cancel()
+
+	var (
+		gathered = make(map[string]facts.Facts)
+		known    = newFactCache()
+	)
+	for _, t := range targets {
+		var (
+			hostFacts facts.Facts
+			err       error
+		)
+		if c.Bool("cached") {
+			hostFacts, err = facts.Load(config.Config.Facts, t.factsName())
+		} else {
+			cmdr := t.commander(sshCfg)
+			hostFacts, err = known.get(ctx, cmdr, t)
+			recordHostKey(cmdr)
+			cmdr.Close()
+		}
+		if err == facts.ErrNotCached {
+			return cli.NewExitError("error/facts-not-cached", 1)
+		} else if err != nil {
+			fmt.Fprintln(os.Stderr, t.Host, "-", err)
+			return cli.NewExitError("error/failed-to-gather-facts", 1)
+		}
+		gathered[t.factsName()] = hostFacts
+	}
+
+	// Facts of a group are keyed by host name
+	var output interface{} = gathered
+	if len(targets) == 1 {
+		output = gathered[targets[0].factsName()]
+	}
+	content, err := json.MarshalIndent(output, "", "    ")
+	if err != nil {
+		return cli.NewExitError("error/failed-to-encode-facts", 1)
+	}
+	fmt.Println(string(content))
+
+	return nil
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	config "github.com/poddworks/machine/config"
+
+	"github.com/poddworks/machine/lib/facts"
+	"github.com/poddworks/machine/lib/ssh"
+
+	"golang.org/x/net/context"
+
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestFactCache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "facts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	saved := config.Config.Facts
+	defer func() { config.Config.Facts = saved }()
+	config.Config.Facts = dir
+
+	var (
+		known = newFactCache()
+		local = target{Host: ssh.LOCAL}
+	)
+	gathered, err := known.get(context.Background(), ssh.NewLocal(), local)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again, _ := known.get(context.Background(), nil, local); again["gathered_at"] != gathered["gathered_at"] {
+		t.Error("expected facts gathered once per run")
+	}
+	if cached, err := facts.Load(dir, ssh.LOCAL); err != nil || cached["kernel"] != gathered["kernel"] {
+		t.Errorf("expected facts cached, got %v, %v", cached, err)
+	}
+
+	playbook, err := (&ssh.Recipe{
+		Provision: []ssh.Provision{{Name: "{{.facts.system}} host"}},
+	}).Render(local.vars(map[string]interface{}{"facts": gathered}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if name := playbook.Provision[0].Name; name != "Linux host" {
+		t.Errorf("unexpected name %q", name)
+	}
+}
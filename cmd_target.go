@@ -0,0 +1,183 @@
+package main
+
+import (
+	mach "github.com/poddworks/machine/lib/machine"
+
+	"github.com/poddworks/machine/lib/inventory"
+	"github.com/poddworks/machine/lib/ssh"
+
+	"github.com/urfave/cli"
+
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// target is a host for exec to run on, with connection settings and
+// variables from inventory overriding those given on command line
+type target struct {
+	// Instance or inventory name, empty for bare address
+	Name string
+	Host string
+
+	User string
+	Port string
+	Key  string
+	Vars map[string]interface{}
+}
+
+// commander connects to t, with its own settings taking precedence
+func (t target) commander(sshCfg ssh.Config) ssh.Commander {
+	if t.User != "" {
+		sshCfg.User = t.User
+	}
+	if t.Port != "" {
+		sshCfg.Port = t.Port
+	}
+	if t.Key != "" {
+		sshCfg.Key = t.Key
+	}
+	return newCommander(sshCfg, t.Host)
+}
+
+// vars merges layers of variables, later ones taking precedence, then adds
+// what is known about t: Name, Host, and AltHost, Driver and Id of a known
+// instance
+func (t target) vars(layers ...map[string]interface{}) map[string]interface{} {
+	var vars = make(map[string]interface{})
+	for _, layer := range layers {
+		for k, v := range layer {
+			vars[k] = v
+		}
+	}
+	vars["Host"] = t.Host
+	if t.Name != "" {
+		vars["Name"] = t.Name
+	}
+	if name, inst := mach.InstList.FindByHost(t.Host); inst != nil {
+		if t.Name == "" {
+			vars["Name"] = name
+		}
+		vars["AltHost"] = inst.AltHost
+		vars["Driver"] = inst.Driver
+		vars["Id"] = inst.Id
+	}
+	return vars
+}
+
+// fromInventory makes target of host named name, reaching it through a
+// known instance of the same name when inventory gives no address
+func fromInventory(inv *inventory.Inventory, name string) target {
+	var h = inv.Resolve(name)
+	t := target{Name: name, Host: h.Addr, User: h.User, Port: h.Port, Key: h.Key, Vars: h.Vars}
+	if inst, ok := mach.InstList[name]; ok && h.Addr == name {
+		t.Host = inst.Host
+	}
+	return t
+}
+
+// candidates lists every target label selector may choose from: hosts in
+// inventory, then known instances not in inventory
+func candidates(inv *inventory.Inventory) (targets []target) {
+	var seen = make(map[string]bool)
+	if inv != nil {
+		for _, name := range inv.Names() {
+			t := fromInventory(inv, name)
+			seen[t.Host], targets = true, append(targets, t)
+		}
+	}
+	var names []string
+	for name := range mach.InstList {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if inst := mach.InstList[name]; !seen[inst.Host] {
+			seen[inst.Host], targets = true, append(targets, target{Name: name, Host: inst.Host})
+		}
+	}
+	return
+}
+
+// selectTargets resolves patterns in order, each being a label selector
+// key=value, "all", an inventory group or host, or a known instance name.
+// A host matched more than once is kept the first time only.  A pattern
+// matching no host is an error, so that a typo does not pass for success.
+func selectTargets(inv *inventory.Inventory, patterns []string) ([]target, error) {
+	var matched []target
+	for _, pattern := range patterns {
+		var (
+			found = len(matched)
+			names []string
+			ok    bool
+		)
+		if inv != nil {
+			names, ok = inv.Select(pattern)
+		}
+		if kv := strings.SplitN(pattern, "=", 2); len(kv) == 2 {
+			for _, t := range candidates(inv) {
+				if v, ok := t.vars(t.Vars)[kv[0]]; ok && fmt.Sprint(v) == kv[1] {
+					matched = append(matched, t)
+				}
+			}
+		} else if ok {
+			for _, name := range names {
+				matched = append(matched, fromInventory(inv, name))
+			}
+		} else if pattern == inventory.GROUP_ALL {
+			matched = append(matched, candidates(nil)...)
+		} else if inst, ok := mach.InstList[pattern]; ok {
+			matched = append(matched, target{Name: pattern, Host: inst.Host})
+		}
+		if len(matched) == found {
+			return nil, fmt.Errorf("error/unknown-target: %s", pattern)
+		}
+	}
+	return uniqTargets(matched), nil
+}
+
+func uniqTargets(targets []target) (uniq []target) {
+	var seen = make(map[string]bool)
+	for _, t := range targets {
+		if !seen[t.Host] {
+			seen[t.Host], uniq = true, append(uniq, t)
+		}
+	}
+	return
+}
+
+// limitTargets keeps targets also found in limit, failing when none is
+func limitTargets(targets, limit []target) (kept []target, err error) {
+	var allowed = make(map[string]bool)
+	for _, t := range limit {
+		allowed[t.Host] = true
+	}
+	for _, t := range targets {
+		if allowed[t.Host] {
+			kept = append(kept, t)
+		}
+	}
+	if len(kept) == 0 {
+		return nil, errors.New("error/unknown-target: no hosts matched")
+	}
+	return kept, nil
+}
+
+// parseTargets loads inventory, when one is given, and resolves --host
+// addresses and --target patterns
+func parseTargets(c *cli.Context) (inv *inventory.Inventory, targets []target, err error) {
+	if file := c.GlobalString("inventory"); file != "" {
+		if inv, err = inventory.Load(file); err != nil {
+			return nil, nil, err
+		}
+	}
+	for _, host := range c.GlobalStringSlice("host") {
+		targets = append(targets, target{Host: host})
+	}
+	selected, err := selectTargets(inv, c.GlobalStringSlice("target"))
+	if err != nil {
+		return nil, nil, err
+	}
+	return inv, uniqTargets(append(targets, selected...)), nil
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	mach "github.com/poddworks/machine/lib/machine"
+
+	"github.com/jeffjen/yaml"
+	"github.com/poddworks/machine/lib/inventory"
+	"github.com/poddworks/machine/lib/ssh"
+
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func targetHosts(targets []target) (hosts []string) {
+	for _, t := range targets {
+		hosts = append(hosts, t.Host)
+	}
+	return
+}
+
+func TestSelectTargets(t *testing.T) {
+	saved := mach.InstList
+	defer func() { mach.InstList = saved }()
+	mach.InstList = mach.RegisteredInstances{
+		"node-1": {Host: "10.0.0.1", Driver: "aws", Id: "i-1"},
+		"node-2": {Host: "10.0.0.2", Driver: "generic"},
+	}
+
+	inv, err := inventory.ParseINI([]byte(`
+[managers]
+node-1 swarm_role=manager ansible_user=ubuntu
+[workers]
+node-2
+edge ansible_host=10.0.0.3 ansible_port=2222
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		patterns []string
+		want     []string
+	}{
+		{[]string{"managers"}, []string{"10.0.0.1"}},
+		{[]string{"workers", "node-2"}, []string{"10.0.0.2", "10.0.0.3"}},
+		{[]string{"all"}, []string{"10.0.0.1", "10.0.0.2", "10.0.0.3"}},
+		{[]string{"Driver=aws"}, []string{"10.0.0.1"}},
+		{[]string{"swarm_role=manager", "edge"}, []string{"10.0.0.1", "10.0.0.3"}},
+	}
+	for _, c := range cases {
+		targets, err := selectTargets(inv, c.patterns)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := targetHosts(targets); !reflect.DeepEqual(got, c.want) {
+			t.Errorf("selectTargets(%v) = %v; want %v", c.patterns, got, c.want)
+		}
+	}
+
+	targets, _ := selectTargets(inv, []string{"managers", "edge"})
+	if targets[0].User != "ubuntu" || targets[0].Name != "node-1" || targets[1].Port != "2222" {
+		t.Errorf("unexpected settings %+v", targets)
+	}
+	if vars := targets[0].vars(targets[0].Vars); vars["Id"] != "i-1" || vars["swarm_role"] != "manager" {
+		t.Errorf("unexpected vars %v", vars)
+	}
+
+	// Registry alone serves names and selectors without inventory
+	if targets, err = selectTargets(nil, []string{"node-2", "Driver=aws"}); err != nil {
+		t.Fatal(err)
+	} else if got := targetHosts(targets); !reflect.DeepEqual(got, []string{"10.0.0.2", "10.0.0.1"}) {
+		t.Errorf("unexpected targets %v", got)
+	}
+	if _, err = selectTargets(inv, []string{"nowhere"}); err == nil {
+		t.Error("expected error for unknown target")
+	}
+	for _, pattern := range []string{"swarm_role=worker", "empty"} {
+		empty, _ := inventory.ParseINI([]byte("[empty]\n[managers]\nnode-1 swarm_role=manager\n"))
+		if _, err = selectTargets(empty, []string{"managers", pattern}); err == nil || !strings.Contains(err.Error(), pattern) {
+			t.Errorf("expected error for %s matching no host, got %v", pattern, err)
+		}
+	}
+
+	limited, err := limitTargets(targets, []target{{Host: "10.0.0.1"}})
+	if got := targetHosts(limited); err != nil || !reflect.DeepEqual(got, []string{"10.0.0.1"}) {
+		t.Errorf("unexpected limited targets %v, %v", got, err)
+	}
+	if _, err = limitTargets(targets, []target{{Host: "10.0.0.9"}}); err == nil {
+		t.Error("expected error when limit leaves no host")
+	}
+}
+
+func TestRecipeHosts(t *testing.T) {
+	for _, doc := range []string{"hosts: managers, workers\n", "hosts: [managers, workers]\n"} {
+		var recipe ssh.Recipe
+		if err := yaml.Unmarshal([]byte(doc), &recipe); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(recipe.Hosts, ssh.Patterns{"managers", "workers"}) {
+			t.Errorf("unexpected hosts %v from %q", recipe.Hosts, doc)
+		}
+	}
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"github.com/poddworks/machine/lib/ssh"
+	"github.com/poddworks/machine/lib/vault"
+
+	"github.com/urfave/cli"
+
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	osexec "os/exec"
+	path "path/filepath"
+	"strings"
+)
+
+// Secrets learnt this run, masked out of exec output and run log
+var secrets = new(vault.Masker)
+
+// vaultPassword reads vault password from keyFile, or asks for it on the
+// terminal, twice when confirm is set
+func vaultPassword(keyFile, question string, confirm bool) func() ([]byte, error) {
+	return func() ([]byte, error) {
+		if keyFile != "" {
+			content, err := ioutil.ReadFile(keyFile)
+			if err != nil {
+				return nil, err
+			}
+			return bytes.TrimRight(content, "\r\n"), nil
+		}
+		answer, err := ssh.Prompt(question, false)
+		if err != nil {
+			return nil, err
+		}
+		if confirm {
+			again, err := ssh.Prompt("Confirm "+strings.ToLower(question[:1])+question[1:], false)
+			if err != nil {
+				return nil, err
+			}
+			if again != answer {
+				return nil, vault.ErrMismatch
+			}
+		}
+		return []byte(answer), nil
+	}
+}
+
+// openVault makes vault of password given by --vault-key-file, or else asked
+// on the terminal, confirmed when it is to encrypt
+func openVault(c *cli.Context, confirm bool) *vault.Vault {
+	return vault.New(vaultPassword(c.GlobalString("vault-key-file"), "Vault password: ", confirm))
+}
+
+// writeSecret replaces file with content readable by owner only
+func writeSecret(file string, content []byte) error {
+	tmp, err := ioutil.TempFile(path.Dir(file), "."+path.Base(file))
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err = tmp.Write(content); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), file)
+}
+
+// editSecret opens plain in $EDITOR from a private temporary file and
+// returns what was saved
+func editSecret(plain []byte) ([]byte, error) {
+	dir, err := ioutil.TempDir("", "machine-vault")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+	var file = path.Join(dir, "secret")
+	if err = ioutil.WriteFile(file, plain, 0600); err != nil {
+		return nil, err
+	}
+	editor := os.Getenv("EDITOR")
+	if editor == "" {
+		editor = "vi"
+	}
+	cmd := osexec.Command("sh", "-c", editor+` "$1"`, "editor", file)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	if err = cmd.Run(); err != nil {
+		return nil, fmt.Errorf("Editor %s: %v", editor, err)
+	}
+	return ioutil.ReadFile(file)
+}
+
+func runVaultCreate(c *cli.Context) error {
+	var file = c.Args().First()
+	if file == "" {
+		return cli.NewExitError("No file specified", 1)
+	}
+	if _, err := os.Stat(file); err == nil {
+		return cli.NewExitError("error/file-exists", 1)
+	}
+	v := openVault(c, true)
+	plain, err := editSecret(nil)
+	if err != nil {
+		return cli.NewExitError(err.Error(), 1)
+	}
+	content, err := v.Encrypt(plain)
+	if err != nil {
+		return cli.NewExitError(err.Error(), 1)
+	}
+	if err = writeSecret(file, content); err != nil {
+		return cli.NewExitError(err.Error(), 1)
+	}
+	return nil
+}
+
+func runVaultEdit(c *cli.Context) error {
+	var file = c.Args().First()
+	if file == "" {
+		return cli.NewExitError("No file specified", 1)
+	}
+	v := openVault(c, false)
+	content, err := ioutil.ReadFile(file)
+	if err != nil {
+		return cli.NewExitError(err.Error(), 1)
+	}
+	plain, err := v.Decrypt(content)
+	if err != nil {
+		return cli.NewExitError(err.Error(), 1)
+	}
+	edited, err := editSecret(plain)
+	if err != nil {
+		return cli.NewExitError(err.Error(), 1)
+	}
+	if bytes.Equal(edited, plain) {
+		return nil // leave file alone
+	}
+	if content, err = v.Encrypt(edited); err != nil {
+		return cli.NewExitError(err.Error(), 1)
+	}
+	if err = writeSecret(file, content); err != nil {
+		return cli.NewExitError(err.Error(), 1)
+	}
+	return nil
+}
+
+func runVaultEncrypt(c *cli.Context) error {
+	if len(c.Args()) == 0 {
+		return cli.NewExitError("No file specified", 1)
+	}
+	v := openVault(c, true)
+	for _, file := range c.Args() {
+		plain, err := ioutil.ReadFile(file)
+		if err != nil {
+			return cli.NewExitError(err.Error(), 1)
+		}
+		content, err := v.Encrypt(plain)
+		if err != nil {
+			return cli.NewExitError(fmt.Sprintf("%s: %v", file, err), 1)
+		}
+		if err = writeSecret(file, content); err != nil {
+			return cli.NewExitError(err.Error(), 1)
+		}
+		fmt.Println("Encrypted", file)
+	}
+	return nil
+}
+
+func runVaultDecrypt(c *cli.Context) error {
+	var output = c.String("output")
+	if len(c.Args()) == 0 {
+		return cli.NewExitError("No file specified", 1)
+	}
+	if output != "" && len(c.Args()) > 1 {
+		return cli.NewExitError("Can only write one file to --output", 1)
+	}
+	v := openVault(c, false)
+	for _, file := range c.Args() {
+		content, err := ioutil.ReadFile(file)
+		if err != nil {
+			return cli.NewExitError(err.Error(), 1)
+		}
+		plain, err := v.Decrypt(content)
+		if err != nil {
+			return cli.NewExitError(fmt.Sprintf("%s: %v", file, err), 1)
+		}
+		switch output {
+		case "-":
+			os.Stdout.Write(plain)
+		case "":
+			if err = writeSecret(file, plain); err != nil {
+				return cli.NewExitError(err.Error(), 1)
+			}
+			fmt.Println("Decrypted", file)
+		default:
+			if err = writeSecret(output, plain); err != nil {
+				return cli.NewExitError(err.Error(), 1)
+			}
+		}
+	}
+	return nil
+}
+
+func runVaultRekey(c *cli.Context) error {
+	if len(c.Args()) == 0 {
+		return cli.NewExitError("No file specified", 1)
+	}
+	var (
+		current = openVault(c, false)
+		next    = vault.New(vaultPassword(c.String("new-key-file"), "New vault password: ", true))
+	)
+	for _, file := range c.Args() {
+		content, err := ioutil.ReadFile(file)
+		if err != nil {
+			return cli.NewExitError(err.Error(), 1)
+		}
+		plain, err := current.Decrypt(content)
+		if err != nil {
+			return cli.NewExitError(fmt.Sprintf("%s: %v", file, err), 1)
+		}
+		if content, err = next.Encrypt(plain); err != nil {
+			return cli.NewExitError(err.Error(), 1)
+		}
+		if err = writeSecret(file, content); err != nil {
+			return cli.NewExitError(err.Error(), 1)
+		}
+		fmt.Println("Rekeyed", file)
+	}
+	return nil
+}
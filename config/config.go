@@ -10,13 +10,21 @@ import (
 )
 
 type config struct {
-	User       string
-	Cert       string
-	Org        string
-	Certpath   string
-	Confdir    string
-	Instance   string
-	AWSProfile string
+	User        string
+	Cert        string
+	Org         string
+	Certpath    string
+	Confdir     string
+	Instance    string
+	Runs        string
+	Facts       string
+	AWSProfile  string
+	KnownHosts  string
+	HostCAFile  string
+	HostKeyMode string
+	Bastion     string
+	Become      string
+	Identities  []string
 }
 
 var (
@@ -33,7 +41,15 @@ func Parse(c *cli.Context) error {
 	Config.User = user
 	Config.Cert = cert
 	Config.Instance = path.Join(confdir, "instance.json")
+	Config.Runs = path.Join(confdir, "runs")
+	Config.Facts = path.Join(confdir, "facts")
 	Config.AWSProfile = path.Join(confdir, "aws-profile.json")
+	Config.KnownHosts = path.Join(confdir, "known_hosts")
+	Config.HostCAFile = path.Join(confdir, "ssh-ca.pub")
+	Config.HostKeyMode = c.String("host-key")
+	Config.Bastion = c.String("bastion")
+	Config.Become = c.String("become")
+	Config.Identities = c.StringSlice("identity")
 	return nil
 }
 
@@ -2,6 +2,7 @@ package aws
 
 import (
 	mach "github.com/poddworks/machine/lib/machine"
+	"github.com/poddworks/machine/lib/ssh"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/credentials"
@@ -30,6 +31,23 @@ var (
 	}
 )
 
+// parseBastion reads jump host chain from --bastion, applying --bastion-cert
+// to hops without their own key
+func parseBastion(c *cli.Context) ([]ssh.Hop, error) {
+	hops, err := ssh.ParseProxyJump(c.String("bastion"))
+	if err != nil {
+		return nil, err
+	}
+	if key := c.String("bastion-cert"); key != "" {
+		for idx := range hops {
+			if hops[idx].Key == "" {
+				hops[idx].Key = key
+			}
+		}
+	}
+	return hops, nil
+}
+
 func beforeAction(c *cli.Context) error {
 	if err := profile.Load(); err != nil {
 		return cli.NewExitError(err.Error(), 1)
@@ -53,11 +71,14 @@ func NewCreateCommand() cli.Command {
 		Flags: append(awsFlags,
 			cli.BoolFlag{Name: "use-docker", Usage: "Opt in to use Docker Engine"},
 			cli.StringFlag{Name: "ami-id", Usage: "EC2 instance AMI ID"},
+			cli.StringFlag{Name: "bastion", Usage: "Jump host chain to reach instance, defaults to profile bastion"},
+			cli.StringFlag{Name: "bastion-cert", Usage: "Private key to authenticate with jump host"},
 			cli.IntFlag{Name: "count", Value: 1, Usage: "EC2 instances to launch in this request"},
 			cli.StringSliceFlag{Name: "group", Usage: "Network security group for instance"},
 			cli.StringFlag{Name: "iam-role", Usage: "EC2 IAM Role to apply"},
 			cli.StringFlag{Name: "profile", Value: "default", Usage: "Name of the profile"},
 			cli.IntFlag{Name: "root-size", Value: 16, Usage: "EC2 root volume size"},
+			cli.BoolFlag{Name: "ssh-only", Usage: "Reach Docker Engine through SSH tunnel instead of tcp:2376"},
 			cli.StringFlag{Name: "ssh-key", Usage: "EC2 instance SSH KeyPair"},
 			cli.BoolFlag{Name: "subnet-private", Usage: "Launch EC2 instance to internal subnet"},
 			cli.StringFlag{Name: "subnet-id", Usage: "Launch EC2 instance to the specified subnet"},
@@ -74,6 +95,7 @@ func NewCreateCommand() cli.Command {
 
 				num2Launch = c.Int("count")
 				useDocker  = c.Bool("use-docker")
+				sshOnly    = c.Bool("ssh-only")
 			)
 
 			if name == "" {
@@ -91,23 +113,40 @@ func NewCreateCommand() cli.Command {
 				return cli.NewExitError("Unable to find matching VPC profile", 1)
 			}
 
+			bastion, err := parseBastion(c)
+			if err != nil {
+				return cli.NewExitError(err.Error(), 1)
+			} else if len(bastion) == 0 {
+				bastion = p.Bastion
+			}
+			if useDocker && c.Bool("subnet-private") && len(bastion) == 0 {
+				return cli.NewExitError("Private instance requires --bastion or profile bastion", 1)
+			}
+
 			instances, err := newEC2Inst(c, p, num2Launch)
 			if err != nil {
 				return cli.NewExitError(err.Error(), 1)
 			}
 
 			// Invoke EC2 launch procedure
-			for state := range deployEC2Inst(name, num2Launch, useDocker, instances) {
+			for state := range deployEC2Inst(name, num2Launch, useDocker, sshOnly, bastion, instances) {
 				if state.err == nil {
-					addr, _ := net.ResolveTCPAddr("tcp", *state.PublicIpAddress+":2376")
-					fmt.Printf("%s - %s - Instance ID: %s\n", *state.PublicIpAddress, *state.PrivateIpAddress, *state.InstanceId)
+					host := ec2_hostAddr(state.Instance)
+					addr, _ := net.ResolveTCPAddr("tcp", host+":2376")
+					if sshOnly {
+						addr = nil // Docker Engine stays on its unix socket
+					}
+					fmt.Printf("%s - %s - Instance ID: %s\n", host, *state.PrivateIpAddress, *state.InstanceId)
 					mach.InstList[state.name] = &mach.Instance{
 						Id:         *state.InstanceId,
 						Driver:     "aws",
 						DockerHost: addr,
-						Host:       *state.PublicIpAddress,
+						Host:       host,
 						AltHost:    []string{*state.PrivateIpAddress},
 						State:      "running",
+						HostKey:    state.hostKey,
+						Bastion:    bastion,
+						SSHOnly:    sshOnly,
 					}
 				} else {
 					fmt.Fprintln(os.Stderr, state.err)
@@ -167,9 +206,11 @@ func newStartCommand() cli.Command {
 				if state := <-ec2_WaitForReady(&info.Id); state.err != nil {
 					fmt.Fprintln(os.Stderr, "Target machine [", name, "] failed to launch")
 				} else {
-					addr, _ := net.ResolveTCPAddr("tcp", *state.PublicIpAddress+":2376")
-					info.DockerHost = addr
-					info.Host = *state.PublicIpAddress
+					host := ec2_hostAddr(state.Instance)
+					if !info.SSHOnly {
+						info.DockerHost, _ = net.ResolveTCPAddr("tcp", host+":2376")
+					}
+					info.Host = host
 					info.AltHost = []string{*state.PrivateIpAddress}
 					info.State = "running"
 				}
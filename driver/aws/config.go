@@ -24,6 +24,8 @@ func syncFromAWS() cli.Command {
 			cli.StringFlag{Name: "name", Value: "default", Usage: "Name of the profile"},
 			cli.StringFlag{Name: "vpc-id", Value: "default", Usage: "AWS VPC identifier"},
 			cli.BoolFlag{Name: "force,f", Usage: "Force new config file"},
+			cli.StringFlag{Name: "bastion", Usage: "Default jump host chain for instances in this profile"},
+			cli.StringFlag{Name: "bastion-cert", Usage: "Private key to authenticate with jump host"},
 		},
 		Action: func(c *cli.Context) error {
 			var forceNew = c.Bool("force")
@@ -32,6 +34,11 @@ func syncFromAWS() cli.Command {
 			defer mach.InstList.Dump()
 
 			p := &Profile{Name: c.String("name"), Region: c.GlobalString("region")}
+			if bastion, err := parseBastion(c); err != nil {
+				return cli.NewExitError(err.Error(), 1)
+			} else {
+				p.Bastion = bastion
+			}
 			if account_id, err := vpcInit(c, &p.VPC); err != nil {
 				return cli.NewExitError(err.Error(), 1)
 			} else {
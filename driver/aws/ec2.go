@@ -2,6 +2,7 @@ package aws
 
 import (
 	mach "github.com/poddworks/machine/lib/machine"
+	"github.com/poddworks/machine/lib/ssh"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/service/ec2"
@@ -21,12 +22,13 @@ var (
 
 type ec2state struct {
 	*ec2.Instance
-	name string
-	err  error
+	name    string
+	hostKey string
+	err     error
 }
 
 func newEc2State(inst *ec2.Instance, err error) ec2state {
-	return ec2state{inst, "", err}
+	return ec2state{inst, "", "", err}
 }
 
 func getEc2InstanceName(inst *ec2.Instance) (name string) {
@@ -38,6 +40,15 @@ func getEc2InstanceName(inst *ec2.Instance) (name string) {
 	return
 }
 
+// ec2_hostAddr picks public address when available, private address
+// otherwise for instances reachable only through bastion
+func ec2_hostAddr(inst *ec2.Instance) string {
+	if inst.PublicIpAddress != nil {
+		return *inst.PublicIpAddress
+	}
+	return *inst.PrivateIpAddress
+}
+
 func ec2Init(forceNew bool) error {
 	var resp = new(ec2.DescribeInstancesOutput)
 
@@ -83,10 +94,11 @@ func ec2Init(forceNew bool) error {
 						info.Id = *inst.InstanceId
 						func() {
 							var addr *net.TCPAddr
-							if inst.PublicIpAddress != nil {
-								addr, _ = net.ResolveTCPAddr("tcp", *inst.PublicIpAddress+":2376")
+							if inst.PublicIpAddress != nil || inst.PrivateIpAddress != nil {
+								host := ec2_hostAddr(inst)
+								addr, _ = net.ResolveTCPAddr("tcp", host+":2376")
 								info.DockerHost = addr
-								info.Host = *inst.PublicIpAddress
+								info.Host = host
 							}
 							if inst.PrivateIpAddress != nil {
 								info.AltHost = []string{*inst.PrivateIpAddress}
@@ -318,7 +330,7 @@ func newEC2Inst(c *cli.Context, profile *Profile, num2Launch int) (instances []*
 	return resp.Instances, nil
 }
 
-func deployEC2Inst(name string, num2Launch int, useDocker bool, instances []*ec2.Instance) <-chan ec2state {
+func deployEC2Inst(name string, num2Launch int, useDocker, sshOnly bool, bastion []ssh.Hop, instances []*ec2.Instance) <-chan ec2state {
 	var wg sync.WaitGroup
 	out := make(chan ec2state)
 	go func() {
@@ -344,13 +356,20 @@ func deployEC2Inst(name string, num2Launch int, useDocker bool, instances []*ec2
 					}
 					_, state.err = svc.CreateTags(tagparam)
 					if useDocker {
-						host := mach.NewDockerHost()
-						if state.err == nil {
-							state.err = host.InstallDockerEngine(*state.PublicIpAddress)
+						var (
+							host = mach.NewDockerHost()
+							addr = ec2_hostAddr(state.Instance)
+						)
+						if len(bastion) > 0 {
+							host.Bastion = bastion
 						}
 						if state.err == nil {
-							state.err = host.InstallDockerEngineCertificate(*state.PublicIpAddress, *state.PrivateIpAddress)
+							state.err = host.InstallDockerEngine(addr)
+						}
+						if state.err == nil && !sshOnly {
+							state.err = host.InstallDockerEngineCertificate(addr, *state.PrivateIpAddress)
 						}
+						state.hostKey = host.HostKey
 					}
 				}
 				out <- state
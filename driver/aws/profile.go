@@ -2,6 +2,7 @@ package aws
 
 import (
 	config "github.com/poddworks/machine/config"
+	"github.com/poddworks/machine/lib/ssh"
 
 	"encoding/json"
 	"io"
@@ -48,6 +49,7 @@ type Profile struct {
 	VPC     VPCProfile   `json:"vpc"`
 	KeyPair []KeyPair    `json:"key_pair"`
 	Ami     []AMIProfile `json:"ami"`
+	Bastion []ssh.Hop    `json:"bastion,omitempty"`
 }
 
 type RegionProfile map[string]*Profile
@@ -2,6 +2,7 @@ package generic
 
 import (
 	mach "github.com/poddworks/machine/lib/machine"
+	"github.com/poddworks/machine/lib/ssh"
 
 	"github.com/urfave/cli"
 
@@ -14,9 +15,11 @@ func NewCreateCommand() cli.Command {
 		Usage: "Provision Docker Engine on Linux instance",
 		Flags: []cli.Flag{
 			cli.BoolFlag{Name: "no-install", Usage: "Skip Docker Engine Installation"},
+			cli.BoolFlag{Name: "ssh-only", Usage: "Reach Docker Engine through SSH tunnel instead of tcp:2376"},
 			cli.StringFlag{Name: "driver", Value: "generic", Usage: "Assign driver for Docker Engine"},
 			cli.StringFlag{Name: "host", Usage: "Host to install Docker Engine"},
 			cli.StringSliceFlag{Name: "altname", Usage: "Alternative name for Host"},
+			cli.StringFlag{Name: "bastion", Usage: "Jump host chain to reach Host"},
 		},
 		Action: func(c *cli.Context) error {
 			defer mach.InstList.Dump()
@@ -30,6 +33,7 @@ func NewCreateCommand() cli.Command {
 				addr, _ = net.ResolveTCPAddr("tcp", hostname+":2376")
 
 				noInstall = c.Bool("no-install")
+				sshOnly   = c.Bool("ssh-only")
 			)
 
 			if name == "" {
@@ -39,13 +43,20 @@ func NewCreateCommand() cli.Command {
 			}
 
 			inst := mach.NewDockerHost()
+			if bastion, err := ssh.ParseProxyJump(c.String("bastion")); err != nil {
+				return cli.NewExitError(err.Error(), 1)
+			} else if len(bastion) > 0 {
+				inst.Bastion = bastion
+			}
 
 			if !noInstall {
 				if err := inst.InstallDockerEngine(hostname); err != nil {
 					return cli.NewExitError("error/failed-to-install-docker-engine", 1)
 				}
 			}
-			if err := inst.InstallDockerEngineCertificate(hostname, altnames...); err != nil {
+			if sshOnly {
+				addr = nil // Docker Engine stays on its unix socket
+			} else if err := inst.InstallDockerEngineCertificate(hostname, altnames...); err != nil {
 				return cli.NewExitError("error/failed-to-install-docker-cert", 1)
 			}
 			mach.InstList[name] = &mach.Instance{
@@ -55,6 +66,9 @@ func NewCreateCommand() cli.Command {
 				Host:       hostname,
 				AltHost:    altnames,
 				State:      "running",
+				HostKey:    inst.HostKey,
+				Bastion:    inst.Bastion,
+				SSHOnly:    sshOnly,
 			}
 
 			return nil
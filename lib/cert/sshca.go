@@ -0,0 +1,109 @@
+package cert
+
+import (
+	"golang.org/x/crypto/ssh"
+
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/binary"
+	"errors"
+	"io/ioutil"
+	path "path/filepath"
+	"time"
+)
+
+const (
+	// SSH CA private key, next to Docker TLS CA under certpath
+	SSH_CA_KEY = "ssh-ca"
+
+	// SSH CA public key in authorized_keys format
+	SSH_CA_PUB = "ssh-ca.pub"
+
+	// Default lifetime of user certificates
+	SSH_USER_CERT_VALIDITY = 24 * time.Hour
+
+	// Default lifetime of host certificates, same as Docker TLS certificates
+	SSH_HOST_CERT_VALIDITY = 1080 * 24 * time.Hour
+)
+
+var (
+	ErrNotPublicKey = errors.New("Input is not an SSH public key")
+)
+
+// GenerateSSHCA creates SSH CA keypair under certpath
+func GenerateSSHCA(certpath string) error {
+	priv, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return err
+	}
+	pub, err := ssh.NewPublicKey(&priv.PublicKey)
+	if err != nil {
+		return err
+	}
+	if err = WriteKey(path.Join(certpath, SSH_CA_KEY), priv); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path.Join(certpath, SSH_CA_PUB), ssh.MarshalAuthorizedKey(pub), 0644)
+}
+
+// LoadSSHCA loads SSH CA signer from certpath
+func LoadSSHCA(certpath string) (ssh.Signer, error) {
+	buf, err := ioutil.ReadFile(path.Join(certpath, SSH_CA_KEY))
+	if err != nil {
+		return nil, err
+	}
+	return ssh.ParsePrivateKey(buf)
+}
+
+// SignSSHUserCertificate signs user public key in authorized_keys format for
+// login as principals, returning certificate in authorized_keys format
+func SignSSHUserCertificate(certpath string, pubKey []byte, keyId string, principals []string, validity time.Duration) ([]byte, error) {
+	return signSSHCertificate(certpath, pubKey, ssh.UserCert, keyId, principals, validity)
+}
+
+// SignSSHHostCertificate signs host public key in authorized_keys format for
+// host names in principals, returning certificate in authorized_keys format
+func SignSSHHostCertificate(certpath string, pubKey []byte, keyId string, principals []string, validity time.Duration) ([]byte, error) {
+	return signSSHCertificate(certpath, pubKey, ssh.HostCert, keyId, principals, validity)
+}
+
+func signSSHCertificate(certpath string, pubKey []byte, certType uint32, keyId string, principals []string, validity time.Duration) ([]byte, error) {
+	pub, comment, _, _, err := ssh.ParseAuthorizedKey(pubKey)
+	if err != nil {
+		return nil, ErrNotPublicKey
+	}
+	signer, err := LoadSSHCA(certpath)
+	if err != nil {
+		return nil, err // Unable to load SSH CA
+	}
+	var serial [8]byte
+	if _, err = rand.Read(serial[:]); err != nil {
+		return nil, err
+	}
+	if keyId == "" {
+		keyId = comment
+	}
+	now := time.Now()
+	cert := &ssh.Certificate{
+		Key:             pub,
+		Serial:          binary.BigEndian.Uint64(serial[:]),
+		CertType:        certType,
+		KeyId:           keyId,
+		ValidPrincipals: principals,
+		ValidAfter:      uint64(now.Add(-5 * time.Minute).Unix()),
+		ValidBefore:     uint64(now.Add(validity).Unix()),
+	}
+	if certType == ssh.UserCert {
+		cert.Permissions.Extensions = map[string]string{
+			"permit-X11-forwarding":   "",
+			"permit-agent-forwarding": "",
+			"permit-port-forwarding":  "",
+			"permit-pty":              "",
+			"permit-user-rc":          "",
+		}
+	}
+	if err = cert.SignCert(rand.Reader, signer); err != nil {
+		return nil, err
+	}
+	return ssh.MarshalAuthorizedKey(cert), nil
+}
@@ -0,0 +1,261 @@
+// Package facts gathers what a host is made of, e.g. distribution, kernel,
+// disks and network interfaces, for playbooks to refer to, and caches them
+// per instance.
+package facts
+
+import (
+	"github.com/poddworks/machine/lib/ssh"
+
+	"golang.org/x/net/context"
+
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	path "path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// Suffix of cached facts
+	FACTS_EXT = ".json"
+)
+
+var (
+	ErrNotCached = errors.New("Facts not cached")
+)
+
+// gatherScript prints facts as key=value lines, see Parse
+const gatherScript = `kv() { printf '%s=%s\n' "$1" "$2"; }
+kv hostname "$(hostname 2>/dev/null || cat /proc/sys/kernel/hostname)"
+kv fqdn "$(hostname -f 2>/dev/null || hostname 2>/dev/null)"
+kv system "$(uname -s)"
+kv kernel "$(uname -r)"
+kv architecture "$(uname -m)"
+if [ -r /etc/os-release ]; then
+	( . /etc/os-release; kv os_id "$ID"; kv os_like "$ID_LIKE"; kv os_version "$VERSION_ID"; kv os_codename "${VERSION_CODENAME:-$UBUNTU_CODENAME}"; kv os_pretty "$PRETTY_NAME" )
+fi
+[ -r /etc/redhat-release ] && kv redhat_release "$(cat /etc/redhat-release)"
+kv processor_count "$(getconf _NPROCESSORS_ONLN 2>/dev/null || grep -c ^processor /proc/cpuinfo)"
+kv cpu_model "$(awk -F': *' '/^model name/ { print $2; exit }' /proc/cpuinfo 2>/dev/null)"
+kv memtotal_kb "$(awk '/^MemTotal:/ { print $2 }' /proc/meminfo 2>/dev/null)"
+kv swaptotal_kb "$(awk '/^SwapTotal:/ { print $2 }' /proc/meminfo 2>/dev/null)"
+if [ -d /run/systemd/system ]; then
+	kv init_system systemd
+elif /sbin/initctl version 2>/dev/null | grep -q upstart; then
+	kv init_system upstart
+else
+	kv init_system sysvinit
+fi
+kv docker_version "$(docker --version 2>/dev/null | sed -n 's/^Docker version \([^,]*\).*/\1/p')"
+for d in /sys/block/*; do
+	[ -e "$d" ] || continue
+	n=${d##*/}
+	case $n in loop*|ram*|zram*|fd*|sr*) continue ;; esac
+	parts=$(cd "$d" && for p in "$n"*; do [ -d "$p" ] && printf '%s ' "$p"; done)
+	busy=0
+	for p in $n $parts; do
+		s=$d; [ "$p" = "$n" ] || s=$d/$p
+		dev=$(cat "$s/dev" 2>/dev/null)
+		awk -v dev="$dev" '$3 == dev { found = 1 } END { exit !found }' /proc/self/mountinfo 2>/dev/null && busy=1
+		grep -qs "^/dev/$p[[:space:]]" /proc/swaps && busy=1
+		[ -n "$(ls "$s/holders" 2>/dev/null)" ] && busy=1
+	done
+	kv device "$n $(cat "$d/size") $(cat "$d/removable") $busy $parts"
+done
+for i in /sys/class/net/*; do
+	[ -e "$i" ] || continue
+	kv interface "${i##*/} $(cat "$i/address" 2>/dev/null) $(cat "$i/operstate" 2>/dev/null)"
+done
+if command -v ip >/dev/null 2>&1; then
+	ip -o addr show 2>/dev/null | awk '{ print "address=" $2 " " $3 " " $4 }'
+	ip -4 route get 8.8.8.8 2>/dev/null | awk '/dev/ { for (i = 1; i < NF; i++) { if ($i == "dev") d = $(i + 1); if ($i == "src") s = $(i + 1) }; print "default_ipv4=" d " " s; exit }'
+fi
+exit 0
+`
+
+// Facts of a host, keyed by snake_case name as template variables are
+type Facts map[string]interface{}
+
+// Gather collects facts of the host cmdr connects to
+func Gather(ctx context.Context, cmdr ssh.Commander) (Facts, error) {
+	output, err := cmdr.RunContext(ctx, "sh -c "+ssh.Quote(gatherScript))
+	if err != nil {
+		return nil, err
+	}
+	facts := Parse(output)
+	facts["gathered_at"] = time.Now().UTC().Format(time.RFC3339)
+	return facts, nil
+}
+
+// Parse makes Facts from key=value lines printed by gather script
+func Parse(output string) Facts {
+	var (
+		facts = make(Facts)
+		raw   = make(map[string]string)
+
+		devices, interfaces []map[string]interface{}
+		free                = []string{}
+		byName              = make(map[string]map[string]interface{})
+	)
+	for _, line := range strings.Split(output, "\n") {
+		kv := strings.SplitN(line, "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		key, value := kv[0], strings.TrimSpace(kv[1])
+		switch key {
+		case "device":
+			if dev := parseDevice(value); dev != nil {
+				devices = append(devices, dev)
+				if !dev["removable"].(bool) && !dev["in_use"].(bool) && len(dev["partitions"].([]string)) == 0 {
+					free = append(free, dev["path"].(string))
+				}
+			}
+		case "interface":
+			fields := strings.Fields(value)
+			if len(fields) == 0 {
+				continue
+			}
+			iface := map[string]interface{}{"name": fields[0], "ipv4": []string{}, "ipv6": []string{}}
+			if len(fields) > 1 {
+				iface["mac"] = fields[1]
+			}
+			if len(fields) > 2 {
+				iface["state"] = fields[2]
+			}
+			interfaces, byName[fields[0]] = append(interfaces, iface), iface
+		case "address":
+			// Interfaces are listed before their addresses
+			fields := strings.Fields(value)
+			if len(fields) != 3 {
+				continue
+			}
+			if iface, ok := byName[fields[0]]; ok && (fields[1] == "inet" || fields[1] == "inet6") {
+				family := map[string]string{"inet": "ipv4", "inet6": "ipv6"}[fields[1]]
+				iface[family] = append(iface[family].([]string), fields[2])
+			}
+		case "default_ipv4":
+			if fields := strings.Fields(value); len(fields) == 2 {
+				facts["default_ipv4"] = map[string]interface{}{"interface": fields[0], "address": fields[1]}
+			}
+		default:
+			raw[key] = value
+		}
+	}
+
+	for _, key := range []string{"hostname", "fqdn", "system", "kernel", "architecture", "cpu_model", "init_system", "docker_version"} {
+		facts[key] = raw[key]
+	}
+	facts["processor_count"], _ = strconv.Atoi(raw["processor_count"])
+	memtotal, _ := strconv.Atoi(raw["memtotal_kb"])
+	swaptotal, _ := strconv.Atoi(raw["swaptotal_kb"])
+	facts["memtotal_mb"], facts["swaptotal_mb"] = memtotal/1024, swaptotal/1024
+
+	id, version := raw["os_id"], raw["os_version"]
+	if release := raw["redhat_release"]; id == "" && release != "" {
+		// CentOS 6 and the like come without os-release
+		id = strings.ToLower(strings.Fields(release)[0])
+		if id == "red" {
+			id = "rhel"
+		}
+		version = regexp.MustCompile(`[0-9][0-9.]*`).FindString(release)
+	}
+	facts["distribution"] = id
+	facts["distribution_version"] = version
+	facts["distribution_release"] = raw["os_codename"]
+	facts["distribution_pretty_name"] = raw["os_pretty"]
+	facts["os_family"] = osFamily(id, raw["os_like"])
+
+	if devices == nil {
+		devices = []map[string]interface{}{}
+	}
+	if interfaces == nil {
+		interfaces = []map[string]interface{}{}
+	}
+	facts["devices"], facts["free_devices"], facts["interfaces"] = devices, free, interfaces
+	return facts
+}
+
+// parseDevice reads "name sectors removable busy partitions..."
+func parseDevice(value string) map[string]interface{} {
+	fields := strings.Fields(value)
+	if len(fields) < 4 {
+		return nil
+	}
+	sectors, _ := strconv.ParseInt(fields[1], 10, 64)
+	var partitions = []string{}
+	for _, part := range fields[4:] {
+		partitions = append(partitions, "/dev/"+part)
+	}
+	return map[string]interface{}{
+		"name":       fields[0],
+		"path":       "/dev/" + fields[0],
+		"size_bytes": sectors * 512,
+		"removable":  fields[2] == "1",
+		"in_use":     fields[3] == "1",
+		"partitions": partitions,
+	}
+}
+
+// osFamily groups distribution id, or one it is like, into debian, redhat,
+// suse and so on
+func osFamily(id, like string) string {
+	var families = map[string]string{
+		"debian":    "debian",
+		"ubuntu":    "debian",
+		"rhel":      "redhat",
+		"centos":    "redhat",
+		"fedora":    "redhat",
+		"amzn":      "redhat",
+		"ol":        "redhat",
+		"rocky":     "redhat",
+		"almalinux": "redhat",
+		"suse":      "suse",
+		"opensuse":  "suse",
+		"sles":      "suse",
+		"alpine":    "alpine",
+		"arch":      "archlinux",
+	}
+	for _, name := range append([]string{id}, strings.Fields(like)...) {
+		if family, ok := families[name]; ok {
+			return family
+		}
+	}
+	return id
+}
+
+// cacheFile maps name of instance or host to its file inside dir
+func cacheFile(dir, name string) string {
+	return path.Join(dir, strings.Replace(name, string(os.PathSeparator), "_", -1)+FACTS_EXT)
+}
+
+// Save caches facts of name under dir, e.g. ~/.machine/facts
+func Save(dir, name string, facts Facts) error {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	content, err := json.MarshalIndent(facts, "", "    ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(cacheFile(dir, name), content, 0600)
+}
+
+// Load reads facts of name cached under dir
+func Load(dir, name string) (Facts, error) {
+	content, err := ioutil.ReadFile(cacheFile(dir, name))
+	if os.IsNotExist(err) {
+		return nil, ErrNotCached
+	} else if err != nil {
+		return nil, err
+	}
+	var facts Facts
+	if err = json.Unmarshal(content, &facts); err != nil {
+		return nil, err
+	}
+	return facts, nil
+}
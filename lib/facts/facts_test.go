@@ -0,0 +1,96 @@
+package facts
+
+import (
+	"github.com/poddworks/machine/lib/ssh"
+
+	"golang.org/x/net/context"
+
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	facts := Parse(`hostname=node-1
+kernel=4.4.0-1022-aws
+os_id=ubuntu
+os_like=debian
+os_version=16.04
+os_codename=xenial
+processor_count=2
+memtotal_kb=4046860
+init_system=systemd
+docker_version=17.03.1-ce
+device=xvda 16777216 0 1 xvda1
+device=xvdb 209715200 0 0
+device=xvdc 209715200 0 1
+device=xvdd 2048 1 0
+interface=eth0 0a:1b:2c:3d:4e:5f up
+interface=lo 00:00:00:00:00:00 unknown
+address=lo inet 127.0.0.1/8
+address=eth0 inet 172.31.5.10/20
+address=eth0 inet6 fe80::81b:2cff:fe3d:4e5f/64
+default_ipv4=eth0 172.31.5.10
+`)
+	for key, want := range map[string]interface{}{
+		"distribution":         "ubuntu",
+		"distribution_version": "16.04",
+		"distribution_release": "xenial",
+		"os_family":            "debian",
+		"processor_count":      2,
+		"memtotal_mb":          3952,
+		"init_system":          "systemd",
+		"docker_version":       "17.03.1-ce",
+		"free_devices":         []string{"/dev/xvdb"},
+		"default_ipv4":         map[string]interface{}{"interface": "eth0", "address": "172.31.5.10"},
+	} {
+		if !reflect.DeepEqual(facts[key], want) {
+			t.Errorf("%s = %#v; want %#v", key, facts[key], want)
+		}
+	}
+	devices := facts["devices"].([]map[string]interface{})
+	if len(devices) != 4 || devices[0]["size_bytes"] != int64(8589934592) || !reflect.DeepEqual(devices[0]["partitions"], []string{"/dev/xvda1"}) {
+		t.Errorf("unexpected devices %v", devices)
+	}
+	interfaces := facts["interfaces"].([]map[string]interface{})
+	if eth0 := interfaces[0]; !reflect.DeepEqual(eth0["ipv4"], []string{"172.31.5.10/20"}) || eth0["mac"] != "0a:1b:2c:3d:4e:5f" {
+		t.Errorf("unexpected interface %v", eth0)
+	}
+
+	// Releases without os-release
+	facts = Parse("redhat_release=CentOS release 6.10 (Final)\n")
+	if facts["distribution"] != "centos" || facts["distribution_version"] != "6.10" || facts["os_family"] != "redhat" {
+		t.Errorf("unexpected distribution %v %v %v", facts["distribution"], facts["distribution_version"], facts["os_family"])
+	}
+}
+
+func TestGather(t *testing.T) {
+	dir, err := ioutil.TempDir("", "facts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	facts, err := Gather(context.Background(), ssh.NewLocal())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if facts["kernel"] == "" || facts["system"] != "Linux" || facts["processor_count"].(int) < 1 {
+		t.Errorf("unexpected facts %v", facts)
+	}
+
+	if _, err = Load(dir, "node-1"); err != ErrNotCached {
+		t.Errorf("expected ErrNotCached, got %v", err)
+	}
+	if err = Save(dir, "node-1", facts); err != nil {
+		t.Fatal(err)
+	}
+	cached, err := Load(dir, "node-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cached["kernel"] != facts["kernel"] || cached["gathered_at"] != facts["gathered_at"] {
+		t.Errorf("unexpected cached facts %v", cached)
+	}
+}
@@ -0,0 +1,448 @@
+// Package inventory loads hosts and groups for exec to target, from a YAML
+// file or an Ansible style INI file.
+package inventory
+
+import (
+	"github.com/jeffjen/yaml"
+
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	path "path/filepath"
+	"sort"
+	"strings"
+)
+
+const (
+	// Group every host belongs to
+	GROUP_ALL = "all"
+
+	// Group of INI hosts listed before any section
+	GROUP_UNGROUPED = "ungrouped"
+)
+
+var (
+	ErrCyclicGroup = errors.New("Group is its own child")
+)
+
+// Settings are connection settings and variables shared by a host or group;
+// empty fields are left to whoever comes next in line
+type Settings struct {
+	User string                 `yaml:"user,omitempty"`
+	Port string                 `yaml:"port,omitempty"`
+	Key  string                 `yaml:"key,omitempty"`
+	Vars map[string]interface{} `yaml:"vars,omitempty"`
+}
+
+// apply overlays s on top of o
+func (s Settings) apply(o *Settings) {
+	if s.User != "" {
+		o.User = s.User
+	}
+	if s.Port != "" {
+		o.Port = s.Port
+	}
+	if s.Key != "" {
+		o.Key = s.Key
+	}
+	for k, v := range s.Vars {
+		if o.Vars == nil {
+			o.Vars = make(map[string]interface{})
+		}
+		o.Vars[k] = v
+	}
+}
+
+type Host struct {
+	Name string `yaml:"-"`
+
+	// Address to connect to, Name when empty
+	Addr string `yaml:"host,omitempty"`
+
+	Settings `yaml:",inline"`
+}
+
+type Group struct {
+	Name     string   `yaml:"-"`
+	Hosts    []string `yaml:"hosts,omitempty"`
+	Children []string `yaml:"children,omitempty"`
+
+	Settings `yaml:",inline"`
+}
+
+type Inventory struct {
+	Hosts  map[string]*Host  `yaml:"hosts,omitempty"`
+	Groups map[string]*Group `yaml:"groups,omitempty"`
+
+	// Host names in the order they were declared
+	order []string
+}
+
+func New() *Inventory {
+	return &Inventory{Hosts: make(map[string]*Host), Groups: make(map[string]*Group)}
+}
+
+// Load reads inventory from file, parsed as YAML when named .yml or .yaml
+// and as INI otherwise
+func Load(file string) (*Inventory, error) {
+	content, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	var inv *Inventory
+	switch path.Ext(file) {
+	case ".yml", ".yaml":
+		inv, err = ParseYAML(content)
+	default:
+		inv, err = ParseINI(content)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Unable to parse inventory %s: %v", file, err)
+	}
+	return inv, nil
+}
+
+// ParseYAML reads inventory of the form
+//
+//	hosts:
+//	  web1:
+//	    host: 10.0.0.1
+//	    user: ubuntu
+//	groups:
+//	  managers:
+//	    hosts: [web1]
+//	    vars: {swarm_role: manager}
+func ParseYAML(content []byte) (*Inventory, error) {
+	var inv = New()
+	if err := yaml.Unmarshal(content, inv); err != nil {
+		return nil, err
+	}
+	if inv.Hosts == nil {
+		inv.Hosts = make(map[string]*Host)
+	}
+	if inv.Groups == nil {
+		inv.Groups = make(map[string]*Group)
+	}
+	var names []string
+	for name, host := range inv.Hosts {
+		if host == nil {
+			host = new(Host)
+			inv.Hosts[name] = host
+		}
+		host.Name = name
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	inv.order = names
+	for name, group := range inv.Groups {
+		if group == nil {
+			group = new(Group)
+			inv.Groups[name] = group
+		}
+		group.Name = name
+	}
+	return inv, inv.complete()
+}
+
+// ParseINI reads inventory in the INI format of Ansible:
+//
+//	web1 ansible_host=10.0.0.1
+//	[managers]
+//	web1 ansible_user=ubuntu
+//	[managers:vars]
+//	swarm_role=manager
+//	[cluster:children]
+//	managers
+func ParseINI(content []byte) (*Inventory, error) {
+	var (
+		inv     = New()
+		scanner = bufio.NewScanner(bytes.NewReader(content))
+		group   = GROUP_UNGROUPED
+		kind    = "hosts"
+		lineno  = 0
+	)
+	for scanner.Scan() {
+		lineno++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, ";") {
+			continue
+		}
+		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+			group, kind = strings.Trim(line, "[]"), "hosts"
+			if idx := strings.Index(group, ":"); idx >= 0 {
+				group, kind = group[:idx], group[idx+1:]
+			}
+			switch kind {
+			case "hosts", "vars", "children":
+				inv.group(group)
+			default:
+				return nil, fmt.Errorf("line %d: unknown section kind %q", lineno, kind)
+			}
+			continue
+		}
+		fields := splitFields(line)
+		switch kind {
+		case "hosts":
+			host := inv.host(fields[0])
+			for _, field := range fields[1:] {
+				k, v, ok := splitAssign(field)
+				if !ok {
+					return nil, fmt.Errorf("line %d: expected key=value, got %q", lineno, field)
+				}
+				host.setINI(k, v)
+			}
+			g := inv.group(group)
+			g.Hosts = append(g.Hosts, host.Name)
+		case "vars":
+			k, v, ok := splitAssign(line)
+			if !ok {
+				return nil, fmt.Errorf("line %d: expected key=value, got %q", lineno, line)
+			}
+			inv.group(group).setINI(k, v)
+		case "children":
+			g := inv.group(group)
+			g.Children = append(g.Children, fields[0])
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return inv, inv.complete()
+}
+
+// splitFields splits line on white space, keeping quoted values together
+// and dropping trailing comment
+func splitFields(line string) (fields []string) {
+	var (
+		field  []rune
+		quote  rune
+		inWord bool
+	)
+	for _, r := range line {
+		switch {
+		case quote != 0:
+			if r == quote {
+				quote = 0
+			} else {
+				field = append(field, r)
+			}
+		case r == '"' || r == '\'':
+			quote, inWord = r, true
+		case r == ' ' || r == '\t':
+			if inWord {
+				fields, field, inWord = append(fields, string(field)), nil, false
+			}
+		case (r == '#' || r == ';') && !inWord:
+			return fields
+		default:
+			field, inWord = append(field, r), true
+		}
+	}
+	if inWord {
+		fields = append(fields, string(field))
+	}
+	return fields
+}
+
+func splitAssign(field string) (k, v string, ok bool) {
+	kv := strings.SplitN(field, "=", 2)
+	if len(kv) != 2 || strings.TrimSpace(kv[0]) == "" {
+		return "", "", false
+	}
+	return strings.TrimSpace(kv[0]), strings.Trim(strings.TrimSpace(kv[1]), `"'`), true
+}
+
+// setINI maps Ansible connection variables to settings, keeping the rest as
+// variables
+func (s *Settings) setINI(k, v string) {
+	switch k {
+	case "ansible_user", "ansible_ssh_user":
+		s.User = v
+	case "ansible_port", "ansible_ssh_port":
+		s.Port = v
+	case "ansible_ssh_private_key_file", "ansible_private_key_file":
+		s.Key = v
+	default:
+		if s.Vars == nil {
+			s.Vars = make(map[string]interface{})
+		}
+		s.Vars[k] = v
+	}
+}
+
+func (h *Host) setINI(k, v string) {
+	switch k {
+	case "ansible_host", "ansible_ssh_host":
+		h.Addr = v
+	default:
+		h.Settings.setINI(k, v)
+	}
+}
+
+func (inv *Inventory) host(name string) *Host {
+	host, ok := inv.Hosts[name]
+	if !ok {
+		host = &Host{Name: name}
+		inv.Hosts[name] = host
+		inv.order = append(inv.order, name)
+	}
+	return host
+}
+
+func (inv *Inventory) group(name string) *Group {
+	group, ok := inv.Groups[name]
+	if !ok {
+		group = &Group{Name: name}
+		inv.Groups[name] = group
+	}
+	return group
+}
+
+// complete declares hosts named by groups only and checks that no group is
+// its own child
+func (inv *Inventory) complete() error {
+	var names []string
+	for name := range inv.Groups {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		for _, host := range inv.Groups[name].Hosts {
+			inv.host(host)
+		}
+		for _, child := range inv.Groups[name].Children {
+			inv.group(child)
+		}
+		if _, err := inv.members(name, nil); err != nil {
+			return fmt.Errorf("%s: %v", name, err)
+		}
+	}
+	return nil
+}
+
+// members lists hosts of group and of its children, in declared order
+func (inv *Inventory) members(name string, visiting map[string]bool) ([]string, error) {
+	if visiting == nil {
+		visiting = make(map[string]bool)
+	}
+	if visiting[name] {
+		return nil, ErrCyclicGroup
+	}
+	visiting[name] = true
+	defer delete(visiting, name)
+
+	group, ok := inv.Groups[name]
+	if !ok {
+		return nil, nil
+	}
+	var hosts = append([]string{}, group.Hosts...)
+	for _, child := range group.Children {
+		more, err := inv.members(child, visiting)
+		if err != nil {
+			return nil, err
+		}
+		hosts = append(hosts, more...)
+	}
+	return hosts, nil
+}
+
+// Names lists every host in the order declared
+func (inv *Inventory) Names() []string {
+	return append([]string{}, inv.order...)
+}
+
+// Select lists hosts matched by pattern: "all", a group or a host name.  ok
+// is false when pattern names neither.
+func (inv *Inventory) Select(pattern string) (hosts []string, ok bool) {
+	if pattern == GROUP_ALL || pattern == "*" {
+		return inv.Names(), true
+	}
+	if _, ok = inv.Groups[pattern]; ok {
+		members, _ := inv.members(pattern, nil)
+		return dedup(members), true
+	}
+	if _, ok = inv.Hosts[pattern]; ok {
+		return []string{pattern}, true
+	}
+	return nil, false
+}
+
+func dedup(names []string) (uniq []string) {
+	var seen = make(map[string]bool)
+	for _, name := range names {
+		if !seen[name] {
+			seen[name] = true
+			uniq = append(uniq, name)
+		}
+	}
+	return
+}
+
+// depth of group below the groups listing it as child, for ordering
+func (inv *Inventory) depth(name string, visiting map[string]bool) int {
+	if visiting[name] {
+		return 0
+	}
+	visiting[name] = true
+	defer delete(visiting, name)
+	var d = 0
+	for _, group := range inv.Groups {
+		for _, child := range group.Children {
+			if child == name {
+				if pd := inv.depth(group.Name, visiting) + 1; pd > d {
+					d = pd
+				}
+			}
+		}
+	}
+	return d
+}
+
+// Resolve merges settings of host named name: those of "all" first, then of
+// each group it belongs to, parents before children and otherwise by name,
+// and its own last
+func (inv *Inventory) Resolve(name string) Host {
+	var resolved = Host{Name: name, Addr: name}
+	host, ok := inv.Hosts[name]
+	if !ok {
+		return resolved
+	}
+	if host.Addr != "" {
+		resolved.Addr = host.Addr
+	}
+
+	type ranked struct {
+		group *Group
+		depth int
+	}
+	var groups []ranked
+	for gname, group := range inv.Groups {
+		if gname == GROUP_ALL {
+			continue
+		}
+		members, _ := inv.members(gname, nil)
+		for _, member := range members {
+			if member == name {
+				groups = append(groups, ranked{group, inv.depth(gname, make(map[string]bool))})
+				break
+			}
+		}
+	}
+	sort.Slice(groups, func(i, j int) bool {
+		if groups[i].depth != groups[j].depth {
+			return groups[i].depth < groups[j].depth
+		}
+		return groups[i].group.Name < groups[j].group.Name
+	})
+
+	if all, ok := inv.Groups[GROUP_ALL]; ok {
+		all.Settings.apply(&resolved.Settings)
+	}
+	for _, g := range groups {
+		g.group.Settings.apply(&resolved.Settings)
+	}
+	host.Settings.apply(&resolved.Settings)
+	return resolved
+}
@@ -0,0 +1,107 @@
+package inventory
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseYAML(t *testing.T) {
+	inv, err := ParseYAML([]byte(`
+hosts:
+  web1:
+    host: 10.0.0.1
+    port: 2222
+    vars: {tier: front}
+  web2:
+groups:
+  all:
+    user: admin
+    vars: {region: us-west-2, tier: none}
+  web:
+    hosts: [web1, web2]
+    key: web.pem
+    vars: {tier: web}
+  cluster:
+    children: [web]
+    hosts: [db1]
+    user: ops
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if names := inv.Names(); !reflect.DeepEqual(names, []string{"web1", "web2", "db1"}) {
+		t.Errorf("unexpected hosts %v", names)
+	}
+	if hosts, ok := inv.Select("cluster"); !ok || !reflect.DeepEqual(hosts, []string{"db1", "web1", "web2"}) {
+		t.Errorf("unexpected cluster members %v", hosts)
+	}
+	if _, ok := inv.Select("nope"); ok {
+		t.Error("expected unknown pattern to match nothing")
+	}
+
+	web1 := inv.Resolve("web1")
+	if web1.Addr != "10.0.0.1" || web1.Port != "2222" || web1.Key != "web.pem" || web1.User != "ops" {
+		t.Errorf("unexpected settings %+v", web1)
+	}
+	if web1.Vars["tier"] != "front" || web1.Vars["region"] != "us-west-2" {
+		t.Errorf("unexpected vars %v", web1.Vars)
+	}
+	if web2 := inv.Resolve("web2"); web2.Addr != "web2" || web2.Vars["tier"] != "web" {
+		t.Errorf("unexpected settings %+v", web2)
+	}
+	if db1 := inv.Resolve("db1"); db1.User != "ops" || db1.Key != "" || db1.Vars["tier"] != "none" {
+		t.Errorf("unexpected settings %+v", db1)
+	}
+}
+
+func TestParseINI(t *testing.T) {
+	inv, err := ParseINI([]byte(`
+# swarm hosts
+bastion ansible_host=10.0.0.9
+
+[managers]
+mgr1 ansible_host=10.0.0.1 ansible_user=ubuntu
+mgr2 ansible_host=10.0.0.2 label="fast disk"
+
+[workers]
+wkr1 ansible_host=10.0.1.1 ansible_port=2222 ; spot
+
+[managers:vars]
+swarm_role=manager
+
+[swarm:children]
+managers
+workers
+
+[swarm:vars]
+ansible_ssh_private_key_file=~/.ssh/swarm.pem
+swarm_role=worker
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if names := inv.Names(); !reflect.DeepEqual(names, []string{"bastion", "mgr1", "mgr2", "wkr1"}) {
+		t.Errorf("unexpected hosts %v", names)
+	}
+	if hosts, _ := inv.Select(GROUP_UNGROUPED); !reflect.DeepEqual(hosts, []string{"bastion"}) {
+		t.Errorf("unexpected ungrouped hosts %v", hosts)
+	}
+	if hosts, _ := inv.Select("swarm"); !reflect.DeepEqual(hosts, []string{"mgr1", "mgr2", "wkr1"}) {
+		t.Errorf("unexpected swarm members %v", hosts)
+	}
+
+	mgr2 := inv.Resolve("mgr2")
+	if mgr2.Addr != "10.0.0.2" || mgr2.Key != "~/.ssh/swarm.pem" || mgr2.Vars["swarm_role"] != "manager" || mgr2.Vars["label"] != "fast disk" {
+		t.Errorf("unexpected settings %+v", mgr2)
+	}
+	wkr1 := inv.Resolve("wkr1")
+	if wkr1.Port != "2222" || wkr1.Vars["swarm_role"] != "worker" {
+		t.Errorf("unexpected settings %+v", wkr1)
+	}
+}
+
+func TestCyclicGroup(t *testing.T) {
+	if _, err := ParseINI([]byte("[a:children]\nb\n[b:children]\na\n")); err == nil {
+		t.Error("expected error for cyclic groups")
+	}
+}
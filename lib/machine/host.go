@@ -6,10 +6,15 @@ import (
 	"github.com/poddworks/machine/lib/docker"
 	"github.com/poddworks/machine/lib/ssh"
 
+	"golang.org/x/net/context"
+
 	"bytes"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"os"
+	path "path/filepath"
+	"strings"
 	"time"
 )
 
@@ -28,6 +33,23 @@ type Host struct {
 	Cert     string
 	IsDocker bool
 
+	// Private keys to try after Cert
+	Identities []string
+
+	// SSH host key verification, HostKey is the recorded fingerprint
+	HostKeyMode string
+	KnownHosts  string
+	HostKey     string
+
+	// SSH CA trusted to sign host certificates
+	HostCAFile string
+
+	// Privilege escalation method, sudo or su
+	Become string
+
+	// Jump hosts to reach this Host through
+	Bastion []ssh.Hop
+
 	// SSH config for command forwarding
 	cmdr ssh.Commander
 
@@ -41,7 +63,13 @@ func NewDockerHost() *Host {
 		Organization: config.Config.Org,
 		User:         config.Config.User,
 		Cert:         config.Config.Cert,
+		Identities:   config.Config.Identities,
 		IsDocker:     true,
+		HostKeyMode:  config.Config.HostKeyMode,
+		KnownHosts:   config.Config.KnownHosts,
+		HostCAFile:   config.Config.HostCAFile,
+		Become:       config.Config.Become,
+		Bastion:      defaultBastion(),
 		provision:    true,
 	}
 }
@@ -52,15 +80,41 @@ func NewHost() *Host {
 		Organization: config.Config.Org,
 		User:         config.Config.User,
 		Cert:         config.Config.Cert,
+		Identities:   config.Config.Identities,
 		IsDocker:     false,
+		HostKeyMode:  config.Config.HostKeyMode,
+		KnownHosts:   config.Config.KnownHosts,
+		HostCAFile:   config.Config.HostCAFile,
+		Become:       config.Config.Become,
+		Bastion:      defaultBastion(),
 		provision:    true,
 	}
 }
 
+func defaultBastion() []ssh.Hop {
+	hops, _ := ssh.ParseProxyJump(config.Config.Bastion)
+	return hops
+}
+
 func (h *Host) SetProvision(provision bool) {
 	h.provision = provision
 }
 
+func (h *Host) sshConfig(host string) ssh.Config {
+	return ssh.Config{
+		User:        h.User,
+		Server:      host,
+		Key:         h.Cert,
+		Identities:  h.Identities,
+		HostKeyMode: h.HostKeyMode,
+		HostKey:     h.HostKey,
+		KnownHosts:  h.KnownHosts,
+		HostCAFile:  h.HostCAFile,
+		Become:      h.Become,
+		Jump:        h.Bastion,
+	}
+}
+
 func (h *Host) waitSSH() error {
 	var (
 		status   = make(chan error)
@@ -81,6 +135,9 @@ func (h *Host) waitSSH() error {
 		}
 		if attempts == 0 {
 			status <- fmt.Errorf("%s - Unable to contact remote", host)
+		} else {
+			// Record host key presented by remote
+			h.HostKey = h.cmdr.HostKey()
 		}
 	}()
 	var result error
@@ -98,10 +155,49 @@ func (h *Host) waitSSH() error {
 }
 
 func (h *Host) Shell(host string) error {
-	ssh_config := ssh.Config{User: h.User, Server: host, Key: h.Cert, Port: "22"}
-	h.cmdr = ssh.New(ssh_config)
+	h.cmdr = ssh.New(h.sshConfig(host))
 	defer h.cmdr.Close()
-	return h.cmdr.Shell()
+	if err := h.cmdr.Shell(); err != nil {
+		return err
+	}
+	// Record host key presented by remote
+	h.HostKey = h.cmdr.HostKey()
+	return nil
+}
+
+// Tunnel relays connections for local and remote forwards over SSH to host
+// until ctx is done or one of the forwards fails
+func (h *Host) Tunnel(ctx context.Context, host string, local, remote []ssh.Forward) error {
+	h.cmdr = ssh.New(h.sshConfig(host))
+	defer h.cmdr.Close()
+	fwd, ok := h.cmdr.(ssh.Forwarder)
+	if !ok {
+		return fmt.Errorf("error/forward-not-supported")
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var errs = make(chan error, len(local)+len(remote))
+	for _, f := range local {
+		fmt.Println(host, "- forward local", f)
+		go func(f ssh.Forward) { errs <- fwd.LocalForward(ctx, f) }(f)
+	}
+	for _, f := range remote {
+		fmt.Println(host, "- forward remote", f)
+		go func(f ssh.Forward) { errs <- fwd.RemoteForward(ctx, f) }(f)
+	}
+	var err error
+	for i := 0; i < len(local)+len(remote); i++ {
+		if e := <-errs; e != nil && err == nil {
+			err = e
+			cancel() // tear down the rest
+		}
+	}
+
+	// Record host key presented by remote
+	h.HostKey = h.cmdr.HostKey()
+	return err
 }
 
 func (h *Host) exec(cmd string) error {
@@ -183,8 +279,7 @@ func (h *Host) InstallDockerEngine(host string) error {
 		fmt.Println(host, "- skipping Docker Engine Install")
 		return nil
 	}
-	ssh_config := ssh.Config{User: h.User, Server: host, Key: h.Cert, Port: "22"}
-	h.cmdr = ssh.New(ssh_config)
+	h.cmdr = ssh.New(h.sshConfig(host))
 	defer h.cmdr.Close()
 
 	fmt.Print(host, " - install Docker Engine ")
@@ -206,8 +301,7 @@ func (h *Host) InstallDockerEngineCertificate(host string, altname ...string) er
 		fmt.Println(host, "- skipping Docker Certificate Install")
 		return nil
 	}
-	ssh_config := ssh.Config{User: h.User, Server: host, Key: h.Cert, Port: "22"}
-	h.cmdr = ssh.New(ssh_config)
+	h.cmdr = ssh.New(h.sshConfig(host))
 	defer h.cmdr.Close()
 
 	var subAltNames = []string{
@@ -232,6 +326,125 @@ func (h *Host) InstallDockerEngineCertificate(host string, altname ...string) er
 	}
 }
 
+// InstallSSHCertificate signs host keys found on host with the SSH CA, then
+// configures sshd to present the certificates and to accept user
+// certificates signed by the same CA
+func (h *Host) InstallSSHCertificate(host string, altname ...string) error {
+	const (
+		caPath = "/etc/ssh/machine-ca.pub"
+
+		sshdConfig    = "/etc/ssh/sshd_config"
+		sshdConfigNew = "/etc/ssh/sshd_config.machine"
+	)
+
+	h.cmdr = ssh.New(h.sshConfig(host))
+	defer h.cmdr.Close()
+
+	var principals = append([]string{host}, altname...)
+
+	caPub, err := ioutil.ReadFile(path.Join(h.CertPath, cert.SSH_CA_PUB))
+	if err != nil {
+		return err
+	}
+
+	fmt.Print(host, " - configure SSH host certificate ")
+	if timeout := h.waitSSH(); timeout != nil {
+		return timeout
+	}
+	h.cmdr.Sudo()
+
+	var current = new(bytes.Buffer)
+	if err = h.cmdr.Load(sshdConfig, current); err != nil {
+		return err
+	}
+	var content = current.Bytes()
+
+	var signed = 0
+	for _, keyType := range []string{"rsa", "ecdsa", "ed25519"} {
+		var (
+			pubFile  = fmt.Sprintf("/etc/ssh/ssh_host_%s_key.pub", keyType)
+			certFile = fmt.Sprintf("/etc/ssh/ssh_host_%s_key-cert.pub", keyType)
+
+			buf = new(bytes.Buffer)
+		)
+		if err := h.cmdr.Load(pubFile, buf); err != nil {
+			continue // no host key of this type
+		}
+		fmt.Println(host, "- sign host key -", pubFile, "- principals", principals)
+		hostCert, err := cert.SignSSHHostCertificate(h.CertPath, buf.Bytes(), host, principals, cert.SSH_HOST_CERT_VALIDITY)
+		if err != nil {
+			return err
+		}
+		fmt.Print(host, " - Sending Host Certificate", " ")
+		if err = h.sendfile(bytes.NewReader(hostCert), int64(len(hostCert)), certFile, 0644); err != nil {
+			return err
+		}
+		content = setSSHDOption(content, "HostCertificate", certFile, true)
+		signed++
+	}
+	if signed == 0 {
+		return fmt.Errorf("no host key to sign on %s", host)
+	}
+
+	fmt.Print(host, " - Sending SSH CA", " ")
+	if err = h.sendfile(bytes.NewReader(caPub), int64(len(caPub)), caPath, 0644); err != nil {
+		return err
+	}
+	content = setSSHDOption(content, "TrustedUserCAKeys", caPath, false)
+
+	fmt.Print(host, " - Configuring sshd", " ")
+	if err = h.sendfile(bytes.NewReader(content), int64(len(content)), sshdConfigNew, 0644); err != nil {
+		return err
+	}
+	// Keep sshd_config in place unless sshd accepts the new one
+	if output, err := h.cmdr.Run("PATH=$PATH:/usr/sbin sshd -t -f " + sshdConfigNew); err != nil {
+		h.cmdr.RunQuiet("rm -f " + sshdConfigNew)
+		return fmt.Errorf("sshd rejected configuration on %s: %s", host, strings.TrimSpace(output))
+	}
+	if err = h.exec(fmt.Sprintf("mv -f %s %s", sshdConfigNew, sshdConfig)); err != nil {
+		return err
+	}
+
+	fmt.Print(host, " - Reloading SSH daemon", " ")
+	return h.exec("service ssh reload || service sshd reload")
+}
+
+// setSSHDOption sets keyword to value in sshd_config content.  Options go
+// ahead of the first Match block, where they apply to all connections; a
+// single valued keyword already set there is replaced, while a keyword
+// taking multiple values, e.g. HostCertificate, gains value unless present.
+func setSSHDOption(content []byte, keyword, value string, multiple bool) []byte {
+	var (
+		lines  = strings.SplitAfter(string(content), "\n")
+		option = keyword + " " + value + "\n"
+		insert = len(lines)
+	)
+	for idx, line := range lines {
+		fields := strings.FieldsFunc(line, func(r rune) bool { return r == ' ' || r == '\t' || r == '=' || r == '\n' })
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		if strings.EqualFold(fields[0], "Match") {
+			insert = idx
+			break
+		}
+		if !strings.EqualFold(fields[0], keyword) {
+			continue
+		}
+		if len(fields) > 1 && fields[1] == value {
+			return content // already set
+		} else if !multiple {
+			lines[idx] = option
+			return []byte(strings.Join(lines, ""))
+		}
+	}
+	if insert == len(lines) && lines[insert-1] != "" && !strings.HasSuffix(lines[insert-1], "\n") {
+		lines[insert-1] += "\n"
+	}
+	lines = append(lines[:insert], append([]string{option}, lines[insert:]...)...)
+	return []byte(strings.Join(lines, ""))
+}
+
 func (h *Host) sendEngineCertificate(ca, cert, key *cert.PemBlock) error {
 	host, _ := h.cmdr.Host()
 
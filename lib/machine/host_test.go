@@ -0,0 +1,46 @@
+package machine
+
+import (
+	"testing"
+)
+
+func TestSetSSHDOption(t *testing.T) {
+	var cases = []struct {
+		name     string
+		content  string
+		keyword  string
+		value    string
+		multiple bool
+		expect   string
+	}{
+		{
+			name:    "appended without Match",
+			content: "PermitRootLogin no",
+			keyword: "TrustedUserCAKeys", value: "/etc/ssh/machine-ca.pub",
+			expect: "PermitRootLogin no\nTrustedUserCAKeys /etc/ssh/machine-ca.pub\n",
+		},
+		{
+			name:    "replaced when pointing elsewhere",
+			content: "trustedusercakeys=/etc/ssh/other.pub\nMatch User sftp\n  ForceCommand internal-sftp\n",
+			keyword: "TrustedUserCAKeys", value: "/etc/ssh/machine-ca.pub",
+			expect: "TrustedUserCAKeys /etc/ssh/machine-ca.pub\nMatch User sftp\n  ForceCommand internal-sftp\n",
+		},
+		{
+			name:    "inserted ahead of Match",
+			content: "# HostCertificate ignored\nHostCertificate /etc/ssh/ssh_host_rsa_key-cert.pub\nMatch User sftp\n  HostCertificate /etc/ssh/ssh_host_ed25519_key-cert.pub\n",
+			keyword: "HostCertificate", value: "/etc/ssh/ssh_host_ed25519_key-cert.pub", multiple: true,
+			expect: "# HostCertificate ignored\nHostCertificate /etc/ssh/ssh_host_rsa_key-cert.pub\nHostCertificate /etc/ssh/ssh_host_ed25519_key-cert.pub\nMatch User sftp\n  HostCertificate /etc/ssh/ssh_host_ed25519_key-cert.pub\n",
+		},
+		{
+			name:    "kept when present",
+			content: "HostCertificate /etc/ssh/ssh_host_rsa_key-cert.pub\n",
+			keyword: "HostCertificate", value: "/etc/ssh/ssh_host_rsa_key-cert.pub", multiple: true,
+			expect: "HostCertificate /etc/ssh/ssh_host_rsa_key-cert.pub\n",
+		},
+	}
+	for _, c := range cases {
+		if got := string(setSSHDOption([]byte(c.content), c.keyword, c.value, c.multiple)); got != c.expect {
+			t.Errorf("%s: expected %q, got %q", c.name, c.expect, got)
+		}
+	}
+}
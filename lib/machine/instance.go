@@ -2,6 +2,7 @@ package machine
 
 import (
 	config "github.com/poddworks/machine/config"
+	"github.com/poddworks/machine/lib/ssh"
 
 	swarm "github.com/docker/docker/api/types/swarm"
 	docker "github.com/docker/docker/client"
@@ -15,6 +16,7 @@ import (
 	"net/http"
 	"os"
 	path "path/filepath"
+	"strings"
 )
 
 type Instance struct {
@@ -25,6 +27,18 @@ type Instance struct {
 	AltHost    []string
 	State      string
 
+	// SHA256 fingerprint of SSH host key
+	HostKey string
+
+	// Jump hosts to reach Host through
+	Bastion []ssh.Hop `json:",omitempty"`
+
+	// Docker Engine is reachable over SSH tunnel only, not on tcp:2376
+	SSHOnly bool `json:",omitempty"`
+
+	// Local end of the last Docker socket tunnel, port or unix socket
+	DockerTunnel string `json:",omitempty"`
+
 	// DO NOT SERIALIZE THIS RUNTIME FIELD
 	cli *docker.Client `json:"-"`
 }
@@ -33,6 +47,24 @@ func (inst *Instance) DockerHostName() string {
 	return fmt.Sprintf("%s://%s", inst.DockerHost.Network(), inst.DockerHost)
 }
 
+// TunnelSocket is the default local unix socket tunnelled to Docker socket
+// on instance name
+func TunnelSocket(name string) string {
+	return path.Join(config.Config.Certpath, "tunnel", name, "docker.sock")
+}
+
+// TunnelDockerHost reports DOCKER_HOST reaching Docker Engine through tunnel
+func (inst *Instance) TunnelDockerHost(name string) string {
+	switch {
+	case inst.DockerTunnel == "":
+		return "unix://" + TunnelSocket(name)
+	case strings.HasPrefix(inst.DockerTunnel, "/"):
+		return "unix://" + inst.DockerTunnel
+	default:
+		return "tcp://" + inst.DockerTunnel
+	}
+}
+
 func (inst *Instance) HostName() string {
 	return fmt.Sprintf("%s", inst.DockerHost)
 }
@@ -119,6 +151,15 @@ var (
 	InstList = make(RegisteredInstances)
 )
 
+func (r RegisteredInstances) FindByHost(host string) (name string, inst *Instance) {
+	for name, inst = range r {
+		if inst.Host == host {
+			return
+		}
+	}
+	return "", nil
+}
+
 func (r RegisteredInstances) Load() error {
 	origin, err := os.OpenFile(config.Config.Instance, os.O_RDONLY|os.O_CREATE, 0600)
 	if err != nil {
@@ -32,16 +32,36 @@ provision:
   action:
     - script: 02-config-system
       sudo: true
+    - sysctl: {name: vm.overcommit_memory, value: "1"}
+      sudo: true
+    - sysctl: {name: net.ipv4.ip_local_port_range, value: "1024 65535"}
+      sudo: true
+    - sysctl: {name: net.ipv4.tcp_rmem, value: "4096 4096 16777216"}
+      sudo: true
+    - sysctl: {name: net.ipv4.tcp_wmem, value: "4096 4096 16777216"}
+      sudo: true
+    - sysctl: {name: net.ipv4.tcp_max_syn_backlog, value: "4096"}
+      sudo: true
+    - sysctl: {name: net.ipv4.tcp_syncookies, value: "1"}
+      sudo: true
+    - sysctl: {name: net.core.somaxconn, value: "1024"}
+      sudo: true
+    - sysctl: {name: fs.file-max, value: "100000"}
+      sudo: true
+    - lineinfile: {path: /etc/security/limits.conf, line: "* - nofile 100000"}
+      sudo: true
 
 - name: Configure Docker Volume
+  when: .facts.free_devices
   action:
-    - cmd: 'pvcreate /dev/xvdb && vgcreate data /dev/xvdb && lvcreate -l 100%FREE -n docker data'
+    - cmd: 'pvcreate {{index .facts.free_devices 0}} && vgcreate data {{index .facts.free_devices 0}} && lvcreate -l 100%FREE -n docker data'
       shell: true
       sudo: true
     - cmd: 'mkfs.ext4 /dev/data/docker'
       sudo: true
-    - cmd: 'echo "/dev/mapper/data-docker /data ext4 rw 0 0" >>/etc/fstab'
-      shell: true
+    - file: {path: /data, state: directory}
+      sudo: true
+    - mount: {src: /dev/mapper/data-docker, path: /data, fstype: ext4, opts: rw, state: present}
       sudo: true
 
 - name: Configure Docker Engine
@@ -49,6 +69,10 @@ provision:
     - src: docker.daemon.json
       dst: /etc/docker/daemon.json
       sudo: true
+      notify: Reset Docker Engine
+
+handlers:
+- name: Reset Docker Engine
   action:
     - cmd: 'service docker stop'
       sudo: true
@@ -64,8 +88,7 @@ provision:
     - cmd: 'fallocate -l 8G /swapfile && chmod 600 /swapfile && mkswap /swapfile'
       shell: true
       sudo: true
-    - cmd: 'echo "/swapfile none swap sw 0 0" >>/etc/fstab'
-      shell: true
+    - mount: {src: /swapfile, path: none, fstype: swap, opts: sw, state: present}
       sudo: true
 
 ---
@@ -97,9 +120,6 @@ apt-get update && apt-get install -y docker-engine
 
 const CONFIGURE_SYSTEM = `#!/bin/bash
 
-truncate -s0 /etc/sysctl.conf
-echo "vm.overcommit_memory = 1" >>/etc/sysctl.conf
-
 cat <<\EOF >/etc/init.d/disable-transparent-hugepages
 #!/bin/sh
 ### BEGIN INIT INFO
@@ -130,17 +150,6 @@ esac
 EOF
 chmod 755 /etc/init.d/disable-transparent-hugepages
 update-rc.d disable-transparent-hugepages defaults
-
-# Adjust server network limit
-echo "net.ipv4.ip_local_port_range = 1024 65535" >>/etc/sysctl.conf
-echo "net.ipv4.tcp_rmem = 4096 4096 16777216" >>/etc/sysctl.conf
-echo "net.ipv4.tcp_wmem = 4096 4096 16777216" >>/etc/sysctl.conf
-echo "net.ipv4.tcp_max_syn_backlog = 4096" >>/etc/sysctl.conf
-echo "net.ipv4.tcp_syncookies = 1" >>/etc/sysctl.conf
-echo "net.core.somaxconn = 1024" >>/etc/sysctl.conf
-
-echo "fs.file-max = 100000" >>/etc/sysctl.conf
-echo "* - nofile 100000" >>/etc/security/limits.conf
 `
 
 const DOCKER_DAEMON_CONFIG = `{
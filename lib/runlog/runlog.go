@@ -0,0 +1,354 @@
+// Package runlog records what exec did on each host: a structured log of
+// JSON lines for the whole run plus a plain text transcript per host.
+package runlog
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	path "path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// Structured log of the run, one Record per line
+	EVENTS_FILE = "events.jsonl"
+
+	// Suffix of per host transcript
+	TRANSCRIPT_EXT = ".log"
+
+	// Where each host got to in the playbook, see Progress
+	PROGRESS_FILE = "progress.json"
+
+	// Action or archive transfer begins
+	EVENT_START = "start"
+
+	// Line of output from an action
+	EVENT_OUTPUT = "output"
+
+	// Action or archive transfer is done, see ExitCode, Duration and Error
+	EVENT_EXIT = "exit"
+)
+
+var (
+	ErrRunNotFound = errors.New("Run not found")
+	ErrNoProgress  = errors.New("Run recorded no playbook progress")
+)
+
+type Record struct {
+	Time      time.Time `json:"time"`
+	Host      string    `json:"host"`
+	Provision string    `json:"provision,omitempty"`
+	Action    string    `json:"action,omitempty"`
+	Event     string    `json:"event"`
+
+	// Output line and the stream it came from, "stdout" or "stderr"
+	Stream string `json:"stream,omitempty"`
+	Text   string `json:"text,omitempty"`
+
+	// Outcome, on EVENT_EXIT only
+	ExitCode *int    `json:"exit_code,omitempty"`
+	Signal   string  `json:"signal,omitempty"`
+	Duration float64 `json:"duration,omitempty"` // seconds
+	Error    string  `json:"error,omitempty"`
+}
+
+// Format renders rec as a transcript line, prefixed with host when asked
+func (rec Record) Format(withHost bool) string {
+	var fields = []string{rec.Time.Format(time.RFC3339)}
+	if withHost {
+		fields = append(fields, rec.Host, "-")
+	}
+	if rec.Provision != "" {
+		fields = append(fields, rec.Provision, "-")
+	}
+	switch rec.Event {
+	case EVENT_START:
+		fields = append(fields, "$", rec.Action)
+	case EVENT_OUTPUT:
+		if rec.Stream == "stderr" {
+			fields = append(fields, "!")
+		}
+		fields = append(fields, rec.Text)
+	case EVENT_EXIT:
+		var outcome = "done"
+		switch {
+		case rec.Signal != "":
+			outcome = "killed by " + rec.Signal
+		case rec.ExitCode != nil:
+			outcome = fmt.Sprintf("exit %d", *rec.ExitCode)
+		}
+		fields = append(fields, outcome, "in", fmt.Sprintf("%.3fs", rec.Duration))
+		if rec.Error != "" {
+			fields = append(fields, "-", rec.Error)
+		}
+	}
+	return strings.Join(fields, " ")
+}
+
+// Progress is where a host carries on in a playbook: index of document,
+// provision section and action, counted from 0.  Provision -1 stands for
+// archives sent ahead of the sections, and one past the last section for
+// handlers, with Action counted in Handler.
+type Progress struct {
+	Document  int    `json:"document"`
+	Provision int    `json:"provision"`
+	Action    int    `json:"action"`
+	Handler   string `json:"handler,omitempty"`
+
+	// Handlers notified so far in this document, and those done running
+	Notified []string `json:"notified,omitempty"`
+	Handled  []string `json:"handled,omitempty"`
+
+	// Results registered so far in this document, by name
+	Registered map[string]interface{} `json:"registered,omitempty"`
+
+	// Host stopped here on error
+	Failed bool   `json:"failed,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+// Start is the beginning of document doc
+func Start(doc int) Progress {
+	return Progress{Document: doc, Provision: -1}
+}
+
+// Resumed is where to carry on from p, its error left behind
+func (p Progress) Resumed() Progress {
+	p.Failed, p.Error = false, ""
+	return p
+}
+
+// State is progress of every host through the playbook of a run
+type State struct {
+	Playbook string              `json:"playbook,omitempty"`
+	Hosts    map[string]Progress `json:"hosts"`
+}
+
+// Run writes the logs of one exec invocation into its own directory
+type Run struct {
+	Id  string
+	Dir string
+
+	// Applied to text of every record, e.g. masking secrets; may be nil
+	Mask func(string) string
+
+	lock   sync.Mutex
+	events *os.File
+	hosts  map[string]*os.File
+	state  State
+}
+
+// NewId makes run id that sorts in the order runs were started
+func NewId() string {
+	var suffix [3]byte
+	rand.Read(suffix[:])
+	return time.Now().UTC().Format("20060102T150405Z") + "-" + hex.EncodeToString(suffix[:])
+}
+
+// New starts Run under root, e.g. ~/.machine/runs
+func New(root string) (*Run, error) {
+	var (
+		id  = NewId()
+		dir = path.Join(root, id)
+	)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	events, err := os.OpenFile(path.Join(dir, EVENTS_FILE), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return &Run{Id: id, Dir: dir, events: events, hosts: make(map[string]*os.File), state: State{Hosts: make(map[string]Progress)}}, nil
+}
+
+// transcriptName maps host to a file name inside run directory
+func transcriptName(host string) string {
+	return strings.Replace(host, string(os.PathSeparator), "_", -1) + TRANSCRIPT_EXT
+}
+
+// Log appends rec to the run log and to the transcript of its host, filling
+// in Time when not set.  Logging on a nil Run is a NOOP.
+func (r *Run) Log(rec Record) {
+	if r == nil {
+		return
+	}
+	if rec.Time.IsZero() {
+		rec.Time = time.Now()
+	}
+	if r.Mask != nil {
+		rec.Provision, rec.Action, rec.Text, rec.Error = r.Mask(rec.Provision), r.Mask(rec.Action), r.Mask(rec.Text), r.Mask(rec.Error)
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if line, err := json.Marshal(rec); err == nil {
+		r.events.Write(append(line, '\n'))
+	}
+	transcript, ok := r.hosts[rec.Host]
+	if !ok {
+		transcript, _ = os.OpenFile(path.Join(r.Dir, transcriptName(rec.Host)), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+		r.hosts[rec.Host] = transcript // nil when unable to open, not retried
+	}
+	if transcript != nil {
+		fmt.Fprintln(transcript, rec.Format(false))
+	}
+}
+
+// SetPlaybook records which playbook this run goes through
+func (r *Run) SetPlaybook(playbook string) {
+	if r == nil {
+		return
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.state.Playbook = playbook
+	r.saveState()
+}
+
+// Mark records where host is in the playbook, so that a later run may
+// resume from there, with Mask applied to error and registered results as
+// Log does.  Marking on a nil Run is a NOOP.
+func (r *Run) Mark(host string, at Progress) {
+	if r == nil {
+		return
+	}
+	if r.Mask != nil {
+		at.Error = r.Mask(at.Error)
+		if len(at.Registered) > 0 {
+			at.Registered = maskRegistered(at.Registered, r.Mask)
+		}
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.state.Hosts[host] = at
+	r.saveState()
+}
+
+// maskRegistered applies mask to every string of registered results.  They
+// are read back through JSON first, so that whatever they are made of is
+// walked as plain maps and lists.
+func maskRegistered(registered map[string]interface{}, mask func(string) string) map[string]interface{} {
+	var masked map[string]interface{}
+	if content, err := json.Marshal(registered); err != nil || json.Unmarshal(content, &masked) != nil {
+		return nil // left out rather than saved unmasked
+	}
+	maskValue(masked, mask)
+	return masked
+}
+
+func maskValue(v interface{}, mask func(string) string) interface{} {
+	switch v := v.(type) {
+	case string:
+		return mask(v)
+	case map[string]interface{}:
+		for key, value := range v {
+			v[key] = maskValue(value, mask)
+		}
+	case []interface{}:
+		for idx, value := range v {
+			v[idx] = maskValue(value, mask)
+		}
+	}
+	return v
+}
+
+// saveState replaces progress file whole, so that an interrupted run does not
+// leave it partly written
+func (r *Run) saveState() {
+	content, err := json.MarshalIndent(r.state, "", "    ")
+	if err != nil {
+		return
+	}
+	var dst = path.Join(r.Dir, PROGRESS_FILE)
+	if err = ioutil.WriteFile(dst+".tmp", content, 0600); err == nil {
+		os.Rename(dst+".tmp", dst)
+	}
+}
+
+func (r *Run) Close() error {
+	if r == nil {
+		return nil
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	for _, transcript := range r.hosts {
+		if transcript != nil {
+			transcript.Close()
+		}
+	}
+	return r.events.Close()
+}
+
+// List reports id of runs recorded under root, oldest first
+func List(root string) ([]string, error) {
+	entries, err := ioutil.ReadDir(root)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var ids []string
+	for _, entry := range entries {
+		if _, err := os.Stat(path.Join(root, entry.Name(), EVENTS_FILE)); entry.IsDir() && err == nil {
+			ids = append(ids, entry.Name())
+		}
+	}
+	sort.Strings(ids)
+	return ids, nil
+}
+
+// Read loads records of run id under root, keeping those for host only when
+// host is given
+func Read(root, id, host string) ([]Record, error) {
+	origin, err := os.Open(path.Join(root, id, EVENTS_FILE))
+	if os.IsNotExist(err) {
+		return nil, ErrRunNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	defer origin.Close()
+	var (
+		records []Record
+		scanner = bufio.NewScanner(origin)
+	)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		var rec Record
+		if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+			continue // partial line left by an interrupted run
+		}
+		if host == "" || rec.Host == host {
+			records = append(records, rec)
+		}
+	}
+	return records, scanner.Err()
+}
+
+// ReadState loads progress of hosts through the playbook of run id under root
+func ReadState(root, id string) (*State, error) {
+	if _, err := os.Stat(path.Join(root, id, EVENTS_FILE)); os.IsNotExist(err) {
+		return nil, ErrRunNotFound
+	}
+	content, err := ioutil.ReadFile(path.Join(root, id, PROGRESS_FILE))
+	if os.IsNotExist(err) {
+		return nil, ErrNoProgress
+	} else if err != nil {
+		return nil, err
+	}
+	var state State
+	if err = json.Unmarshal(content, &state); err != nil {
+		return nil, err
+	}
+	if len(state.Hosts) == 0 {
+		return nil, ErrNoProgress
+	}
+	return &state, nil
+}
@@ -0,0 +1,183 @@
+package ssh
+
+import (
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/terminal"
+
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+const (
+	// Environment variable consulted for private key passphrase before
+	// prompting
+	KEY_PASSPHRASE_ENV = "MACHINE_KEY_PASSPHRASE"
+)
+
+var (
+	// Passphrases entered this run, by key file, so each is asked once
+	passphrases     = make(map[string][]byte)
+	passphrasesLock sync.Mutex
+
+	// Prompt asks user question on the controlling terminal, echoing answer
+	// as typed only when echo is set
+	Prompt = promptTTY
+)
+
+// AuthError reports a failed login along with the methods attempted
+type AuthError struct {
+	User string
+	Addr string
+
+	// Methods offered to server, e.g. "publickey (~/.ssh/id_rsa)"
+	Tried []string
+
+	// Identities left out and why
+	Skipped []string
+
+	err error
+}
+
+func (e *AuthError) Error() string {
+	msg := fmt.Sprintf("Unable to authenticate %s@%s; tried %s", e.User, e.Addr, strings.Join(e.Tried, ", "))
+	if len(e.Tried) == 0 {
+		msg = fmt.Sprintf("Unable to authenticate %s@%s; no authentication method available", e.User, e.Addr)
+	}
+	if len(e.Skipped) > 0 {
+		msg += "; skipped " + strings.Join(e.Skipped, ", ")
+	}
+	return msg
+}
+
+func isAuthFailure(err error) bool {
+	return err != nil && strings.Contains(err.Error(), "unable to authenticate")
+}
+
+func promptTTY(question string, echo bool) (string, error) {
+	tty, err := os.OpenFile("/dev/tty", os.O_RDWR, 0)
+	if err != nil {
+		return "", ErrNoTTY
+	}
+	defer tty.Close()
+	fmt.Fprint(tty, question)
+	if echo {
+		var answer string
+		_, err = fmt.Fscanln(tty, &answer)
+		return answer, err
+	}
+	answer, err := terminal.ReadPassword(int(tty.Fd()))
+	fmt.Fprintln(tty)
+	return string(answer), err
+}
+
+func keyPassphrase(keyfile string) ([]byte, error) {
+	if env := os.Getenv(KEY_PASSPHRASE_ENV); env != "" {
+		return []byte(env), nil
+	}
+	passphrasesLock.Lock()
+	defer passphrasesLock.Unlock()
+	if passphrase, ok := passphrases[keyfile]; ok {
+		return passphrase, nil
+	}
+	answer, err := Prompt(fmt.Sprintf("Enter passphrase for key '%s': ", keyfile), false)
+	if err != nil {
+		return nil, err
+	}
+	passphrases[keyfile] = []byte(answer)
+	return passphrases[keyfile], nil
+}
+
+func forgetPassphrase(keyfile string) {
+	passphrasesLock.Lock()
+	defer passphrasesLock.Unlock()
+	delete(passphrases, keyfile)
+}
+
+// loadKeyFile parses private key in keyfile, PEM or OpenSSH format,
+// decrypting it with passphrase when protected
+func loadKeyFile(keyfile string) (ssh.Signer, error) {
+	keyfile = expandHome(keyfile)
+	keyfile, err := filepath.Abs(keyfile)
+	if err != nil {
+		return nil, err
+	}
+	buf, err := ioutil.ReadFile(keyfile)
+	if err != nil {
+		return nil, err
+	}
+	if block, _ := pem.Decode(buf); block == nil {
+		return nil, ErrKeyFormat
+	}
+	key, err := ssh.ParseRawPrivateKey(buf)
+	if _, protected := err.(*ssh.PassphraseMissingError); !protected {
+		if err != nil {
+			return nil, fmt.Errorf("%v: %v", ErrKeyFormat, err)
+		}
+		return ssh.NewSignerFromKey(key)
+	}
+	passphrase, err := keyPassphrase(keyfile)
+	if err != nil {
+		return nil, err
+	}
+	signer, err := ssh.ParsePrivateKeyWithPassphrase(buf, passphrase)
+	if err == x509.IncorrectPasswordError {
+		forgetPassphrase(keyfile)
+		return nil, ErrKeyPassphrase
+	}
+	return signer, err
+}
+
+// certSigner pairs signer with the OpenSSH style companion certificate
+// keyfile-cert.pub when there is one
+func certSigner(keyfile string, signer ssh.Signer) (ssh.Signer, bool) {
+	buf, err := ioutil.ReadFile(expandHome(keyfile) + "-cert.pub")
+	if err != nil {
+		return nil, false
+	}
+	pub, _, _, _, err := ssh.ParseAuthorizedKey(buf)
+	if err != nil {
+		return nil, false
+	}
+	cert, ok := pub.(*ssh.Certificate)
+	if !ok {
+		return nil, false
+	}
+	certSigner, err := ssh.NewCertSigner(cert, signer)
+	if err != nil {
+		return nil, false
+	}
+	return certSigner, true
+}
+
+// keyboardInteractive answers server challenges, e.g. OTP, on the terminal.
+// A lone non echoed question is answered with password when one is given.
+func keyboardInteractive(password string) ssh.KeyboardInteractiveChallenge {
+	return func(user, instruction string, questions []string, echos []bool) ([]string, error) {
+		if len(questions) == 1 && !echos[0] && password != "" {
+			answer := password
+			password = "" // use once, ask user if challenged again
+			return []string{answer}, nil
+		}
+		if instruction != "" {
+			if tty, err := os.OpenFile("/dev/tty", os.O_WRONLY, 0); err == nil {
+				fmt.Fprintln(tty, instruction)
+				tty.Close()
+			}
+		}
+		answers := make([]string, len(questions))
+		for idx, question := range questions {
+			answer, err := Prompt(question, echos[idx])
+			if err != nil {
+				return nil, err
+			}
+			answers[idx] = answer
+		}
+		return answers, nil
+	}
+}
@@ -0,0 +1,190 @@
+package ssh
+
+import (
+	"github.com/poddworks/machine/lib/ssh/sshtest"
+
+	"golang.org/x/crypto/ssh"
+
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// writeKey generates RSA key into dir, encrypted with passphrase if given
+func writeKey(t *testing.T, dir, name, passphrase string) (string, ssh.PublicKey) {
+	key, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	block := &pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)}
+	if passphrase != "" {
+		if block, err = x509.EncryptPEMBlock(rand.Reader, block.Type, block.Bytes, []byte(passphrase), x509.PEMCipherAES128); err != nil {
+			t.Fatal(err)
+		}
+	}
+	keyfile := filepath.Join(dir, name)
+	if err = ioutil.WriteFile(keyfile, pem.EncodeToMemory(block), 0600); err != nil {
+		t.Fatal(err)
+	}
+	pub, err := ssh.NewPublicKey(&key.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return keyfile, pub
+}
+
+func TestLoadKeyFilePassphrase(t *testing.T) {
+	dir, err := ioutil.TempDir("", "keys")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	keyfile, pub := writeKey(t, dir, "id_rsa", "secret")
+
+	var asked int
+	defer func(prompt func(string, bool) (string, error)) { Prompt = prompt }(Prompt)
+	Prompt = func(question string, echo bool) (string, error) {
+		asked++
+		return "secret", nil
+	}
+	for i := 0; i < 2; i++ {
+		signer, err := loadKeyFile(keyfile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if Fingerprint(signer.PublicKey()) != Fingerprint(pub) {
+			t.Error("decrypted key does not match")
+		}
+	}
+	if asked != 1 {
+		t.Errorf("expected passphrase asked once, asked %d times", asked)
+	}
+
+	os.Setenv(KEY_PASSPHRASE_ENV, "wrong")
+	defer os.Unsetenv(KEY_PASSPHRASE_ENV)
+	if _, err = loadKeyFile(keyfile); err != ErrKeyPassphrase {
+		t.Errorf("expected ErrKeyPassphrase, got %v", err)
+	}
+}
+
+func TestAuthIdentities(t *testing.T) {
+	srv, err := sshtest.NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	keyfile, pub := writeKey(t, srv.Dir, "id_rsa", "")
+	host, port := srv.Host()
+
+	defer func(prompt func(string, bool) (string, error)) { Prompt = prompt }(Prompt)
+	Prompt = func(question string, echo bool) (string, error) {
+		return "", ErrNoTTY
+	}
+
+	cfg := Config{
+		User:       srv.User,
+		Server:     host,
+		Port:       port,
+		HostKey:    Fingerprint(srv.HostKey),
+		Key:        filepath.Join(srv.Dir, "missing"),
+		Identities: []string{keyfile},
+	}
+	cmdr := newSSHCommander(cfg)
+	_, err = cmdr.Run("true")
+	authErr, ok := err.(*AuthError)
+	if !ok {
+		t.Fatalf("expected AuthError, got %v", err)
+	}
+	if msg := authErr.Error(); !strings.Contains(msg, "publickey ("+keyfile+")") || !strings.Contains(msg, "missing (not found)") {
+		t.Errorf("unexpected report %q", msg)
+	}
+	cmdr.Close()
+
+	srv.Authorize(pub)
+	cmdr = newSSHCommander(cfg)
+	defer cmdr.Close()
+	if _, err = cmdr.Run("true"); err != nil {
+		t.Errorf("expected login with second identity, got %v", err)
+	}
+}
+
+func TestLoadKeyFileOpenSSH(t *testing.T) {
+	var asked int
+	defer func(prompt func(string, bool) (string, error)) { Prompt = prompt }(Prompt)
+	Prompt = func(question string, echo bool) (string, error) {
+		asked++
+		return "secret", nil
+	}
+
+	// Keys written by ssh-keygen in openssh-key-v1 format, passphrase secret
+	for _, name := range []string{"id_ed25519", "id_ed25519_enc", "id_rsa_enc"} {
+		keyfile := filepath.Join("testdata", name)
+		buf, err := ioutil.ReadFile(keyfile + ".pub")
+		if err != nil {
+			t.Fatal(err)
+		}
+		pub, _, _, _, err := ssh.ParseAuthorizedKey(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 2; i++ {
+			signer, err := loadKeyFile(keyfile)
+			if err != nil {
+				t.Fatalf("%s: %v", name, err)
+			}
+			if Fingerprint(signer.PublicKey()) != Fingerprint(pub) {
+				t.Errorf("%s: decrypted key does not match", name)
+			}
+		}
+	}
+	if asked != 2 {
+		t.Errorf("expected passphrase asked once for each protected key, asked %d times", asked)
+	}
+
+	os.Setenv(KEY_PASSPHRASE_ENV, "wrong")
+	defer os.Unsetenv(KEY_PASSPHRASE_ENV)
+	if _, err := loadKeyFile(filepath.Join("testdata", "id_ed25519_enc")); err != ErrKeyPassphrase {
+		t.Errorf("expected ErrKeyPassphrase, got %v", err)
+	}
+	if _, err := loadKeyFile(filepath.Join("testdata", "id_ed25519.pub")); err != ErrKeyFormat {
+		t.Errorf("expected ErrKeyFormat, got %v", err)
+	}
+}
+
+func TestAuthOpenSSHKey(t *testing.T) {
+	srv, err := sshtest.NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	buf, err := ioutil.ReadFile(filepath.Join("testdata", "id_ed25519_enc.pub"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	pub, _, _, _, err := ssh.ParseAuthorizedKey(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv.Authorize(pub)
+
+	os.Setenv(KEY_PASSPHRASE_ENV, "secret")
+	defer os.Unsetenv(KEY_PASSPHRASE_ENV)
+	host, port := srv.Host()
+	cmdr := newSSHCommander(Config{
+		User:    srv.User,
+		Server:  host,
+		Port:    port,
+		HostKey: Fingerprint(srv.HostKey),
+		Key:     filepath.Join("testdata", "id_ed25519_enc"),
+	})
+	defer cmdr.Close()
+	if _, err = cmdr.Run("true"); err != nil {
+		t.Errorf("expected login with passphrase protected ed25519 key, got %v", err)
+	}
+}
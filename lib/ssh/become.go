@@ -0,0 +1,271 @@
+package ssh
+
+import (
+	"golang.org/x/crypto/ssh"
+
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sync"
+)
+
+const (
+	// Escalate with sudo(8), the default
+	BecomeSudo = "sudo"
+
+	// Escalate with su(1), which reads password from a terminal only
+	BecomeSu = "su"
+
+	// Environment variable consulted for sudo or su password before
+	// prompting
+	BECOME_PASSWORD_ENV = "MACHINE_BECOME_PASSWORD"
+
+	// Prompt handed to sudo -p so it can be told apart from command output
+	becomePrompt = "[machine-become-password]"
+
+	// Line printed once escalation is done, before command starts
+	becomeReady = "machine-become-ready"
+)
+
+var (
+	// Passwords entered this run, by login, so each is asked once
+	becomePasswords     = make(map[string]string)
+	becomePasswordsLock sync.Mutex
+
+	// Terminal for su to prompt on, raw so that output passes unaltered
+	becomeTermModes = ssh.TerminalModes{
+		ssh.ECHO:   0,
+		ssh.ICANON: 0,
+		ssh.ISIG:   0,
+		ssh.IEXTEN: 0,
+		ssh.ICRNL:  0,
+		ssh.IXON:   0,
+		ssh.OPOST:  0,
+	}
+)
+
+// IsBecomeMethod reports whether method is a recognized escalation method
+func IsBecomeMethod(method string) bool {
+	switch method {
+	case BecomeSudo, BecomeSu:
+		return true
+	default:
+		return false
+	}
+}
+
+func becomePassword(login string) (string, error) {
+	if env := os.Getenv(BECOME_PASSWORD_ENV); env != "" {
+		return env, nil
+	}
+	becomePasswordsLock.Lock()
+	defer becomePasswordsLock.Unlock()
+	if password, ok := becomePasswords[login]; ok {
+		return password, nil
+	}
+	answer, err := Prompt(fmt.Sprintf("Password to become on %s: ", login), false)
+	if err != nil {
+		return "", err
+	}
+	becomePasswords[login] = answer
+	return answer, nil
+}
+
+func forgetBecomePassword(login string) {
+	becomePasswordsLock.Lock()
+	defer becomePasswordsLock.Unlock()
+	delete(becomePasswords, login)
+}
+
+// becomeCommand wraps cmd for running as user through method; empty user
+// means root.  cmd reaches the shell as a single quoted argument.  As with
+// sudo -s, that is the login user's shell rather than /bin/sh, so commands
+// run the same elevated or not; su runs the shell of user.
+func becomeCommand(method, user, cmd string) string {
+	var inner = "echo " + becomeReady + " >&2; " + cmd
+	switch method {
+	case BecomeSu:
+		if user == "" {
+			user = "root"
+		}
+		return fmt.Sprintf("su %s -c %s", Quote(user), Quote(inner))
+	default:
+		var line = "sudo -S -p " + Quote(becomePrompt)
+		if user != "" {
+			line += " -u " + Quote(user)
+		}
+		return line + ` -- "${SHELL:-/bin/sh}" -c ` + Quote(inner)
+	}
+}
+
+// escalation sits between caller and an elevated process.  It answers the
+// password prompt seen on the watched output and holds caller's stdin back
+// until escalation is done, so that none of it is taken for the password.
+type escalation struct {
+	prompt string
+	login  string
+
+	// Caller's stdin and the pipe feeding process stdin
+	stdin  io.Reader
+	pipe   *io.PipeWriter
+	reader *io.PipeReader
+
+	// Set when escalation is refused, read after done is closed
+	err  error
+	done chan struct{}
+}
+
+// newEscalation prepares escalation through method for login, returning
+// reader to hand to process as its stdin
+func newEscalation(method, login string, stdin io.Reader) (*escalation, io.Reader) {
+	var prompt = becomePrompt
+	if method == BecomeSu {
+		prompt = "assword:" // su takes no prompt of our choosing
+	}
+	r, w := io.Pipe()
+	return &escalation{
+		prompt: prompt,
+		login:  login,
+		stdin:  stdin,
+		pipe:   w,
+		reader: r,
+		done:   make(chan struct{}),
+	}, r
+}
+
+func (e *escalation) answer(again bool) {
+	if again {
+		forgetBecomePassword(e.login)
+		e.err = ErrBecomePassword
+		e.pipe.Close() // give up instead of retrying the same password
+		return
+	}
+	password, err := becomePassword(e.login)
+	if err != nil {
+		e.err = err
+		e.pipe.Close()
+		return
+	}
+	io.WriteString(e.pipe, password+"\n")
+}
+
+// ready lets caller's stdin through to the process
+func (e *escalation) ready() {
+	go func() {
+		if e.stdin != nil {
+			io.Copy(e.pipe, e.stdin)
+		}
+		e.pipe.Close()
+	}()
+}
+
+// watch copies watched output into out, answering password prompt and
+// dropping markers, until watched is exhausted
+func (e *escalation) watch(watched io.Reader, out io.Writer) {
+	defer close(e.done)
+	if out == nil {
+		out = ioutil.Discard
+	}
+	var (
+		prompt   = []byte(e.prompt)
+		marker   = []byte(becomeReady + "\n")
+		keep     = len(marker)
+		pending  []byte
+		prompted bool
+		buf      = make([]byte, 4096)
+	)
+	if len(prompt) > keep {
+		keep = len(prompt)
+	}
+	for {
+		n, err := watched.Read(buf)
+		pending = append(pending, buf[:n]...)
+		for {
+			if idx := bytes.Index(pending, prompt); idx >= 0 {
+				out.Write(pending[:idx])
+				pending = pending[idx+len(prompt):]
+				e.answer(prompted)
+				prompted = true
+				continue
+			}
+			if idx := bytes.Index(pending, marker); idx >= 0 {
+				out.Write(pending[:idx])
+				out.Write(pending[idx+len(marker):])
+				e.ready()
+				io.Copy(out, watched)
+				return
+			}
+			break
+		}
+		if err != nil {
+			out.Write(pending)
+			e.pipe.Close() // escalation failed, let session finish
+			return
+		}
+		// Pass along what cannot be the start of a marker
+		if len(pending) > keep {
+			out.Write(pending[:len(pending)-keep])
+			pending = pending[len(pending)-keep:]
+		}
+	}
+}
+
+// start runs cmd on session with stdin, stdout and stderr attached,
+// elevated when in sudo.  wait reports command result once all of its
+// output is delivered.
+func (sshCmd *SSHCommander) start(session *ssh.Session, cmd string, stdin io.Reader, stdout, stderr io.Writer) (wait func() error, err error) {
+	if !sshCmd.sudo {
+		session.Stdin, session.Stdout, session.Stderr = stdin, stdout, stderr
+		if err = session.Start(cmd); err != nil {
+			return nil, err
+		}
+		return session.Wait, nil
+	}
+
+	var (
+		watched io.Reader
+		out     io.Writer
+	)
+	esc, procStdin := newEscalation(sshCmd.become, sshCmd.ssh_config.User+"@"+sshCmd.addr, stdin)
+	session.Stdin = procStdin
+	if sshCmd.become == BecomeSu {
+		if err = session.RequestPty("xterm", 24, 80, becomeTermModes); err != nil {
+			return nil, err
+		}
+		// Terminal merges stderr into stdout
+		session.Stderr = stderr
+		watched, err = session.StdoutPipe()
+		out = stdout
+	} else {
+		session.Stdout = stdout
+		watched, err = session.StderrPipe()
+		out = stderr
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err = session.Start(becomeCommand(sshCmd.become, sshCmd.sudoUser, cmd)); err != nil {
+		return nil, err
+	}
+	go esc.watch(watched, out)
+	return func() error {
+		err := session.Wait()
+		esc.reader.Close() // unblock writes nobody is left to read
+		<-esc.done
+		if esc.err != nil {
+			return esc.err
+		}
+		return err
+	}, nil
+}
+
+// run is start followed by wait
+func (sshCmd *SSHCommander) run(session *ssh.Session, cmd string, stdin io.Reader, stdout, stderr io.Writer) error {
+	wait, err := sshCmd.start(session, cmd, stdin, stdout, stderr)
+	if err != nil {
+		return err
+	}
+	return wait()
+}
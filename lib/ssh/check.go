@@ -0,0 +1,323 @@
+package ssh
+
+import (
+	"golang.org/x/net/context"
+
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	// Lines of context around each change in a diff
+	DIFF_CONTEXT = 3
+
+	// Remote file larger than this is compared by checksum only
+	DIFF_MAX_SIZE = 1 << 20
+
+	// Lines beyond this product of both sides are diffed as a whole
+	DIFF_MAX_CELLS = 1 << 22
+)
+
+// edit is one line of a diff: ' ' kept, '-' removed or '+' added, along
+// with how many lines of either side come before it
+type edit struct {
+	op     byte
+	line   string
+	ai, bi int
+}
+
+// Diff returns unified diff turning before into after, both named name;
+// empty when they are the same
+func Diff(name string, before, after []byte) string {
+	if bytes.Equal(before, after) {
+		return ""
+	}
+	if bytes.IndexByte(before, 0) >= 0 || bytes.IndexByte(after, 0) >= 0 {
+		return fmt.Sprintf("Binary files %s differ\n", name)
+	}
+	var (
+		edits = diffLines(splitLines(before), splitLines(after))
+		b     bytes.Buffer
+	)
+	fmt.Fprintf(&b, "--- %s\n+++ %s\n", name, name)
+	for start := 0; start < len(edits); {
+		for start < len(edits) && edits[start].op == ' ' {
+			start++
+		}
+		if start == len(edits) {
+			break
+		}
+		// Changes no more than twice the context apart share a hunk
+		var last = start
+		for idx := start; idx < len(edits); idx++ {
+			if edits[idx].op != ' ' {
+				last = idx
+			} else if idx-last > 2*DIFF_CONTEXT {
+				break
+			}
+		}
+		var lo, hi = start - DIFF_CONTEXT, last + DIFF_CONTEXT + 1
+		if lo < 0 {
+			lo = 0
+		}
+		if hi > len(edits) {
+			hi = len(edits)
+		}
+		writeHunk(&b, edits[lo:hi])
+		start = hi
+	}
+	return b.String()
+}
+
+// splitLines cuts text into lines, each keeping its newline
+func splitLines(text []byte) []string {
+	var lines = strings.SplitAfter(string(text), "\n")
+	if lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	return lines
+}
+
+// diffLines finds the longest common subsequence of a and b, and reports
+// how to get from a to b around it
+func diffLines(a, b []string) (edits []edit) {
+	var ai, bi int
+	add := func(op byte, line string) {
+		edits = append(edits, edit{op, line, ai, bi})
+		if op != '+' {
+			ai++
+		}
+		if op != '-' {
+			bi++
+		}
+	}
+	var pre, suf = 0, 0
+	for pre < len(a) && pre < len(b) && a[pre] == b[pre] {
+		pre++
+	}
+	for suf < len(a)-pre && suf < len(b)-pre && a[len(a)-1-suf] == b[len(b)-1-suf] {
+		suf++
+	}
+	for _, line := range a[:pre] {
+		add(' ', line)
+	}
+	var (
+		am, bm = a[pre : len(a)-suf], b[pre : len(b)-suf]
+		n, m   = len(am), len(bm)
+	)
+	if n*m > DIFF_MAX_CELLS {
+		for _, line := range am {
+			add('-', line)
+		}
+		for _, line := range bm {
+			add('+', line)
+		}
+	} else {
+		var lcs = make([]int32, (n+1)*(m+1))
+		at := func(i, j int) *int32 { return &lcs[i*(m+1)+j] }
+		for i := n - 1; i >= 0; i-- {
+			for j := m - 1; j >= 0; j-- {
+				if am[i] == bm[j] {
+					*at(i, j) = *at(i+1, j+1) + 1
+				} else if *at(i+1, j) >= *at(i, j+1) {
+					*at(i, j) = *at(i+1, j)
+				} else {
+					*at(i, j) = *at(i, j+1)
+				}
+			}
+		}
+		var i, j = 0, 0
+		for i < n && j < m {
+			switch {
+			case am[i] == bm[j]:
+				add(' ', am[i])
+				i, j = i+1, j+1
+			case *at(i+1, j) >= *at(i, j+1):
+				add('-', am[i])
+				i++
+			default:
+				add('+', bm[j])
+				j++
+			}
+		}
+		for ; i < n; i++ {
+			add('-', am[i])
+		}
+		for ; j < m; j++ {
+			add('+', bm[j])
+		}
+	}
+	for _, line := range a[len(a)-suf:] {
+		add(' ', line)
+	}
+	return
+}
+
+// writeHunk writes edits under their @@ header the way diff -u does
+func writeHunk(b *bytes.Buffer, edits []edit) {
+	var alen, blen int
+	for _, e := range edits {
+		if e.op != '+' {
+			alen++
+		}
+		if e.op != '-' {
+			blen++
+		}
+	}
+	fmt.Fprintf(b, "@@ -%s +%s @@\n", hunkRange(edits[0].ai, alen), hunkRange(edits[0].bi, blen))
+	for _, e := range edits {
+		b.WriteByte(e.op)
+		b.WriteString(e.line)
+		if !strings.HasSuffix(e.line, "\n") {
+			b.WriteString("\n\\ No newline at end of file\n")
+		}
+	}
+}
+
+func hunkRange(before, length int) string {
+	switch length {
+	case 0:
+		return fmt.Sprintf("%d,0", before)
+	case 1:
+		return fmt.Sprintf("%d", before+1)
+	default:
+		return fmt.Sprintf("%d,%d", before+1, length)
+	}
+}
+
+// runStdout runs cmd and returns lines of its standard output alone, so
+// that whatever lands on standard error, e.g. sudo warnings, is not parsed
+func runStdout(ctx context.Context, cmdr Commander, cmd string) (lines []string, err error) {
+	output, err := cmdr.StreamContext(ctx, cmd)
+	if err != nil {
+		return nil, err
+	}
+	for resp := range output {
+		text, rerr := resp.Data()
+		switch resp.Source() {
+		case STDOUT:
+			lines = append(lines, text)
+		case STDERR:
+		default:
+			err = rerr
+		}
+	}
+	return lines, err
+}
+
+// checkFile reports whether remote file dst differs from content, with diff
+// of what putting content there would change
+func checkFile(ctx context.Context, cmdr Commander, dst string, content []byte) (changed bool, diff string, err error) {
+	remote, err := runStdout(ctx, cmdr, fmt.Sprintf("sha256sum %[1]s 2>/dev/null && wc -c < %[1]s || true", Quote(dst)))
+	if err != nil {
+		return false, "", err
+	}
+	if len(remote) < 2 {
+		return true, Diff(dst, nil, content), nil // no such file
+	}
+	sum := sha256.Sum256(content)
+	if fields := strings.Fields(remote[0]); len(fields) > 0 && fields[0] == hex.EncodeToString(sum[:]) {
+		return false, "", nil
+	}
+	if size, _ := strconv.Atoi(strings.TrimSpace(remote[1])); size > DIFF_MAX_SIZE {
+		return true, fmt.Sprintf("Files %s differ\n", dst), nil
+	}
+	var before bytes.Buffer
+	if err = cmdr.Load(dst, &before); err != nil {
+		return true, "", err
+	}
+	return true, Diff(dst, before.Bytes(), content), nil
+}
+
+// checkTree reports whether sending local directory src to remote dst would
+// change any file there, with diff of each
+func checkTree(ctx context.Context, cmdr Commander, src, dst string, follow bool) (changed bool, diff string, err error) {
+	var local = make(map[string]string)
+	err = filepath.Walk(src, func(file string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if follow && info.Mode()&os.ModeSymlink != 0 {
+			if info, err = os.Stat(file); err != nil {
+				return err
+			}
+		}
+		if info.Mode().IsRegular() {
+			rel, _ := filepath.Rel(src, file)
+			local[filepath.ToSlash(rel)] = file
+		}
+		return nil
+	})
+	if err != nil {
+		return false, "", err
+	}
+	output, err := runStdout(ctx, cmdr, "cd "+Quote(dst)+" 2>/dev/null && find . -type f -exec sha256sum {} + 2>/dev/null || true")
+	if err != nil {
+		return false, "", err
+	}
+	var remote = make(map[string]string)
+	for _, line := range output {
+		if fields := strings.SplitN(line, "  ", 2); len(fields) == 2 {
+			remote[strings.TrimPrefix(fields[1], "./")] = fields[0]
+		}
+	}
+	var names = make([]string, 0, len(local))
+	for name := range local {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var b bytes.Buffer
+	for _, name := range names {
+		content, err := readLocal(local[name])
+		if err != nil {
+			return changed, b.String(), err
+		}
+		if sum := sha256.Sum256(content); remote[name] == hex.EncodeToString(sum[:]) {
+			continue
+		}
+		_, fileDiff, err := checkFile(ctx, cmdr, path.Join(dst, name), content)
+		if err != nil {
+			return changed, b.String(), err
+		}
+		changed = true
+		b.WriteString(hideDiff(local[name], path.Join(dst, name), fileDiff))
+	}
+	return changed, b.String(), nil
+}
+
+// Check reports whether sending Archive would change anything on remote
+// host, with diff of the content it would replace
+func (a Archive) Check(ctx context.Context, cmdr Commander) (changed bool, diff string, err error) {
+	if a.Sudo || a.BecomeUser != "" {
+		defer cmdr.SudoAs(a.BecomeUser).StepDown()
+	}
+	a.Src = a.Source(cmdr)
+	dst := path.Join(a.Dir, a.Dest())
+	if info, err := os.Stat(a.Src); err != nil {
+		return false, "", err
+	} else if info.IsDir() {
+		if a.Template {
+			return false, "", ErrTemplateDir
+		}
+		return checkTree(ctx, cmdr, a.Src, dst, a.Follow)
+	}
+	var content []byte
+	if a.Template {
+		content, err = renderFile(a.Src, a.vars)
+	} else {
+		content, err = readLocal(a.Src)
+	}
+	if err != nil {
+		return false, "", err
+	}
+	changed, diff, err = checkFile(ctx, cmdr, dst, content)
+	return changed, hideDiff(a.Src, dst, diff), err
+}
@@ -0,0 +1,163 @@
+package ssh
+
+import (
+	"golang.org/x/net/context"
+
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestDiff(t *testing.T) {
+	before := "a\nb\nc\nd\ne\nf\ng\nh\ni\nj\nk\nl\n"
+	after := "a\nB\nc\nd\ne\nf\ng\nh\ni\nj\nk\nl\nm"
+	want := `--- f
++++ f
+@@ -1,5 +1,5 @@
+ a
+-b
++B
+ c
+ d
+ e
+@@ -10,3 +10,4 @@
+ j
+ k
+ l
++m
+\ No newline at end of file
+`
+	if got := Diff("f", []byte(before), []byte(after)); got != want {
+		t.Errorf("unexpected diff:\n%s", got)
+	}
+	if got := Diff("f", nil, []byte("x\n")); got != "--- f\n+++ f\n@@ -0,0 +1 @@\n+x\n" {
+		t.Errorf("unexpected diff of new file:\n%s", got)
+	}
+	if got := Diff("f", []byte("x\n"), []byte("x\n")); got != "" {
+		t.Errorf("expected no diff, got:\n%s", got)
+	}
+	if got := Diff("f", []byte("\x00"), []byte("x")); got != "Binary files f differ\n" {
+		t.Errorf("unexpected diff of binary file %q", got)
+	}
+}
+
+func TestCheckMode(t *testing.T) {
+	dir, err := ioutil.TempDir("", "check")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	cmdr := NewLocal()
+
+	conf := filepath.Join(dir, "sysctl.conf")
+	ioutil.WriteFile(conf, []byte("vm.swappiness = 60\n"), 0644)
+	reload := false
+	sysctl := Action{Modules: Modules{Sysctl: &SysctlModule{Name: "vm.swappiness", Value: "10", File: conf, Reload: &reload}}}.CheckMode()
+	changed, diff, err := sysctl.Apply(context.Background(), cmdr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !changed || !strings.Contains(diff, "-vm.swappiness = 60\n+vm.swappiness = 10\n") {
+		t.Errorf("unexpected check %v:\n%s", changed, diff)
+	}
+	if data, _ := ioutil.ReadFile(conf); string(data) != "vm.swappiness = 60\n" {
+		t.Errorf("file changed in check mode %q", data)
+	}
+
+	data := filepath.Join(dir, "data")
+	changed, diff, err = Action{Modules: Modules{File: &FileModule{Path: data, State: "directory", Mode: "0700"}}}.CheckMode().Apply(context.Background(), cmdr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !changed || diff != "mkdir -p "+data+"\nchmod 700 "+data+"\n" {
+		t.Errorf("unexpected check %v:\n%s", changed, diff)
+	}
+	if _, err = os.Stat(data); !os.IsNotExist(err) {
+		t.Error("directory created in check mode")
+	}
+
+	dest := filepath.Join(dir, "app.conf")
+	ioutil.WriteFile(dest, []byte("port=80\n"), 0644)
+	changed, diff, err = Action{Modules: Modules{Copy: &CopyModule{Content: "port=8080\n", Dest: dest}}}.CheckMode().Apply(context.Background(), cmdr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !changed || !strings.HasSuffix(diff, "-port=80\n+port=8080\n") {
+		t.Errorf("unexpected check %v:\n%s", changed, diff)
+	}
+}
+
+func TestArchiveCheck(t *testing.T) {
+	dir, err := ioutil.TempDir("", "check")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	cmdr := NewLocal()
+
+	src, dst := filepath.Join(dir, "src"), filepath.Join(dir, "dst")
+	os.MkdirAll(filepath.Join(src, "conf"), 0755)
+	os.MkdirAll(filepath.Join(dst, "conf"), 0755)
+	ioutil.WriteFile(filepath.Join(src, "same"), []byte("same\n"), 0644)
+	ioutil.WriteFile(filepath.Join(dst, "same"), []byte("same\n"), 0644)
+	ioutil.WriteFile(filepath.Join(src, "conf", "app.conf"), []byte("port={{.port}}\n"), 0644)
+	ioutil.WriteFile(filepath.Join(dst, "conf", "app.conf"), []byte("port=80\n"), 0644)
+
+	changed, diff, err := Archive{Src: src, Dst: dst}.Check(context.Background(), cmdr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !changed || !strings.Contains(diff, "+++ "+filepath.Join(dst, "conf", "app.conf")+"\n") || strings.Contains(diff, "same") {
+		t.Errorf("unexpected check %v:\n%s", changed, diff)
+	}
+
+	rendered, err := Archive{Src: filepath.Join(src, "conf", "app.conf"), Dir: filepath.Join(dst, "conf"), Template: true}.render(map[string]interface{}{"port": 80})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if changed, diff, err = rendered.Check(context.Background(), cmdr); err != nil || changed || diff != "" {
+		t.Errorf("expected rendered template to match, got %v %q %v", changed, diff, err)
+	}
+}
+
+func TestArchiveCheckSudoNoise(t *testing.T) {
+	srv, cmdr := newTestCommander(t)
+	defer srv.Close()
+	defer cmdr.Close()
+	srv.SudoNoise = "sudo: unable to resolve host machine-test: Name or service not known"
+
+	dir, err := ioutil.TempDir("", "check")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	src, dst := filepath.Join(dir, "src"), filepath.Join(srv.Dir, "dst")
+	os.MkdirAll(src, 0755)
+	os.MkdirAll(dst, 0755)
+	ioutil.WriteFile(filepath.Join(src, "same"), []byte("same\r\nno newline"), 0644)
+	ioutil.WriteFile(filepath.Join(dst, "same"), []byte("same\r\nno newline"), 0644)
+	ioutil.WriteFile(filepath.Join(src, "app.conf"), []byte("port=8080\n"), 0644)
+	ioutil.WriteFile(filepath.Join(dst, "app.conf"), []byte("port=80\n"), 0644)
+
+	// Noise on stderr is neither taken for checksum nor for content
+	changed, diff, err := Archive{Src: filepath.Join(src, "same"), Dir: dst, Sudo: true}.Check(context.Background(), cmdr)
+	if err != nil || changed || diff != "" {
+		t.Errorf("expected same file unchanged, got %v %q %v", changed, diff, err)
+	}
+	changed, diff, err = Archive{Src: filepath.Join(src, "app.conf"), Dir: dst, Sudo: true}.Check(context.Background(), cmdr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expect := "-port=80\n+port=8080\n"; !changed || !strings.HasSuffix(diff, expect) || strings.Contains(diff, "sudo") {
+		t.Errorf("unexpected check %v:\n%s", changed, diff)
+	}
+	changed, diff, err = Archive{Src: src, Dst: dst, Sudo: true}.Check(context.Background(), cmdr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !changed || strings.Contains(diff, "same") || strings.Contains(diff, "sudo") {
+		t.Errorf("unexpected check %v:\n%s", changed, diff)
+	}
+}
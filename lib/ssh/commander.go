@@ -4,31 +4,171 @@ import (
 	"golang.org/x/crypto/ssh"
 	"golang.org/x/crypto/ssh/agent"
 	"golang.org/x/crypto/ssh/terminal"
+	"golang.org/x/net/context"
 
-	"bufio"
 	"bytes"
 	"fmt"
 	"io"
 	"net"
 	"os"
 	"path/filepath"
+	"strings"
 	"sync"
+	"time"
+)
+
+const (
+	// Interval between keepalive requests on an idle connection
+	KEEPALIVE_INTERVAL = 30 * time.Second
+
+	// Time to wait for keepalive reply before dropping connection
+	KEEPALIVE_TIMEOUT = 15 * time.Second
 )
 
 type SSHCommander struct {
 	ssh_config  *ssh.ClientConfig
 	sshAuthSock net.Conn
 	addr        string
-	sudo        bool
+
+	// Escalation method and state, sudoUser empty means root
+	become   string
+	sudo     bool
+	sudoUser string
+
+	// Host key verification state
+	verifier *hostKeyVerifier
+
+	// Persistent connection shared by all sessions
+	lock   sync.Mutex
+	client *ssh.Client
+
+	// Jump host this Commander dials through
+	jump *SSHCommander
+
+	// Authentication methods offered and identities left out, for reporting
+	authTried   []string
+	authSkipped []string
+
+	// OpenSSH client config that could not be applied, failing dial
+	configErr error
+}
+
+// dial returns the established connection, or make a new one
+func (sshCmd *SSHCommander) dial() (*ssh.Client, error) {
+	sshCmd.lock.Lock()
+	defer sshCmd.lock.Unlock()
+	if sshCmd.client != nil {
+		return sshCmd.client, nil
+	}
+	if sshCmd.configErr != nil {
+		return nil, sshCmd.configErr
+	}
+	var (
+		cli *ssh.Client
+		err error
+	)
+	if sshCmd.jump != nil {
+		cli, err = sshCmd.dialJump()
+	} else {
+		cli, err = ssh.Dial("tcp", sshCmd.addr, sshCmd.ssh_config)
+	}
+	if isAuthFailure(err) || err == ErrNoTTY {
+		return nil, &AuthError{
+			User:    sshCmd.ssh_config.User,
+			Addr:    sshCmd.addr,
+			Tried:   sshCmd.authTried,
+			Skipped: sshCmd.authSkipped,
+			err:     err,
+		}
+	} else if err != nil {
+		return nil, err
+	}
+	sshCmd.client = cli
+	go sshCmd.keepalive(cli)
+	return cli, nil
+}
+
+// dialJump tunnels connection to addr through the jump host
+func (sshCmd *SSHCommander) dialJump() (*ssh.Client, error) {
+	via, err := sshCmd.jump.dial()
+	if err != nil {
+		return nil, err
+	}
+	conn, err := via.Dial("tcp", sshCmd.addr)
+	if err != nil {
+		return nil, err
+	}
+	c, chans, reqs, err := ssh.NewClientConn(conn, sshCmd.addr, sshCmd.ssh_config)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return ssh.NewClient(c, chans, reqs), nil
+}
+
+// drop closes cli and forget it if it is the current connection
+func (sshCmd *SSHCommander) drop(cli *ssh.Client) {
+	sshCmd.lock.Lock()
+	defer sshCmd.lock.Unlock()
+	if sshCmd.client == cli {
+		sshCmd.client = nil
+	}
+	cli.Close()
+}
+
+func (sshCmd *SSHCommander) keepalive(cli *ssh.Client) {
+	var (
+		tick   = time.NewTicker(KEEPALIVE_INTERVAL)
+		closed = make(chan struct{})
+	)
+	defer tick.Stop()
+	go func() {
+		defer close(closed)
+		cli.Wait()
+	}()
+	for {
+		select {
+		case <-closed:
+			sshCmd.drop(cli)
+			return
+		case <-tick.C:
+			var reply = make(chan error, 1)
+			go func() {
+				_, _, err := cli.SendRequest("keepalive@openssh.com", true, nil)
+				reply <- err
+			}()
+			select {
+			case err := <-reply:
+				if err != nil {
+					sshCmd.drop(cli)
+					return
+				}
+			case <-time.After(KEEPALIVE_TIMEOUT):
+				sshCmd.drop(cli)
+				return
+			}
+		}
+	}
 }
 
 func (sshCmd *SSHCommander) connect() (*ssh.Session, error) {
-	cli, err := ssh.Dial("tcp", sshCmd.addr, sshCmd.ssh_config)
+	cli, err := sshCmd.dial()
 	if err != nil {
 		return nil, err
-	} else {
-		return cli.NewSession()
 	}
+	session, err := cli.NewSession()
+	if err == nil {
+		return session, nil
+	}
+	if _, rejected := err.(*ssh.OpenChannelError); rejected {
+		return nil, err // remote refused session, connection is fine
+	}
+	// Transport is broken, reconnect once
+	sshCmd.drop(cli)
+	if cli, err = sshCmd.dial(); err != nil {
+		return nil, err
+	}
+	return cli.NewSession()
 }
 
 func (sshCmd *SSHCommander) Host() (host, port string) {
@@ -36,13 +176,23 @@ func (sshCmd *SSHCommander) Host() (host, port string) {
 	return
 }
 
+func (sshCmd *SSHCommander) HostKey() string {
+	return sshCmd.verifier.verified
+}
+
 func (sshCmd *SSHCommander) Sudo() SudoSession {
+	return sshCmd.SudoAs("")
+}
+
+func (sshCmd *SSHCommander) SudoAs(user string) SudoSession {
 	sshCmd.sudo = true
+	sshCmd.sudoUser = user
 	return sshCmd
 }
 
 func (sshCmd *SSHCommander) StepDown() {
 	sshCmd.sudo = false
+	sshCmd.sudoUser = ""
 }
 
 func (sshCmd *SSHCommander) Load(target string, here io.Writer) error {
@@ -50,18 +200,8 @@ func (sshCmd *SSHCommander) Load(target string, here io.Writer) error {
 	if err != nil {
 		return err
 	}
-	r, _ := session.StdoutPipe()
-	var ret = make(chan error)
-	go func() {
-		defer session.Close()
-		var cmd = fmt.Sprint("cat ", target)
-		if sshCmd.sudo {
-			cmd = fmt.Sprintf("sudo -s %s", cmd)
-		}
-		ret <- session.Run(cmd)
-	}()
-	io.Copy(here, r)
-	return <-ret
+	defer session.Close()
+	return sshCmd.run(session, "cat "+Quote(target), nil, here, nil)
 }
 
 func (sshCmd *SSHCommander) LoadFile(target, here string, mode os.FileMode) error {
@@ -80,6 +220,10 @@ func (sshCmd *SSHCommander) LoadFile(target, here string, mode os.FileMode) erro
 }
 
 func (sshCmd *SSHCommander) Copy(src io.Reader, size int64, dst string, mode os.FileMode) error {
+	return sshCmd.CopyContext(context.Background(), src, size, dst, mode)
+}
+
+func (sshCmd *SSHCommander) CopyContext(ctx context.Context, src io.Reader, size int64, dst string, mode os.FileMode) error {
 	session, err := sshCmd.connect()
 	if err != nil {
 		return err
@@ -96,21 +240,20 @@ func (sshCmd *SSHCommander) Copy(src io.Reader, size int64, dst string, mode os.
 		return err
 	}
 
-	w, _ := session.StdinPipe()
-	go func() {
-		defer w.Close()
-		// stream file content
-		fmt.Fprintln(w, perm, size, filepath.Base(dst))
-		io.Copy(w, src)
-		fmt.Fprint(w, "\x00")
-	}()
+	// stream file content
+	stdin := io.MultiReader(
+		strings.NewReader(fmt.Sprintln(perm, size, filepath.Base(dst))),
+		src,
+		strings.NewReader("\x00"),
+	)
 
 	// initiate scp on remote
-	var cmd = fmt.Sprint("scp -t ", dst)
-	if sshCmd.sudo {
-		cmd = fmt.Sprintf("sudo -s %s", cmd)
+	stop := cancelOnDone(ctx, session)
+	err = sshCmd.run(session, "scp -t "+Quote(dst), stdin, nil, nil)
+	if cerr := stop(); cerr != nil {
+		err = cerr
 	}
-	return session.Run(cmd)
+	return err
 }
 
 func (sshCmd *SSHCommander) CopyFile(src, dst string, mode os.FileMode) error {
@@ -126,6 +269,63 @@ func (sshCmd *SSHCommander) CopyFile(src, dst string, mode os.FileMode) error {
 	return sshCmd.Copy(file, info.Size(), dst, mode)
 }
 
+func (sshCmd *SSHCommander) sftp() (*sftpClient, error) {
+	session, err := sshCmd.connect()
+	if err != nil {
+		return nil, err
+	}
+	var (
+		stdin  io.WriteCloser
+		stdout io.Reader
+	)
+	if sshCmd.sudo {
+		// Subsystem cannot be elevated, run sftp-server through escalation
+		inR, inW := io.Pipe()
+		outR, outW := io.Pipe()
+		wait, err := sshCmd.start(session, SFTP_SERVER_CMD, inR, outW, nil)
+		if err != nil {
+			session.Close()
+			return nil, err
+		}
+		go func() { outW.CloseWithError(wait()) }()
+		stdin, stdout = inW, outR
+	} else {
+		if stdin, err = session.StdinPipe(); err == nil {
+			if stdout, err = session.StdoutPipe(); err == nil {
+				err = session.RequestSubsystem("sftp")
+			}
+		}
+		if err != nil {
+			session.Close()
+			return nil, err
+		}
+	}
+	client, err := newSFTPClient(session, stdin, stdout)
+	if err != nil {
+		session.Close()
+		return nil, err
+	}
+	return client, nil
+}
+
+func (sshCmd *SSHCommander) Upload(src, dst string, opts TransferOptions) error {
+	client, err := sshCmd.sftp()
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+	return client.upload(src, dst, opts)
+}
+
+func (sshCmd *SSHCommander) Download(src, dst string, opts TransferOptions) error {
+	client, err := sshCmd.sftp()
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+	return client.download(src, dst, opts)
+}
+
 func (sshCmd *SSHCommander) Mkdir(path string) error {
 	session, err := sshCmd.connect()
 	if err != nil {
@@ -133,11 +333,7 @@ func (sshCmd *SSHCommander) Mkdir(path string) error {
 	}
 	defer session.Close()
 	// initiate mkdir on remote
-	var cmd = fmt.Sprint("mkdir -p ", path)
-	if sshCmd.sudo {
-		cmd = fmt.Sprintf("sudo -s %s", cmd)
-	}
-	return session.Run(cmd)
+	return sshCmd.run(session, "mkdir -p "+Quote(path), nil, nil, nil)
 }
 
 // buffer is a utility object for combined output
@@ -153,18 +349,21 @@ func (b *buffer) Write(p []byte) (int, error) {
 }
 
 func (sshCmd *SSHCommander) Run(cmd string) (output string, err error) {
+	return sshCmd.RunContext(context.Background(), cmd)
+}
+
+func (sshCmd *SSHCommander) RunContext(ctx context.Context, cmd string) (output string, err error) {
 	session, err := sshCmd.connect()
 	if err != nil {
 		return
 	}
 	defer session.Close()
 	var b buffer
-	session.Stdout = &b
-	session.Stderr = &b
-	if sshCmd.sudo {
-		cmd = fmt.Sprintf("sudo -s %s", cmd)
+	stop := cancelOnDone(ctx, session)
+	err = sshCmd.run(session, cmd, nil, &b, &b)
+	if cerr := stop(); cerr != nil {
+		err = cerr
 	}
-	err = session.Run(cmd)
 	output = b.buf.String()
 	return
 }
@@ -174,17 +373,16 @@ func (sshCmd *SSHCommander) RunQuiet(cmd string) (err error) {
 	if err != nil {
 		return
 	}
-	session.Stdout = nil
-	session.Stderr = nil
 	defer session.Close()
-	if sshCmd.sudo {
-		cmd = fmt.Sprintf("sudo -s %s", cmd)
-	}
-	err = session.Run(cmd)
+	err = sshCmd.run(session, cmd, nil, nil, nil)
 	return
 }
 
 func (sshCmd *SSHCommander) Shell() (err error) {
+	return sshCmd.ShellContext(context.Background())
+}
+
+func (sshCmd *SSHCommander) ShellContext(ctx context.Context) (err error) {
 	var (
 		termWidth, termHeight int
 	)
@@ -229,85 +427,137 @@ func (sshCmd *SSHCommander) Shell() (err error) {
 		return
 	}
 
+	stop := cancelOnDone(ctx, session)
 	session.Wait()
-	return nil
+	return stop()
 }
 
 func (sshCmd *SSHCommander) Stream(cmd string) (<-chan Response, error) {
+	return sshCmd.StreamContext(context.Background(), cmd)
+}
+
+func (sshCmd *SSHCommander) StreamContext(ctx context.Context, cmd string) (<-chan Response, error) {
 	session, err := sshCmd.connect()
 	if err != nil {
 		return nil, err
 	}
-	stdout, _ := session.StdoutPipe()
-	stderr, _ := session.StderrPipe()
-	output := make(chan Response)
+	stdout, stdoutW := io.Pipe()
+	stderr, stderrW := io.Pipe()
+	wait, err := sshCmd.start(session, cmd, nil, stdoutW, stderrW)
+	if err != nil {
+		session.Close()
+		return nil, err
+	}
+	var (
+		output = make(chan Response)
+		result = make(chan error, 1)
+	)
+	stop := cancelOnDone(ctx, session)
+	go func() {
+		result <- wait()
+		stdoutW.Close()
+		stderrW.Close()
+	}()
 	go func() {
-		var reader = func(r io.Reader) <-chan string {
-			var ch = make(chan string)
-			go func() {
-				defer close(ch)
-				lnr := bufio.NewScanner(r)
-				for lnr.Scan() {
-					ch <- lnr.Text()
-				}
-			}()
-			return ch
-		}
-		var ln string
 		defer session.Close()
 		defer close(output)
-		stdOut, stdErr := reader(stdout), reader(stderr)
-		for outOk, errOk := true, true; outOk || errOk; {
-			select {
-			case ln, outOk = <-stdOut:
-				if outOk {
-					output <- Response{text: ln}
-				}
-			case ln, errOk = <-stdErr:
-				if errOk {
-					output <- Response{text: ln}
-				}
-			}
+		relayLines(stdout, stderr, output)
+		err := <-result
+		if cerr := stop(); cerr != nil {
+			output <- Response{err: cerr}
+		} else {
+			output <- exitResponse(err)
 		}
-		output <- Response{err: session.Wait()}
 	}()
-	if sshCmd.sudo {
-		cmd = fmt.Sprintf("sudo -s %s", cmd)
-	}
-	if err := session.Start(cmd); err != nil {
-		return nil, err
-	} else {
-		return output, nil
-	}
+	return output, nil
 }
 
-func (sshCmd *SSHCommander) Close() error {
+func (sshCmd *SSHCommander) Close() (err error) {
+	sshCmd.lock.Lock()
+	defer sshCmd.lock.Unlock()
+	if sshCmd.client != nil {
+		err = sshCmd.client.Close()
+		sshCmd.client = nil
+	}
 	if sshCmd.sshAuthSock != nil {
-		return sshCmd.sshAuthSock.Close()
-	} else {
-		return nil
+		if e := sshCmd.sshAuthSock.Close(); err == nil {
+			err = e
+		}
+		sshCmd.sshAuthSock = nil
 	}
+	if sshCmd.jump != nil {
+		sshCmd.jump.Close()
+	}
+	return
 }
 
 func New(cfg Config) Commander {
+	return newSSHCommander(cfg)
+}
+
+func newSSHCommander(cfg Config) *SSHCommander {
 	var (
 		auths = []ssh.AuthMethod{}
 
+		tried, skipped []string
+
+		signers  []ssh.Signer
+		keyfiles []string
+
 		sshAuthSock net.Conn
+
+		verifier *hostKeyVerifier
 	)
+	if cfg = cfg.resolve(); cfg.Port == "" {
+		cfg.Port = "22"
+	}
+	verifier = newHostKeyVerifier(cfg)
 	if cfg.Password != "" {
 		auths = append(auths, ssh.Password(cfg.Password))
+		tried = append(tried, "password")
 	}
-	if pubkey, err := cfg.GetKeyFile(); err == nil {
-		auths = append(auths, ssh.PublicKeys(pubkey))
+	for _, keyfile := range cfg.identityFiles() {
+		signer, err := loadKeyFile(keyfile)
+		if os.IsNotExist(err) {
+			skipped = append(skipped, fmt.Sprintf("%s (not found)", keyfile))
+		} else if err != nil {
+			skipped = append(skipped, fmt.Sprintf("%s (%v)", keyfile, err))
+		} else {
+			if cert, ok := certSigner(keyfile, signer); ok {
+				signers = append(signers, cert)
+				keyfiles = append(keyfiles, keyfile+"-cert.pub")
+			}
+			signers = append(signers, signer)
+			keyfiles = append(keyfiles, keyfile)
+		}
+	}
+	if len(signers) > 0 {
+		auths = append(auths, ssh.PublicKeys(signers...))
+		tried = append(tried, fmt.Sprintf("publickey (%s)", strings.Join(keyfiles, ", ")))
 	}
 	if conn, err := net.Dial("unix", os.Getenv("SSH_AUTH_SOCK")); err == nil {
 		auths = append(auths, ssh.PublicKeysCallback(agent.NewClient(conn).Signers))
+		tried = append(tried, "publickey (ssh-agent)")
 		sshAuthSock = conn
 	}
-	return &SSHCommander{
-		ssh_config:  &ssh.ClientConfig{User: cfg.User, Auth: auths},
+	auths = append(auths, ssh.KeyboardInteractive(keyboardInteractive(cfg.Password)))
+	tried = append(tried, "keyboard-interactive")
+	sshCmd := &SSHCommander{
+		ssh_config: &ssh.ClientConfig{
+			User:            cfg.User,
+			Auth:            auths,
+			HostKeyCallback: verifier.check,
+		},
 		sshAuthSock: sshAuthSock,
-		addr:        cfg.Server + ":" + cfg.Port,
+		addr:        net.JoinHostPort(cfg.Server, cfg.Port),
+		become:      cfg.Become,
+		verifier:    verifier,
+		authTried:   tried,
+		authSkipped: skipped,
+		configErr:   cfg.resolveErr,
 	}
+	if n := len(cfg.Jump); n > 0 {
+		sshCmd.jump = newSSHCommander(cfg.hop(n - 1))
+	}
+	return sshCmd
 }
@@ -0,0 +1,278 @@
+package ssh
+
+import (
+	"github.com/poddworks/machine/lib/ssh/sshtest"
+
+	"golang.org/x/net/context"
+
+	"bytes"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func init() {
+	// Keep user's OpenSSH client config out of the way
+	UserConfigFile = os.DevNull
+}
+
+func newTestCommander(t *testing.T) (*sshtest.Server, *SSHCommander) {
+	srv, err := sshtest.NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	host, port := srv.Host()
+	cmdr := newSSHCommander(Config{
+		User:     srv.User,
+		Password: srv.Password,
+		Server:   host,
+		Port:     port,
+		HostKey:  Fingerprint(srv.HostKey),
+	})
+	return srv, cmdr
+}
+
+// collect drains output, returning lines from each stream and the terminal
+// response
+func collect(output <-chan Response) (stdout, stderr []string, last Response) {
+	for resp := range output {
+		switch resp.Source() {
+		case STDOUT:
+			stdout = append(stdout, resp.text)
+		case STDERR:
+			stderr = append(stderr, resp.text)
+		default:
+			last = resp
+		}
+	}
+	return
+}
+
+func TestCopy(t *testing.T) {
+	srv, cmdr := newTestCommander(t)
+	defer srv.Close()
+	defer cmdr.Close()
+
+	dst := filepath.Join(srv.Dir, "nested", "dir", "hello.txt")
+	content := "hello world\n"
+	if err := cmdr.Copy(strings.NewReader(content), int64(len(content)), dst, 0600); err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadFile(dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != content {
+		t.Errorf("expected %q, got %q", content, data)
+	}
+	if info, _ := os.Stat(dst); info.Mode().Perm() != 0600 {
+		t.Errorf("expected mode 0600, got %v", info.Mode().Perm())
+	}
+	if err := cmdr.Copy(strings.NewReader(""), 0, dst, os.ModeDir|0755); err != ErrCopyNotRegular {
+		t.Errorf("expected ErrCopyNotRegular, got %v", err)
+	}
+}
+
+func TestStream(t *testing.T) {
+	srv, cmdr := newTestCommander(t)
+	defer srv.Close()
+	defer cmdr.Close()
+
+	output, err := cmdr.Stream("echo one; echo two >&2; echo three; exit 3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout, stderr, last := collect(output)
+	if strings.Join(stdout, ",") != "one,three" {
+		t.Errorf("unexpected stdout %q", stdout)
+	}
+	if strings.Join(stderr, ",") != "two" {
+		t.Errorf("unexpected stderr %q", stderr)
+	}
+	status, ok := last.Exit()
+	if !ok || status.Code != 3 {
+		t.Errorf("expected exit status 3, got %+v (%v)", status, ok)
+	}
+	if _, err = last.Data(); err == nil {
+		t.Error("expected error for non zero exit")
+	}
+
+	output, err = cmdr.Stream("kill -TERM $$")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _, last = collect(output)
+	if status, ok = last.Exit(); !ok || status.Signal != "TERM" {
+		t.Errorf("expected exit signal TERM, got %+v (%v)", status, ok)
+	}
+}
+
+func TestStreamContext(t *testing.T) {
+	srv, cmdr := newTestCommander(t)
+	defer srv.Close()
+	defer cmdr.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	output, err := cmdr.StreamContext(ctx, "sleep 10")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _, last := collect(output)
+	if _, err = last.Data(); err != context.DeadlineExceeded {
+		t.Errorf("expected deadline exceeded, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("command was not cancelled, took %v", elapsed)
+	}
+}
+
+func TestLoad(t *testing.T) {
+	srv, cmdr := newTestCommander(t)
+	defer srv.Close()
+	defer cmdr.Close()
+
+	target := filepath.Join(srv.Dir, "remote.txt")
+	if err := ioutil.WriteFile(target, []byte("remote content"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	buf := new(bytes.Buffer)
+	if err := cmdr.Load(target, buf); err != nil {
+		t.Fatal(err)
+	}
+	if buf.String() != "remote content" {
+		t.Errorf("unexpected content %q", buf.String())
+	}
+	if err := cmdr.Load(filepath.Join(srv.Dir, "missing"), buf); err == nil {
+		t.Error("expected error loading missing file")
+	}
+}
+
+func TestSudo(t *testing.T) {
+	srv, cmdr := newTestCommander(t)
+	defer srv.Close()
+	defer cmdr.Close()
+
+	session := cmdr.Sudo()
+	if _, err := cmdr.Run("true"); err != nil {
+		t.Fatal(err)
+	}
+	session.StepDown()
+	if _, err := cmdr.Run("true"); err != nil {
+		t.Fatal(err)
+	}
+	commands := srv.Commands()
+	if len(commands) != 2 || commands[0] != becomeCommand(BecomeSudo, "", "true") || commands[1] != "true" {
+		t.Errorf("unexpected commands %q", commands)
+	}
+
+	defer cmdr.SudoAs("deploy").StepDown()
+	output, err := cmdr.Run(`echo "$SUDO_TEST_USER" 'it'"'"'s'`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if output != "deploy it's\n" {
+		t.Errorf("unexpected output as deploy %q", output)
+	}
+
+	// Elevated commands run in login user's shell, not /bin/sh
+	bash, err := exec.LookPath("bash")
+	if err != nil {
+		t.Skip("bash not available")
+	}
+	defer os.Setenv("SHELL", os.Getenv("SHELL"))
+	os.Setenv("SHELL", bash)
+	if output, err = cmdr.Run(`[[ "$SUDO_TEST_USER" == dep* ]] && echo bash`); err != nil {
+		t.Fatal(err)
+	} else if output != "bash\n" {
+		t.Errorf("unexpected output from bash %q", output)
+	}
+}
+
+func TestSudoPassword(t *testing.T) {
+	srv, cmdr := newTestCommander(t)
+	defer srv.Close()
+	defer cmdr.Close()
+	srv.SudoPassword = "sesame"
+
+	var asked int
+	defer func(prompt func(string, bool) (string, error)) { Prompt = prompt }(Prompt)
+	Prompt = func(question string, echo bool) (string, error) {
+		asked++
+		return "sesame", nil
+	}
+	defer cmdr.Sudo().StepDown()
+
+	// Password goes in ahead of content sent on stdin
+	content := "elevated content\n"
+	dst := filepath.Join(srv.Dir, "elevated.txt")
+	if err := cmdr.Copy(strings.NewReader(content), int64(len(content)), dst, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := ioutil.ReadFile(dst); string(data) != content {
+		t.Errorf("unexpected content %q", data)
+	}
+	_, stderr, last := collect(mustStream(t, cmdr, "echo out; echo err >&2"))
+	if strings.Join(stderr, ",") != "err" {
+		t.Errorf("expected prompt and marker hidden from stderr, got %q", stderr)
+	}
+	if _, ok := last.Exit(); !ok {
+		t.Errorf("unexpected terminal response %v", last.err)
+	}
+	if asked != 1 {
+		t.Errorf("expected password asked once, asked %d times", asked)
+	}
+
+	Prompt = func(question string, echo bool) (string, error) {
+		return "wrong", nil
+	}
+	forgetBecomePassword(cmdr.ssh_config.User + "@" + cmdr.addr)
+	if _, err := cmdr.Run("true"); err != ErrBecomePassword {
+		t.Errorf("expected ErrBecomePassword, got %v", err)
+	}
+}
+
+func mustStream(t *testing.T, cmdr Commander, cmd string) <-chan Response {
+	output, err := cmdr.Stream(cmd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return output
+}
+
+func TestUpload(t *testing.T) {
+	srv, cmdr := newTestCommander(t)
+	defer srv.Close()
+	defer cmdr.Close()
+
+	src, err := ioutil.TempDir("", "upload")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(src)
+	os.MkdirAll(filepath.Join(src, "sub"), 0750)
+	ioutil.WriteFile(filepath.Join(src, "sub", "file"), []byte("content"), 0640)
+	os.Symlink("sub/file", filepath.Join(src, "link"))
+	mtime := time.Unix(1000000000, 0)
+	os.Chtimes(filepath.Join(src, "sub", "file"), mtime, mtime)
+
+	dst := filepath.Join(srv.Dir, "tree")
+	if err = cmdr.Upload(src, dst, TransferOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(filepath.Join(dst, "sub", "file"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0640 || !info.ModTime().Equal(mtime) {
+		t.Errorf("attributes not preserved, got %v %v", info.Mode(), info.ModTime())
+	}
+	if target, _ := os.Readlink(filepath.Join(dst, "link")); target != "sub/file" {
+		t.Errorf("expected symlink to sub/file, got %q", target)
+	}
+}
@@ -1,24 +1,161 @@
 package ssh
 
 import (
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/net/context"
+
+	"bufio"
 	"errors"
 	"fmt"
+	"io"
 	"os"
+	"strings"
 )
 
 var (
 	ErrCopyNotRegular = errors.New("Can only copy regular file")
+	ErrTemplateDir    = errors.New("Can only render regular file as template")
+
+	ErrHostKeyMismatch = errors.New("Host key does not match recorded key")
+	ErrHostKeyRevoked  = errors.New("Host key has been revoked")
+	ErrHostKeyUnknown  = errors.New("Host key is not known")
+	ErrNotHostCert     = errors.New("Certificate presented by host is not a host certificate")
+
+	ErrBadProxyJump = errors.New("Jump host must be in the form [user@]host[:port]")
+	ErrBadForward   = errors.New("Forward must be in the form [bind_address:]port:host:hostport or use unix socket")
+
+	ErrMatchCriteria = errors.New("Malformed Match criteria in OpenSSH client config")
+	ErrIncludeDepth  = errors.New("Too many nested Include in OpenSSH client config")
+
+	ErrKeyFormat     = errors.New("Unsupported private key format")
+	ErrKeyPassphrase = errors.New("Incorrect passphrase for private key")
+	ErrNoTTY         = errors.New("No terminal available to prompt")
+
+	ErrBecomePassword = errors.New("Incorrect password for privilege escalation")
+	ErrLocalBecome    = errors.New("Only sudo can escalate privilege on local host")
+
+	ErrNoModule  = errors.New("Action runs no module")
+	ErrNoHandler = errors.New("No such handler")
+
+	ErrIncludeLoop  = errors.New("Playbook includes itself")
+	ErrRoleNotFound = errors.New("Role not found")
+	ErrRoleNoName   = errors.New("Role given without name")
+)
+
+const (
+	// Response carries a line from remote standard output
+	STDOUT = iota + 1
+
+	// Response carries a line from remote standard error
+	STDERR
 )
 
+type ExitStatus struct {
+	Code   int
+	Signal string
+}
+
 type Response struct {
-	text string
-	err  error
+	text   string
+	source int
+	status *ExitStatus
+	err    error
 }
 
 func (r Response) Data() (string, error) {
 	return r.text, r.err
 }
 
+// Source reports the stream a line came from, STDOUT or STDERR; zero for the
+// terminal response
+func (r Response) Source() int {
+	return r.source
+}
+
+// Exit reports remote exit status delivered with the terminal response.  ok
+// is false for lines of output or when the command did not exit cleanly,
+// e.g. lost connection.
+func (r Response) Exit() (status ExitStatus, ok bool) {
+	if r.status == nil {
+		return ExitStatus{}, false
+	}
+	return *r.status, true
+}
+
+// exitResponse builds the terminal response out of session.Wait() result
+func exitResponse(err error) Response {
+	switch e := err.(type) {
+	case nil:
+		return Response{status: &ExitStatus{}}
+	case *ssh.ExitError:
+		return Response{status: &ExitStatus{Code: e.ExitStatus(), Signal: e.Signal()}, err: err}
+	default:
+		return Response{err: err}
+	}
+}
+
+// abortOnDone calls abort when ctx is done before stop is called.  stop
+// reports ctx.Err() so callers can tell cancellation apart from command
+// failure.
+func abortOnDone(ctx context.Context, abort func()) (stop func() error) {
+	var done = make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			abort()
+		case <-done:
+		}
+	}()
+	return func() error {
+		close(done)
+		return ctx.Err()
+	}
+}
+
+// cancelOnDone tears down session when ctx is done, asking remote process to
+// terminate first
+func cancelOnDone(ctx context.Context, session *ssh.Session) (stop func() error) {
+	return abortOnDone(ctx, func() {
+		session.Signal(ssh.SIGTERM)
+		session.Close()
+	})
+}
+
+// relayLines delivers stdout and stderr line by line into output until both
+// are exhausted
+func relayLines(stdout, stderr io.Reader, output chan<- Response) {
+	var reader = func(r io.Reader) <-chan string {
+		var ch = make(chan string)
+		go func() {
+			defer close(ch)
+			lnr := bufio.NewScanner(r)
+			for lnr.Scan() {
+				ch <- lnr.Text()
+			}
+		}()
+		return ch
+	}
+	var ln string
+	stdOut, stdErr := reader(stdout), reader(stderr)
+	for outOk, errOk := true, true; outOk || errOk; {
+		select {
+		case ln, outOk = <-stdOut:
+			if outOk {
+				output <- Response{text: ln, source: STDOUT}
+			}
+		case ln, errOk = <-stdErr:
+			if errOk {
+				output <- Response{text: ln, source: STDERR}
+			}
+		}
+	}
+}
+
+// Quote protects s from interpretation by POSIX shell
+func Quote(s string) string {
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
+
 func getFileMode(m os.FileMode) (string, error) {
 	if !m.IsRegular() {
 		return "", ErrCopyNotRegular
@@ -26,3 +163,28 @@ func getFileMode(m os.FileMode) (string, error) {
 	perm := m.Perm() // retrieve permission
 	return fmt.Sprintf("C0%d%d%d", perm&0700>>6, perm&0070>>3, perm&0007), nil
 }
+
+// matchPattern reports whether s matches pattern with '*' and '?' wildcard
+func matchPattern(pattern, s string) bool {
+	for len(pattern) > 0 {
+		switch pattern[0] {
+		case '*':
+			for i := len(s); i >= 0; i-- {
+				if matchPattern(pattern[1:], s[i:]) {
+					return true
+				}
+			}
+			return false
+		case '?':
+			if len(s) == 0 {
+				return false
+			}
+		default:
+			if len(s) == 0 || pattern[0] != s[0] {
+				return false
+			}
+		}
+		pattern, s = pattern[1:], s[1:]
+	}
+	return len(s) == 0
+}
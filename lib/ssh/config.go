@@ -3,9 +3,7 @@ package ssh
 import (
 	"golang.org/x/crypto/ssh"
 
-	"io/ioutil"
-	"os"
-	"path/filepath"
+	"net"
 	"strings"
 )
 
@@ -15,21 +13,120 @@ type Config struct {
 	Key      string
 	Port     string
 	Password string
+
+	// Private keys to try after Key, in order
+	Identities []string
+
+	// Host key verification mode, defaults to HostKeyAcceptNew
+	HostKeyMode string
+
+	// Fingerprint previously recorded for Server
+	HostKey string
+
+	// Machine managed known_hosts file, consulted after ~/.ssh/known_hosts
+	KnownHosts string
+
+	// SSH CA public keys trusted to sign host certificates, in
+	// authorized_keys format
+	HostCAFile string
+
+	// Jump hosts to dial through, in order, before reaching Server
+	Jump []Hop
+
+	// Escalation method under Sudo, defaults to BecomeSudo
+	Become string
+
+	// Mark that OpenSSH client config was applied, and why it could not be
+	resolved   bool
+	resolveErr error
 }
 
-func (cfg Config) GetKeyFile() (ssh.Signer, error) {
-	keyfile := strings.Replace(cfg.Key, "~", os.Getenv("HOME"), 1)
-	keyfile, err := filepath.Abs(keyfile)
-	if err != nil {
-		return nil, err
+// Hop describes one jump host in a ProxyJump style chain
+type Hop struct {
+	User    string `json:"user,omitempty"`
+	Server  string `json:"server"`
+	Port    string `json:"port,omitempty"`
+	Key     string `json:"key,omitempty"`
+	HostKey string `json:"host_key,omitempty"`
+}
+
+func (h Hop) String() string {
+	var addr = h.Server
+	if h.Port != "" {
+		addr = net.JoinHostPort(h.Server, h.Port)
 	}
-	buf, err := ioutil.ReadFile(keyfile)
-	if err != nil {
-		return nil, err
+	if h.User != "" {
+		addr = h.User + "@" + addr
 	}
-	pubkey, err := ssh.ParsePrivateKey(buf)
-	if err != nil {
-		return nil, err
+	return addr
+}
+
+// ParseProxyJump parses jump host chain in the form [user@]host[:port][,...]
+func ParseProxyJump(spec string) (hops []Hop, err error) {
+	for _, part := range strings.Split(spec, ",") {
+		var hop Hop
+		if part = strings.TrimSpace(part); part == "" {
+			continue
+		}
+		if at := strings.LastIndex(part, "@"); at >= 0 {
+			hop.User, part = part[:at], part[at+1:]
+		}
+		if host, port, e := net.SplitHostPort(part); e == nil {
+			hop.Server, hop.Port = host, port
+		} else {
+			hop.Server = part
+		}
+		if hop.Server == "" {
+			return nil, ErrBadProxyJump
+		}
+		hops = append(hops, hop)
+	}
+	return
+}
+
+// hop derives Config for the idx-th jump host, reached through the hops
+// before it.  User and Key not found in OpenSSH client config for the jump
+// host default to those of cfg.
+func (cfg Config) hop(idx int) Config {
+	var h = cfg.Jump[idx]
+	hopCfg := Config{
+		User:        h.User,
+		Server:      h.Server,
+		Key:         h.Key,
+		Port:        h.Port,
+		HostKeyMode: cfg.HostKeyMode,
+		HostKey:     h.HostKey,
+		KnownHosts:  cfg.KnownHosts,
+		HostCAFile:  cfg.HostCAFile,
+		Jump:        cfg.Jump[:idx],
+	}
+	hopCfg = hopCfg.resolve()
+	// Chain is given by cfg, ignore ProxyJump configured for the jump host
+	hopCfg.Jump = cfg.Jump[:idx]
+	if hopCfg.User == "" {
+		hopCfg.User = cfg.User
+	}
+	if hopCfg.Key == "" {
+		hopCfg.Key = cfg.Key
+	}
+	if len(hopCfg.Identities) == 0 {
+		hopCfg.Identities = cfg.Identities
+	}
+	return hopCfg
+}
+
+func (cfg Config) GetKeyFile() (ssh.Signer, error) {
+	return loadKeyFile(cfg.Key)
+}
+
+// identityFiles reports Key followed by Identities, without duplicates
+func (cfg Config) identityFiles() (files []string) {
+	var seen = make(map[string]bool)
+	for _, keyfile := range append([]string{cfg.Key}, cfg.Identities...) {
+		if keyfile != "" && !seen[keyfile] {
+			seen[keyfile] = true
+			files = append(files, keyfile)
+		}
 	}
-	return pubkey, nil
+	return
 }
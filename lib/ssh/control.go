@@ -0,0 +1,288 @@
+package ssh
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// Retries when Until is given without retries
+	DEFAULT_RETRIES = 3
+
+	// Pause between runs of a retried action
+	DEFAULT_RETRY_DELAY = 5 * time.Second
+)
+
+var (
+	ErrUntilNotMet = errors.New("Condition not met after retries")
+	ErrBadSerial   = errors.New("Serial must be a count or percentage of hosts")
+)
+
+// Eval reports whether expr is true against vars.  expr is a text/template
+// pipeline such as `eq .role "manager"`, or a full template whose output
+// other than "", "false", "0" or "<no value>" counts as true.  Empty expr is
+// always true.
+func Eval(expr string, vars map[string]interface{}) (bool, error) {
+	if expr = strings.TrimSpace(expr); expr == "" {
+		return true, nil
+	}
+	var text = expr
+	if !strings.Contains(expr, "{{") {
+		text = "{{if " + expr + "}}true{{end}}"
+	}
+	out, err := render("when", text, vars)
+	if err != nil {
+		return false, err
+	}
+	switch strings.TrimSpace(out) {
+	case "", "false", "0", "<no value>":
+		return false, nil
+	default:
+		return true, nil
+	}
+}
+
+// Applies reports whether to go through this Provision
+func (p Provision) Applies(vars map[string]interface{}) (bool, error) {
+	for _, expr := range p.conditions {
+		if ok, err := Eval(expr, vars); err != nil || !ok {
+			return false, err
+		}
+	}
+	return Eval(p.When, vars)
+}
+
+// Variables of this section: Vars over vars of the host, or vars itself when
+// there are none.  nil when vars is nil, i.e. Recipe was not rendered.
+func (p Provision) Variables(vars map[string]interface{}) map[string]interface{} {
+	if vars == nil || len(p.Vars) == 0 {
+		return vars
+	}
+	var scope = make(map[string]interface{}, len(vars)+len(p.Vars))
+	for k, v := range vars {
+		scope[k] = v
+	}
+	for k, v := range p.Vars {
+		scope[k] = v
+	}
+	return scope
+}
+
+// Expand makes the steps to run this Action: one per item of Loop or
+// WithItems, each with the item bound to .item, or else just one.  cmd,
+// script and module settings of each step are expanded as text/template.
+// Action of a Recipe that was not rendered is run as is.
+func (a Action) Expand(vars map[string]interface{}) ([]Action, error) {
+	if vars == nil {
+		return []Action{a}, nil
+	}
+	var items = append(append([]interface{}{}, a.Loop...), a.WithItems...)
+	if len(items) == 0 {
+		step, err := a.render(vars)
+		if err != nil {
+			return nil, err
+		}
+		return []Action{step}, nil
+	}
+	var steps = make([]Action, 0, len(items))
+	for _, item := range items {
+		itemVars := make(map[string]interface{}, len(vars)+1)
+		for k, v := range vars {
+			itemVars[k] = v
+		}
+		itemVars["item"] = item
+		step, err := a.render(itemVars)
+		if err != nil {
+			return nil, err
+		}
+		steps = append(steps, step)
+	}
+	return steps, nil
+}
+
+// Applies reports whether to run this step, see Expand
+func (a Action) Applies() (bool, error) {
+	return Eval(a.When, a.vars)
+}
+
+// RetryPolicy reports how many more times to run this Action after the first
+// and how long to pause in between
+func (a Action) RetryPolicy() (retries int, delay time.Duration, err error) {
+	retries = a.Retries
+	if retries == 0 && a.Until != "" {
+		retries = DEFAULT_RETRIES
+	}
+	delay = DEFAULT_RETRY_DELAY
+	if a.Delay != "" {
+		if delay, err = time.ParseDuration(a.Delay); err != nil {
+			return 0, 0, err
+		}
+	}
+	return
+}
+
+// Done reports whether this step needs no more retries given its result:
+// Until is true, or without Until the step did not fail.  Until sees result
+// under the Register name, or under .result when not registered.
+func (a Action) Done(result Result) (bool, error) {
+	if a.Until == "" {
+		return !result.Failed(), nil
+	}
+	var (
+		vars = make(map[string]interface{}, len(a.vars)+1)
+		name = a.Register
+	)
+	for k, v := range a.vars {
+		vars[k] = v
+	}
+	if name == "" {
+		name = "result"
+	}
+	vars[name] = result
+	return Eval(a.Until, vars)
+}
+
+// Result describes how a step went, for later steps to refer to once
+// registered: stdout, stderr, stdout_lines, stderr_lines, rc, failed, changed
+// and skipped.  Registered Action with loop has results, failed, changed and
+// skipped.
+type Result map[string]interface{}
+
+// NewResult collects output of a step; rc is -1 when the step did not exit
+func NewResult(stdout, stderr []string, status *ExitStatus, err error) Result {
+	var rc = -1
+	if status != nil && status.Signal == "" {
+		rc = status.Code
+	}
+	return Result{
+		"stdout":       strings.Join(stdout, "\n"),
+		"stderr":       strings.Join(stderr, "\n"),
+		"stdout_lines": append([]string{}, stdout...),
+		"stderr_lines": append([]string{}, stderr...),
+		"rc":           rc,
+		"failed":       err != nil,
+		"changed":      true,
+		"skipped":      false,
+	}
+}
+
+// Result collects output of a step of this Action as NewResult does.  A
+// module reports whether it changed anything on its last line of output.
+func (a Action) Result(stdout, stderr []string, status *ExitStatus, err error) Result {
+	var result = NewResult(stdout, stderr, status, err)
+	if a.Module() != nil {
+		result["changed"] = err == nil && len(stdout) > 0 && stdout[len(stdout)-1] == "changed"
+	}
+	return result
+}
+
+// SkippedResult stands for a step not run
+func SkippedResult() Result {
+	return Result{"failed": false, "changed": false, "skipped": true}
+}
+
+// LoopResult gathers results of every step of a looped Action
+func LoopResult(results []Result) Result {
+	var failed, changed, skipped = false, false, true
+	for _, result := range results {
+		failed = failed || result.Failed()
+		changed = changed || result.Changed()
+		skipped = skipped && result.Skipped()
+	}
+	return Result{"results": results, "failed": failed, "changed": changed, "skipped": skipped}
+}
+
+// RestoreResult turns v, a Result read back from JSON, into what it was
+// before: rc an int again, output lines []string and loop results []Result,
+// so that templates handle it the same
+func RestoreResult(v interface{}) Result {
+	if result, ok := v.(Result); ok {
+		return result
+	}
+	fields, _ := v.(map[string]interface{})
+	var result = make(Result, len(fields))
+	for key, value := range fields {
+		switch value := value.(type) {
+		case float64:
+			result[key] = int(value)
+		case []interface{}:
+			if key == "results" {
+				var results = make([]Result, len(value))
+				for idx := range value {
+					results[idx] = RestoreResult(value[idx])
+				}
+				result[key] = results
+			} else {
+				var lines = make([]string, len(value))
+				for idx := range value {
+					lines[idx], _ = value[idx].(string)
+				}
+				result[key] = lines
+			}
+		default:
+			result[key] = value
+		}
+	}
+	return result
+}
+
+func (r Result) Failed() bool {
+	failed, _ := r["failed"].(bool)
+	return failed
+}
+
+func (r Result) Changed() bool {
+	changed, _ := r["changed"].(bool)
+	return changed
+}
+
+func (r Result) Skipped() bool {
+	skipped, _ := r["skipped"].(bool)
+	return skipped
+}
+
+// Registered is the value Action leaves under its Register name after
+// running steps with these results
+func (a Action) Registered(results []Result) Result {
+	if len(a.Loop)+len(a.WithItems) == 0 && len(results) == 1 {
+		return results[0]
+	}
+	return LoopResult(results)
+}
+
+// BatchSize reports how many of total hosts to run on at a time by Serial, a
+// count or percentage such as "25%", at least one.  Without Serial all hosts
+// run in one batch.
+func (r Recipe) BatchSize(total int) (int, error) {
+	var spec = strings.TrimSpace(r.Serial)
+	if spec == "" {
+		return total, nil
+	}
+	percent := strings.HasSuffix(spec, "%")
+	size, err := strconv.Atoi(strings.TrimSpace(strings.TrimSuffix(spec, "%")))
+	if err != nil || size <= 0 {
+		return 0, ErrBadSerial
+	}
+	if percent {
+		size = total * size / 100
+	}
+	if size < 1 {
+		size = 1
+	}
+	if size > total {
+		size = total
+	}
+	return size, nil
+}
+
+// Aborts reports whether failed hosts out of a batch of size stop the
+// batches after it: more than MaxFailPercentage of them, or every one of
+// them when not given
+func (r Recipe) Aborts(failed, size int) bool {
+	if r.MaxFailPercentage == nil {
+		return failed > 0 && failed == size
+	}
+	return failed*100 > *r.MaxFailPercentage*size
+}
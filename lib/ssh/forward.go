@@ -0,0 +1,183 @@
+package ssh
+
+import (
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/net/context"
+
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"sync"
+)
+
+// Forward relays connections accepted on Listen to Dial on the other end of
+// the SSH connection.  Addresses starting with "/" are unix sockets.
+type Forward struct {
+	Listen string
+	Dial   string
+}
+
+func (f Forward) String() string {
+	return f.Listen + " -> " + f.Dial
+}
+
+// ParseForward parses forwarding spec as accepted by ssh -L and -R:
+//
+//	[bind_address:]port:host:hostport
+//	[bind_address:]port:socket
+//	socket:host:hostport
+//	socket:socket
+func ParseForward(spec string) (f Forward, err error) {
+	var parts = strings.Split(spec, ":")
+	if strings.HasPrefix(parts[0], "/") {
+		f.Listen, parts = parts[0], parts[1:]
+	} else {
+		switch {
+		case len(parts) >= 2 && strings.HasPrefix(parts[1], "/"):
+			f.Listen, parts = net.JoinHostPort("localhost", parts[0]), parts[1:]
+		case len(parts) >= 3 && strings.HasPrefix(parts[2], "/"):
+			f.Listen, parts = net.JoinHostPort(parts[0], parts[1]), parts[2:]
+		case len(parts) == 3:
+			f.Listen, parts = net.JoinHostPort("localhost", parts[0]), parts[1:]
+		case len(parts) == 4:
+			f.Listen, parts = net.JoinHostPort(parts[0], parts[1]), parts[2:]
+		default:
+			return f, ErrBadForward
+		}
+	}
+	switch {
+	case len(parts) == 1 && strings.HasPrefix(parts[0], "/"):
+		f.Dial = parts[0]
+	case len(parts) == 2 && parts[0] != "" && parts[1] != "":
+		f.Dial = net.JoinHostPort(parts[0], parts[1])
+	default:
+		return f, ErrBadForward
+	}
+	return f, nil
+}
+
+func addrNetwork(addr string) string {
+	if strings.HasPrefix(addr, "/") {
+		return "unix"
+	}
+	return "tcp"
+}
+
+// listenLocal listens on addr, replacing stale unix socket left behind by an
+// earlier tunnel
+func listenLocal(addr string) (net.Listener, error) {
+	var network = addrNetwork(addr)
+	if info, err := os.Stat(addr); network == "unix" && err == nil && info.Mode()&os.ModeSocket != 0 {
+		if conn, err := net.Dial(network, addr); err == nil {
+			conn.Close() // someone is serving on it, let Listen fail
+		} else {
+			os.Remove(addr)
+		}
+	}
+	return net.Listen(network, addr)
+}
+
+// dialRemote connects to addr from the remote host
+func dialRemote(cli *ssh.Client, addr string) (io.ReadWriteCloser, error) {
+	if addrNetwork(addr) == "tcp" {
+		return cli.Dial("tcp", addr)
+	}
+	ch, reqs, err := cli.OpenChannel("direct-streamlocal@openssh.com", ssh.Marshal(&struct {
+		Path      string
+		Reserved0 string
+		Reserved1 uint32
+	}{Path: addr}))
+	if err != nil {
+		return nil, err
+	}
+	go ssh.DiscardRequests(reqs)
+	return ch, nil
+}
+
+// relay copies between a and b in both directions, passing half close along
+// until both directions are done
+func relay(a, b io.ReadWriteCloser) {
+	type closeWriter interface {
+		CloseWrite() error
+	}
+	var wg sync.WaitGroup
+	pipe := func(dst, src io.ReadWriteCloser) {
+		defer wg.Done()
+		io.Copy(dst, src)
+		if cw, ok := dst.(closeWriter); ok {
+			cw.CloseWrite()
+		} else {
+			dst.Close()
+		}
+	}
+	wg.Add(2)
+	go pipe(a, b)
+	go pipe(b, a)
+	wg.Wait()
+	a.Close()
+	b.Close()
+}
+
+// serveForward accepts connections on ln and relays each to connect() until
+// ctx is done or ln fails
+func serveForward(ctx context.Context, ln net.Listener, f Forward, connect func() (io.ReadWriteCloser, error)) error {
+	stop := abortOnDone(ctx, func() { ln.Close() })
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if perr := stop(); perr != nil {
+				return nil // asked to stop
+			}
+			return err
+		}
+		go func() {
+			peer, err := connect()
+			if err != nil {
+				fmt.Fprintln(os.Stderr, "forward", f, "-", err)
+				conn.Close()
+				return
+			}
+			relay(conn, peer)
+		}()
+	}
+}
+
+// LocalForward listens on this end and relays connections to f.Dial on the
+// remote host until ctx is done
+func (sshCmd *SSHCommander) LocalForward(ctx context.Context, f Forward) error {
+	if _, err := sshCmd.dial(); err != nil {
+		return err // report login failure before accepting connections
+	}
+	ln, err := listenLocal(f.Listen)
+	if err != nil {
+		return err
+	}
+	return serveForward(ctx, ln, f, func() (io.ReadWriteCloser, error) {
+		cli, err := sshCmd.dial()
+		if err != nil {
+			return nil, err
+		}
+		return dialRemote(cli, f.Dial)
+	})
+}
+
+// RemoteForward listens on the remote host and relays connections to f.Dial
+// on this end until ctx is done.  Remote unix socket is not supported.
+func (sshCmd *SSHCommander) RemoteForward(ctx context.Context, f Forward) error {
+	if addrNetwork(f.Listen) != "tcp" {
+		return ErrBadForward
+	}
+	cli, err := sshCmd.dial()
+	if err != nil {
+		return err
+	}
+	ln, err := cli.Listen("tcp", f.Listen)
+	if err != nil {
+		return err
+	}
+	return serveForward(ctx, ln, f, func() (io.ReadWriteCloser, error) {
+		return net.Dial(addrNetwork(f.Dial), f.Dial)
+	})
+}
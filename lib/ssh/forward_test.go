@@ -0,0 +1,159 @@
+package ssh
+
+import (
+	"golang.org/x/net/context"
+
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestParseForward(t *testing.T) {
+	cases := []struct {
+		spec string
+		want Forward
+	}{
+		{"8080:web:80", Forward{Listen: "localhost:8080", Dial: "web:80"}},
+		{"0.0.0.0:8080:web:80", Forward{Listen: "0.0.0.0:8080", Dial: "web:80"}},
+		{"2375:/var/run/docker.sock", Forward{Listen: "localhost:2375", Dial: "/var/run/docker.sock"}},
+		{"127.0.0.1:2375:/var/run/docker.sock", Forward{Listen: "127.0.0.1:2375", Dial: "/var/run/docker.sock"}},
+		{"/tmp/docker.sock:/var/run/docker.sock", Forward{Listen: "/tmp/docker.sock", Dial: "/var/run/docker.sock"}},
+		{"/tmp/web.sock:web:80", Forward{Listen: "/tmp/web.sock", Dial: "web:80"}},
+	}
+	for _, c := range cases {
+		got, err := ParseForward(c.spec)
+		if err != nil || got != c.want {
+			t.Errorf("ParseForward(%q) = %+v, %v; want %+v", c.spec, got, err, c.want)
+		}
+	}
+	for _, spec := range []string{"", "8080", "8080:web", "a:b:c:d:e"} {
+		if _, err := ParseForward(spec); err != ErrBadForward {
+			t.Errorf("ParseForward(%q) expected ErrBadForward, got %v", spec, err)
+		}
+	}
+}
+
+// echoServer answers each line with the same line prefixed by greeting
+func echoServer(t *testing.T, network, addr, greeting string) net.Listener {
+	ln, err := net.Listen(network, addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				line, _ := bufio.NewReader(conn).ReadString('\n')
+				fmt.Fprint(conn, greeting, line)
+			}()
+		}
+	}()
+	return ln
+}
+
+// roundTrip sends a line to addr and returns reply, retrying until the
+// forward starts listening
+func roundTrip(t *testing.T, network, addr string) string {
+	var (
+		conn net.Conn
+		err  error
+	)
+	for i := 0; i < 50; i++ {
+		if conn, err = net.Dial(network, addr); err == nil {
+			break
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	fmt.Fprintln(conn, "ping")
+	reply, _ := bufio.NewReader(conn).ReadString('\n')
+	return reply
+}
+
+func freeAddr(t *testing.T) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	return ln.Addr().String()
+}
+
+func TestLocalForward(t *testing.T) {
+	srv, cmdr := newTestCommander(t)
+	defer srv.Close()
+	defer cmdr.Close()
+
+	dir, err := ioutil.TempDir("", "forward")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	tcp := echoServer(t, "tcp", "127.0.0.1:0", "tcp ")
+	defer tcp.Close()
+	sock := echoServer(t, "unix", filepath.Join(dir, "remote.sock"), "unix ")
+	defer sock.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	forwards := []Forward{
+		{Listen: freeAddr(t), Dial: tcp.Addr().String()},
+		{Listen: filepath.Join(dir, "local.sock"), Dial: filepath.Join(dir, "remote.sock")},
+	}
+	done := make(chan error, len(forwards))
+	for _, f := range forwards {
+		go func(f Forward) { done <- cmdr.LocalForward(ctx, f) }(f)
+	}
+
+	if reply := roundTrip(t, "tcp", forwards[0].Listen); reply != "tcp ping\n" {
+		t.Errorf("unexpected reply over tcp forward: %q", reply)
+	}
+	if reply := roundTrip(t, "unix", forwards[1].Listen); reply != "unix ping\n" {
+		t.Errorf("unexpected reply over unix socket forward: %q", reply)
+	}
+
+	cancel()
+	for range forwards {
+		select {
+		case err := <-done:
+			if err != nil {
+				t.Errorf("expected clean stop, got %v", err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("forward did not stop on cancel")
+		}
+	}
+}
+
+func TestRemoteForward(t *testing.T) {
+	srv, cmdr := newTestCommander(t)
+	defer srv.Close()
+	defer cmdr.Close()
+
+	local := echoServer(t, "tcp", "127.0.0.1:0", "local ")
+	defer local.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	f := Forward{Listen: freeAddr(t), Dial: local.Addr().String()}
+	go cmdr.RemoteForward(ctx, f)
+
+	if reply := roundTrip(t, "tcp", f.Listen); reply != "local ping\n" {
+		t.Errorf("unexpected reply over remote forward: %q", reply)
+	}
+	if err := cmdr.RemoteForward(ctx, Forward{Listen: "/tmp/remote.sock", Dial: f.Dial}); err != ErrBadForward {
+		t.Errorf("expected ErrBadForward for remote unix socket, got %v", err)
+	}
+}
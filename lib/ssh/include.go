@@ -0,0 +1,331 @@
+package ssh
+
+import (
+	"github.com/jeffjen/yaml"
+
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	path "path/filepath"
+	"strings"
+)
+
+const (
+	// Directory next to playbook holding roles
+	ROLES_DIR = "roles"
+
+	// File read from tasks, handlers and defaults directory of a role
+	ROLE_MAIN = "main.yml"
+)
+
+// Role names a role to apply, given in YAML as a name, or a mapping of role
+// to name along with its parameters, e.g. {role: hardening, ssh_port: 2222}.
+// A name with a path separator is a role directory relative to the playbook.
+type Role struct {
+	Name string
+
+	// Parameters, over variables of the host in sections of this role
+	Vars map[string]interface{}
+
+	// Go through sections of this role only when this pipeline is true
+	When string
+}
+
+func (r *Role) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	if err := unmarshal(&r.Name); err == nil {
+		return nil
+	}
+	var spec map[string]interface{}
+	if err := unmarshal(&spec); err != nil {
+		return err
+	}
+	r.Name, _ = spec["role"].(string)
+	r.When, _ = spec["when"].(string)
+	delete(spec, "role")
+	delete(spec, "when")
+	if r.Name == "" {
+		return ErrRoleNoName
+	}
+	r.Vars = spec
+	return nil
+}
+
+// searchPath is where local files named by archives, scripts and copy or
+// template modules are found; empty for the directory of the file naming them
+type searchPath struct {
+	files, templates string
+}
+
+// at fills in dir for empty search path
+func (s searchPath) at(dir string) searchPath {
+	if s.files == "" {
+		return searchPath{files: dir, templates: dir}
+	}
+	return s
+}
+
+// resolve makes relative file relative to dir instead.  Templated file is
+// left alone, for it may well be absolute once rendered.
+func resolve(dir, file string) string {
+	if file == "" || path.IsAbs(file) || strings.HasPrefix(file, "{{") {
+		return file
+	}
+	return path.Join(dir, file)
+}
+
+// LoadPlaybook reads documents of playbook file with imports, includes and
+// roles expanded.  Relative files named in a playbook are found next to the
+// playbook; those named by a role in files and templates of the role.
+func LoadPlaybook(file string) ([]*Recipe, error) {
+	return loadPlaybook(file, nil)
+}
+
+// enter makes file absolute and adds it to the chain of files including one
+// another, failing when it is already there
+func enter(file string, chain []string) (string, []string, error) {
+	abs, err := path.Abs(file)
+	if err != nil {
+		return "", nil, err
+	}
+	for _, seen := range chain {
+		if seen == abs {
+			return "", nil, fmt.Errorf("%s: %v", file, ErrIncludeLoop)
+		}
+	}
+	return abs, append(append([]string{}, chain...), abs), nil
+}
+
+func loadPlaybook(file string, chain []string) ([]*Recipe, error) {
+	file, chain, err := enter(file, chain)
+	if err != nil {
+		return nil, err
+	}
+	r, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	var (
+		dir     = path.Dir(file)
+		docs    []*Recipe
+		decoder = yaml.NewDecoder(r)
+	)
+	defer decoder.Close()
+	for {
+		doc := new(Recipe)
+		if err = decoder.Decode(doc); err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, fmt.Errorf("Unable to parse %s: %v", file, err)
+		}
+		if doc.Import == "" {
+			if err = doc.expand(dir, chain); err != nil {
+				return nil, err
+			}
+			docs = append(docs, doc)
+			continue
+		}
+		imported, err := loadPlaybook(resolve(dir, doc.Import), chain)
+		if err != nil {
+			return nil, err
+		}
+		for _, d := range imported {
+			// Importing document may set hosts and vars underneath
+			if len(d.Hosts) == 0 {
+				d.Hosts = doc.Hosts
+			}
+			d.Vars = underlay(d.Vars, doc.Vars)
+		}
+		docs = append(docs, imported...)
+	}
+	return docs, nil
+}
+
+// underlay adds to vars what base has that vars has not
+func underlay(vars, base map[string]interface{}) map[string]interface{} {
+	if len(base) == 0 {
+		return vars
+	}
+	if vars == nil {
+		vars = make(map[string]interface{}, len(base))
+	}
+	for k, v := range base {
+		if _, ok := vars[k]; !ok {
+			vars[k] = v
+		}
+	}
+	return vars
+}
+
+// expand brings in roles and includes of document found in dir
+func (r *Recipe) expand(dir string, chain []string) (err error) {
+	var local = searchPath{}.at(dir)
+	for idx, a := range r.Archive {
+		r.Archive[idx] = a.resolve(local)
+	}
+	if r.Provision, err = expandSections(r.Provision, searchPath{}, dir, chain); err != nil {
+		return err
+	}
+	if r.Handlers, err = expandSections(r.Handlers, searchPath{}, dir, chain); err != nil {
+		return err
+	}
+	var sections, handlers []Provision
+	for _, role := range r.Roles {
+		tasks, notified, defaults, err := loadRole(dir, role, chain)
+		if err != nil {
+			return err
+		}
+		sections, handlers = append(sections, tasks...), append(handlers, notified...)
+		r.Vars = underlay(r.Vars, defaults)
+	}
+	r.Provision = append(sections, r.Provision...)
+	r.Handlers = append(r.Handlers, handlers...)
+	return nil
+}
+
+// loadRole reads tasks, handlers and defaults of role, each in main.yml of
+// its own directory, every one of them optional
+func loadRole(dir string, role Role, chain []string) (tasks, handlers []Provision, defaults map[string]interface{}, err error) {
+	var root = path.Join(dir, ROLES_DIR, role.Name)
+	if strings.ContainsRune(role.Name, os.PathSeparator) {
+		root = resolve(dir, role.Name)
+	}
+	if info, err := os.Stat(root); err != nil || !info.IsDir() {
+		return nil, nil, nil, fmt.Errorf("%s: %v", role.Name, ErrRoleNotFound)
+	}
+	var (
+		search = searchPath{files: path.Join(root, "files"), templates: path.Join(root, "templates")}
+
+		load = func(kind string) ([]Provision, error) {
+			var file = path.Join(root, kind, ROLE_MAIN)
+			if _, err := os.Stat(file); os.IsNotExist(err) {
+				return nil, nil
+			}
+			return loadSections(file, search, chain)
+		}
+	)
+	if tasks, err = load("tasks"); err != nil {
+		return nil, nil, nil, err
+	}
+	if handlers, err = load("handlers"); err != nil {
+		return nil, nil, nil, err
+	}
+	content, err := ioutil.ReadFile(path.Join(root, "defaults", ROLE_MAIN))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, nil, nil, err
+	} else if err == nil {
+		if err = yaml.Unmarshal(content, &defaults); err != nil {
+			return nil, nil, nil, fmt.Errorf("Unable to parse defaults of role %s: %v", role.Name, err)
+		}
+	}
+	for _, list := range [][]Provision{tasks, handlers} {
+		for idx := range list {
+			list[idx] = list[idx].within(Provision{Vars: role.Vars, When: role.When})
+		}
+	}
+	return tasks, handlers, defaults, nil
+}
+
+// loadSections reads list of sections in file, bringing in what they include
+// in turn
+func loadSections(file string, search searchPath, chain []string) ([]Provision, error) {
+	file, chain, err := enter(file, chain)
+	if err != nil {
+		return nil, err
+	}
+	content, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	var sections []Provision
+	if err = yaml.Unmarshal(content, &sections); err != nil {
+		return nil, fmt.Errorf("Unable to parse %s: %v", file, err)
+	}
+	return expandSections(sections, search, path.Dir(file), chain)
+}
+
+// expandSections replaces sections that include a file with those listed in
+// it, and resolves files named in every section against search path
+func expandSections(sections []Provision, search searchPath, dir string, chain []string) ([]Provision, error) {
+	var expanded []Provision
+	for _, p := range sections {
+		if p.Include == "" {
+			expanded = append(expanded, p.resolve(search.at(dir)))
+			continue
+		}
+		included, err := loadSections(resolve(dir, p.Include), search, chain)
+		if err != nil {
+			return nil, err
+		}
+		for _, q := range included {
+			expanded = append(expanded, q.within(p))
+		}
+	}
+	return expanded, nil
+}
+
+// within makes section q part of include or role p: q takes variables and
+// condition of p, is skipped or may fail along with it
+func (q Provision) within(p Provision) Provision {
+	if len(p.Vars) > 0 {
+		var vars = make(map[string]interface{}, len(q.Vars)+len(p.Vars))
+		for k, v := range q.Vars {
+			vars[k] = v
+		}
+		for k, v := range p.Vars {
+			vars[k] = v // parameters given win
+		}
+		q.Vars = vars
+	}
+	var conditions = append([]string{}, p.conditions...)
+	if p.When != "" {
+		conditions = append(conditions, p.When)
+	}
+	q.conditions = append(conditions, q.conditions...)
+	q.Skip, q.Ok2fail = q.Skip || p.Skip, q.Ok2fail || p.Ok2fail
+	return q
+}
+
+// resolve finds files named by section in search path
+func (p Provision) resolve(search searchPath) Provision {
+	var archive = make([]Archive, len(p.Archive))
+	for idx, a := range p.Archive {
+		archive[idx] = a.resolve(search)
+	}
+	var action = make([]Action, len(p.Action))
+	for idx, a := range p.Action {
+		action[idx] = a.resolve(search)
+	}
+	p.Archive, p.Action = archive, action
+	return p
+}
+
+func (a Archive) resolve(search searchPath) Archive {
+	if a.Template {
+		a.Src = resolve(search.templates, a.Src)
+	} else {
+		a.Src = resolve(search.files, a.Src)
+	}
+	return a
+}
+
+func (a Action) resolve(search searchPath) Action {
+	if a.Template.Script {
+		a.Script = resolve(search.templates, a.Script)
+	} else {
+		a.Script = resolve(search.files, a.Script)
+	}
+	if m := a.Modules.Copy; m != nil {
+		copied := *m
+		copied.Src = resolve(search.files, m.Src)
+		a.Modules.Copy = &copied
+	}
+	if m := a.Template.Module; m != nil {
+		copied := *m
+		copied.Src = resolve(search.templates, m.Src)
+		a.Template.Module = &copied
+	}
+	return a
+}
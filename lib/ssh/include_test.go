@@ -0,0 +1,171 @@
+package ssh
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func writeFiles(t *testing.T, dir string, files map[string]string) {
+	for name, content := range files {
+		file := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(file, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestLoadPlaybook(t *testing.T) {
+	dir, err := ioutil.TempDir("", "playbook")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	writeFiles(t, dir, map[string]string{
+		"site.yml": `
+import: engine.yml
+hosts: managers
+vars: {region: us-west-2}
+---
+archive:
+- src: dist
+  dir: /opt/app
+provision:
+- include: tasks/app.yml
+  vars: {port: 9090}
+  when: .deploy
+`,
+		"engine.yml": `
+roles:
+- docker-engine
+- {role: hardening, ssh_port: 2222, when: .secure}
+vars: {storage: overlay2}
+provision:
+- name: Own section
+`,
+		"tasks/app.yml": `
+- name: Run app on {{.port}}
+  action:
+    - script: start.sh
+`,
+		"roles/docker-engine/tasks/main.yml": `
+- name: Install Docker {{.docker_version}}
+  action:
+    - copy: {src: daemon.json, dest: /etc/docker/daemon.json}
+      notify: Restart Docker
+    - template: {src: docker.service, dest: /etc/systemd/system/docker.service}
+- include: storage.yml
+`,
+		"roles/docker-engine/tasks/storage.yml": `
+- name: Storage {{.storage}}
+`,
+		"roles/docker-engine/handlers/main.yml": `
+- name: Restart Docker
+  action:
+    - service: {name: docker, state: restarted}
+`,
+		"roles/docker-engine/defaults/main.yml": "docker_version: 17.03.1\nstorage: devicemapper\n",
+		"roles/hardening/tasks/main.yml": `
+- name: Harden sshd on {{.ssh_port}}
+  archive:
+  - src: sshd_config
+    dst: /etc/ssh/sshd_config
+    template: true
+`,
+	})
+
+	docs, err := LoadPlaybook(filepath.Join(dir, "site.yml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(docs) != 2 {
+		t.Fatalf("expected imported document and one of its own, got %d", len(docs))
+	}
+	engine, app := docs[0], docs[1]
+	if err = engine.CheckNotify(); err != nil {
+		t.Error(err)
+	}
+
+	var names []string
+	for _, p := range engine.Provision {
+		names = append(names, p.Name)
+	}
+	if want := []string{"Install Docker {{.docker_version}}", "Storage {{.storage}}", "Harden sshd on {{.ssh_port}}", "Own section"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("unexpected sections %q", names)
+	}
+	if len(engine.Handlers) != 1 || !reflect.DeepEqual(engine.Hosts, Patterns{"managers"}) {
+		t.Errorf("unexpected handlers %v or hosts %v", engine.Handlers, engine.Hosts)
+	}
+	// Defaults of role are beneath variables of document, importing ones lower still
+	if engine.Vars["storage"] != "overlay2" || engine.Vars["docker_version"] != "17.03.1" || engine.Vars["region"] != "us-west-2" {
+		t.Errorf("unexpected vars %v", engine.Vars)
+	}
+
+	install := engine.Provision[0].Action
+	if src := install[0].Modules.Copy.Src; src != filepath.Join(dir, "roles", "docker-engine", "files", "daemon.json") {
+		t.Errorf("unexpected copy src %s", src)
+	}
+	if src := install[1].Template.Module.Src; src != filepath.Join(dir, "roles", "docker-engine", "templates", "docker.service") {
+		t.Errorf("unexpected template src %s", src)
+	}
+	harden := engine.Provision[2]
+	if src := harden.Archive[0].Src; src != filepath.Join(dir, "roles", "hardening", "templates", "sshd_config") {
+		t.Errorf("unexpected archive src %s", src)
+	}
+	vars := map[string]interface{}{"ssh_port": 22, "secure": true}
+	if scope := harden.Variables(vars); scope["ssh_port"] != 2222 || vars["ssh_port"] != 22 {
+		t.Errorf("expected role parameter in its section alone, got %v", scope)
+	}
+	if ok, _ := harden.Applies(map[string]interface{}{"secure": false}); ok {
+		t.Error("expected role condition to apply to its sections")
+	}
+
+	if src := app.Archive[0].Src; src != filepath.Join(dir, "dist") {
+		t.Errorf("unexpected archive src %s", src)
+	}
+	run := app.Provision[0]
+	if run.Action[0].Script != filepath.Join(dir, "tasks", "start.sh") || run.Vars["port"] != 9090 {
+		t.Errorf("unexpected included section %+v", run)
+	}
+	rendered, err := app.Render(map[string]interface{}{"deploy": true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if name := rendered.Provision[0].Name; name != "Run app on 9090" {
+		t.Errorf("unexpected name %q", name)
+	}
+	if ok, _ := run.Applies(map[string]interface{}{"deploy": false}); ok {
+		t.Error("expected include condition to apply to included sections")
+	}
+}
+
+func TestLoadPlaybookErrors(t *testing.T) {
+	dir, err := ioutil.TempDir("", "playbook")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	writeFiles(t, dir, map[string]string{
+		"loop.yml":    "provision:\n- include: tasks.yml\n",
+		"tasks.yml":   "- include: tasks.yml\n",
+		"missing.yml": "roles: [nginx]\n",
+		"noname.yml":  "roles: [{port: 80}]\n",
+	})
+	if _, err = LoadPlaybook(filepath.Join(dir, "loop.yml")); err == nil || !strings.Contains(err.Error(), ErrIncludeLoop.Error()) {
+		t.Errorf("expected include loop, got %v", err)
+	}
+	if _, err = LoadPlaybook(filepath.Join(dir, "missing.yml")); err == nil || !strings.Contains(err.Error(), ErrRoleNotFound.Error()) {
+		t.Errorf("expected role not found, got %v", err)
+	}
+	if _, err = LoadPlaybook(filepath.Join(dir, "noname.yml")); err == nil {
+		t.Error("expected error for role without name")
+	}
+}
@@ -1,6 +1,8 @@
 package ssh
 
 import (
+	"golang.org/x/net/context"
+
 	"io"
 	"os"
 )
@@ -9,6 +11,9 @@ type Commander interface {
 	// Report host this Commander connects to
 	Host() (host, port string)
 
+	// Report fingerprint of host key verified on connect
+	HostKey() string
+
 	// Load file from target to here
 	Load(target string, here io.Writer) error
 
@@ -18,31 +23,63 @@ type Commander interface {
 	// Copy file from src to dst
 	Copy(src io.Reader, size int64, dst string, mode os.FileMode) error
 
+	// Copy file from src to dst, aborting when ctx is done
+	CopyContext(ctx context.Context, src io.Reader, size int64, dst string, mode os.FileMode) error
+
 	// Copy file from src to dst
 	CopyFile(src, dst string, mode os.FileMode) error
 
+	// Copy local file or directory tree src to dst over SFTP
+	Upload(src, dst string, opts TransferOptions) error
+
+	// Copy remote file or directory tree src to local dst over SFTP
+	Download(src, dst string, opts TransferOptions) error
+
 	// Create full directory
 	Mkdir(path string) error
 
 	// Run command and retreive combinded output
 	Run(cmd string) (string, error)
 
+	// Run command and retreive combinded output, aborting when ctx is done
+	RunContext(ctx context.Context, cmd string) (string, error)
+
 	// Run command and stay quiet
 	RunQuiet(cmd string) error
 
 	// Obtain a login shell
 	Shell() error
 
-	// Run command and stream combined output
+	// Obtain a login shell, closing it when ctx is done
+	ShellContext(ctx context.Context) error
+
+	// Run command and stream output line by line, ending with exit status
 	Stream(cmd string) (<-chan Response, error)
 
+	// Run command and stream output, terminating command when ctx is done
+	StreamContext(ctx context.Context, cmd string) (<-chan Response, error)
+
 	// Elevate commander role and return a Deferr Target
 	Sudo() SudoSession
 
+	// Elevate commander role to user, root when empty, and return a Deferr
+	// Target
+	SudoAs(user string) SudoSession
+
 	// Close Connection and cleanup
 	Close() error
 }
 
+// Forwarder relays connections across the SSH connection, in the manner of
+// ssh -L and -R
+type Forwarder interface {
+	// Listen here and connect from remote host, until ctx is done
+	LocalForward(ctx context.Context, f Forward) error
+
+	// Listen on remote host and connect from here, until ctx is done
+	RemoteForward(ctx context.Context, f Forward) error
+}
+
 type SudoSession interface {
 	// Step down from sudo status
 	StepDown()
@@ -0,0 +1,293 @@
+package ssh
+
+import (
+	"golang.org/x/crypto/ssh"
+
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+const (
+	// Refuse hosts not found in known_hosts
+	HostKeyStrict = "strict"
+
+	// Trust on first use, record new hosts in known_hosts
+	HostKeyAcceptNew = "accept-new"
+
+	// Skip host key verification altogether
+	HostKeyInsecure = "insecure"
+)
+
+var (
+	// Serialize writes to the machine managed known_hosts
+	knownHostsLock sync.Mutex
+)
+
+// IsHostKeyMode reports whether mode is a recognized verification mode
+func IsHostKeyMode(mode string) bool {
+	switch mode {
+	case HostKeyStrict, HostKeyAcceptNew, HostKeyInsecure:
+		return true
+	default:
+		return false
+	}
+}
+
+// Fingerprint reports the SHA256 fingerprint of key in OpenSSH notation
+func Fingerprint(key ssh.PublicKey) string {
+	sum := sha256.Sum256(key.Marshal())
+	return "SHA256:" + base64.RawStdEncoding.EncodeToString(sum[:])
+}
+
+type hostKeyVerifier struct {
+	// Verification mode, one of HostKeyStrict, HostKeyAcceptNew, HostKeyInsecure
+	mode string
+
+	// Fingerprint previously recorded for this host
+	pinned string
+
+	// known_hosts files to consult, in order
+	knownHosts []string
+
+	// known_hosts file to record newly accepted host into
+	record string
+
+	// SSH CA keys trusted to sign host certificates for any host
+	authorities []ssh.PublicKey
+
+	// Fingerprint of host key verified on last handshake
+	verified string
+}
+
+func newHostKeyVerifier(cfg Config) *hostKeyVerifier {
+	var mode = cfg.HostKeyMode
+	if mode == "" {
+		mode = HostKeyAcceptNew
+	}
+	v := &hostKeyVerifier{
+		mode:       mode,
+		pinned:     cfg.HostKey,
+		knownHosts: []string{filepath.Join(os.Getenv("HOME"), ".ssh", "known_hosts")},
+		record:     cfg.KnownHosts,
+	}
+	if cfg.KnownHosts != "" {
+		v.knownHosts = append(v.knownHosts, cfg.KnownHosts)
+	}
+	if cfg.HostCAFile != "" {
+		v.authorities = loadAuthorizedKeys(cfg.HostCAFile)
+	}
+	return v
+}
+
+// loadAuthorizedKeys reads public keys in authorized_keys format, missing
+// file yields none
+func loadAuthorizedKeys(file string) (keys []ssh.PublicKey) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil
+	}
+	for len(data) > 0 {
+		pub, _, _, rest, err := ssh.ParseAuthorizedKey(data)
+		if err != nil {
+			break
+		}
+		keys = append(keys, pub)
+		data = rest
+	}
+	return
+}
+
+func (v *hostKeyVerifier) check(hostname string, remote net.Addr, key ssh.PublicKey) error {
+	if err := v.verify(hostname, key); err != nil {
+		return err
+	}
+	if cert, ok := key.(*ssh.Certificate); ok {
+		key = cert.Key // record the host key, which outlives its certificate
+	}
+	v.verified = Fingerprint(key)
+	return nil
+}
+
+func (v *hostKeyVerifier) verify(hostname string, key ssh.PublicKey) error {
+	if v.mode == HostKeyInsecure {
+		return nil
+	}
+	if cert, ok := key.(*ssh.Certificate); ok {
+		if trusted, err := v.verifyCert(hostname, cert); trusted {
+			return err
+		}
+		key = cert.Key // not signed by a trusted CA, judge host key on its own
+	}
+	if v.pinned != "" {
+		if v.pinned != Fingerprint(key) {
+			return ErrHostKeyMismatch
+		}
+		return nil
+	}
+	known, err := lookupKnownHosts(v.knownHosts, hostname, key)
+	switch {
+	case err != nil:
+		return err
+	case known:
+		return nil
+	case v.mode == HostKeyStrict || v.record == "":
+		return ErrHostKeyUnknown
+	default:
+		return appendKnownHosts(v.record, hostname, key)
+	}
+}
+
+// verifyCert checks host certificate against trusted SSH CA keys.  trusted
+// reports whether cert was signed by one of them at all.
+func (v *hostKeyVerifier) verifyCert(hostname string, cert *ssh.Certificate) (trusted bool, err error) {
+	// Copied, as dials verifying at once share v.authorities
+	authorities := append(append([]ssh.PublicKey{}, v.authorities...), knownHostsAuthorities(v.knownHosts, hostname)...)
+	for _, auth := range authorities {
+		if bytes.Equal(auth.Marshal(), cert.SignatureKey.Marshal()) {
+			trusted = true
+		}
+	}
+	if !trusted {
+		return
+	}
+	if cert.CertType != ssh.HostCert {
+		return true, ErrNotHostCert
+	}
+	host, _, e := net.SplitHostPort(hostname)
+	if e != nil {
+		host = hostname
+	}
+	// Authority was matched above, CheckCert looks at the rest
+	checker := &ssh.CertChecker{}
+	return true, checker.CheckCert(host, cert)
+}
+
+// knownHostsAuthorities collects @cert-authority keys applying to hostname
+func knownHostsAuthorities(files []string, hostname string) (keys []ssh.PublicKey) {
+	var addr = knownHostsAddr(hostname)
+	for _, file := range files {
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			continue
+		}
+		for _, line := range bytes.Split(data, []byte("\n")) {
+			marker, hosts, pubKey, _, _, err := ssh.ParseKnownHosts(line)
+			if err == nil && marker == "cert-authority" && matchKnownHost(hosts, addr) {
+				keys = append(keys, pubKey)
+			}
+		}
+	}
+	return
+}
+
+// knownHostsAddr normalize address into known_hosts notation
+func knownHostsAddr(hostname string) string {
+	host, port, err := net.SplitHostPort(hostname)
+	if err != nil {
+		return hostname
+	}
+	if port == "22" {
+		return host
+	}
+	return "[" + host + "]:" + port
+}
+
+func matchKnownHost(patterns []string, addr string) (matched bool) {
+	for _, pattern := range patterns {
+		switch {
+		case strings.HasPrefix(pattern, "|1|"):
+			if matchHashedHost(pattern, addr) {
+				matched = true
+			}
+		case strings.HasPrefix(pattern, "!"):
+			if matchPattern(pattern[1:], addr) {
+				return false // negated pattern wins
+			}
+		default:
+			if matchPattern(pattern, addr) {
+				matched = true
+			}
+		}
+	}
+	return
+}
+
+func matchHashedHost(pattern, addr string) bool {
+	parts := strings.Split(pattern[len("|1|"):], "|")
+	if len(parts) != 2 {
+		return false
+	}
+	salt, err := base64.StdEncoding.DecodeString(parts[0])
+	if err != nil {
+		return false
+	}
+	hash, err := base64.StdEncoding.DecodeString(parts[1])
+	if err != nil {
+		return false
+	}
+	mac := hmac.New(sha1.New, salt)
+	mac.Write([]byte(addr))
+	return hmac.Equal(mac.Sum(nil), hash)
+}
+
+func lookupKnownHosts(files []string, hostname string, key ssh.PublicKey) (known bool, err error) {
+	var (
+		addr     = knownHostsAddr(hostname)
+		mismatch = false
+	)
+	for _, file := range files {
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			continue // missing known_hosts is not fatal
+		}
+		for _, line := range bytes.Split(data, []byte("\n")) {
+			marker, hosts, pubKey, _, _, err := ssh.ParseKnownHosts(line)
+			if err != nil {
+				continue // skip entries we cannot parse, e.g. unsupported key type
+			}
+			if !matchKnownHost(hosts, addr) {
+				continue
+			}
+			same := bytes.Equal(pubKey.Marshal(), key.Marshal())
+			switch marker {
+			case "revoked":
+				if same {
+					return false, ErrHostKeyRevoked
+				}
+			case "cert-authority":
+				// NOOP, consulted for host certificates only
+			default:
+				if same {
+					known = true
+				} else if pubKey.Type() == key.Type() {
+					mismatch = true
+				}
+			}
+		}
+	}
+	if !known && mismatch {
+		err = ErrHostKeyMismatch
+	}
+	return
+}
+
+func appendKnownHosts(file, hostname string, key ssh.PublicKey) error {
+	knownHostsLock.Lock()
+	defer knownHostsLock.Unlock()
+	origin, err := os.OpenFile(file, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	defer origin.Close()
+	_, err = origin.Write(append([]byte(knownHostsAddr(hostname)+" "), ssh.MarshalAuthorizedKey(key)...))
+	return err
+}
@@ -0,0 +1,64 @@
+package ssh
+
+import (
+	"github.com/poddworks/machine/lib/cert"
+
+	"golang.org/x/crypto/ssh"
+
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestHostCertificate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sshca")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err = cert.GenerateSSHCA(dir); err != nil {
+		t.Fatal(err)
+	}
+	_, hostKey := writeKey(t, dir, "ssh_host_rsa_key", "")
+
+	signHost := func(certType string, principals ...string) ssh.PublicKey {
+		var sign = cert.SignSSHHostCertificate
+		if certType == "user" {
+			sign = cert.SignSSHUserCertificate
+		}
+		signed, err := sign(dir, ssh.MarshalAuthorizedKey(hostKey), "test", principals, time.Hour)
+		if err != nil {
+			t.Fatal(err)
+		}
+		pub, _, _, _, err := ssh.ParseAuthorizedKey(signed)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return pub
+	}
+
+	v := newHostKeyVerifier(Config{
+		HostKeyMode: HostKeyStrict,
+		HostCAFile:  filepath.Join(dir, cert.SSH_CA_PUB),
+	})
+	if err = v.check("10.0.0.1:22", nil, signHost("host", "10.0.0.1")); err != nil {
+		t.Errorf("trusted host certificate refused: %v", err)
+	}
+	if v.verified != Fingerprint(hostKey) {
+		t.Errorf("expected host key recorded, got %s", v.verified)
+	}
+	if err = v.check("10.0.0.2:22", nil, signHost("host", "10.0.0.1")); err == nil {
+		t.Error("expected certificate for other host refused")
+	}
+	if err = v.check("10.0.0.1:22", nil, signHost("user", "10.0.0.1")); err != ErrNotHostCert {
+		t.Errorf("expected ErrNotHostCert, got %v", err)
+	}
+
+	// Without trusted CA certificate is judged by its host key
+	v = newHostKeyVerifier(Config{HostKeyMode: HostKeyStrict})
+	if err = v.check("10.0.0.1:22", nil, signHost("host", "10.0.0.1")); err != ErrHostKeyUnknown {
+		t.Errorf("expected ErrHostKeyUnknown, got %v", err)
+	}
+}
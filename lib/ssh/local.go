@@ -0,0 +1,403 @@
+package ssh
+
+import (
+	"github.com/poddworks/machine/lib/vault"
+
+	"golang.org/x/net/context"
+
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+const (
+	// Host name or playbook connection selecting LocalCommander
+	LOCAL = "local"
+)
+
+var (
+	// Signal names as reported in SSH exit-signal, see RFC 4254 6.10
+	signalNames = map[syscall.Signal]string{
+		syscall.SIGABRT: "ABRT",
+		syscall.SIGALRM: "ALRM",
+		syscall.SIGFPE:  "FPE",
+		syscall.SIGHUP:  "HUP",
+		syscall.SIGILL:  "ILL",
+		syscall.SIGINT:  "INT",
+		syscall.SIGKILL: "KILL",
+		syscall.SIGPIPE: "PIPE",
+		syscall.SIGQUIT: "QUIT",
+		syscall.SIGSEGV: "SEGV",
+		syscall.SIGTERM: "TERM",
+		syscall.SIGUSR1: "USR1",
+		syscall.SIGUSR2: "USR2",
+	}
+)
+
+// LocalCommander runs commands and transfers files on the control machine
+// itself, so that a Recipe may be applied locally
+type LocalCommander struct {
+	sudo bool
+
+	// Run as this user under sudo, root when empty
+	sudoUser string
+
+	// Escalation method under Sudo, only BecomeSudo is supported here
+	become string
+
+	// Private directory holding scripts to run, made on first use
+	tmpDir string
+}
+
+func (local *LocalCommander) Host() (host, port string) {
+	return LOCAL, ""
+}
+
+func (local *LocalCommander) HostKey() string {
+	return ""
+}
+
+func (local *LocalCommander) Sudo() SudoSession {
+	return local.SudoAs("")
+}
+
+func (local *LocalCommander) SudoAs(user string) SudoSession {
+	local.sudo = true
+	local.sudoUser = user
+	return local
+}
+
+func (local *LocalCommander) StepDown() {
+	local.sudo = false
+	local.sudoUser = ""
+}
+
+// sudoArgs prefixes args with sudo invocation for the target user; sudo asks
+// for password on the terminal itself
+func (local *LocalCommander) sudoArgs(args ...string) *exec.Cmd {
+	if local.sudoUser != "" {
+		args = append([]string{"-u", local.sudoUser}, args...)
+	}
+	return exec.Command("sudo", args...)
+}
+
+// command prepares cmd for running through shell, elevated when in sudo
+func (local *LocalCommander) command(cmd string) (*exec.Cmd, error) {
+	if !local.sudo {
+		return exec.Command(userShell(), "-c", cmd), nil
+	}
+	if local.become != "" && local.become != BecomeSudo {
+		return nil, ErrLocalBecome
+	}
+	return local.sudoArgs("--", userShell(), "-c", cmd), nil
+}
+
+// userShell is the shell commands run in, as they would over SSH
+func userShell() string {
+	if shell := os.Getenv("SHELL"); shell != "" {
+		return shell
+	}
+	return "/bin/sh"
+}
+
+// TempDir reports directory private to this Commander for scripts to run
+// from, so that concurrent runs keep out of each other's way.  It is owned
+// by the user running machine, and may be entered by users sudo runs as.
+func (local *LocalCommander) TempDir() (string, error) {
+	if local.tmpDir != "" {
+		return local.tmpDir, nil
+	}
+	dir, err := ioutil.TempDir("", "machine")
+	if err != nil {
+		return "", err
+	}
+	if err = os.Chmod(dir, 0711); err != nil {
+		os.RemoveAll(dir)
+		return "", err
+	}
+	local.tmpDir = dir
+	return dir, nil
+}
+
+// CleanTempDir removes what TempDir holds, without escalating
+func (local *LocalCommander) CleanTempDir() error {
+	if local.tmpDir == "" {
+		return nil
+	}
+	dir := local.tmpDir
+	local.tmpDir = ""
+	return os.RemoveAll(dir)
+}
+
+// run starts proc and waits for it, terminating proc when ctx is done
+func (local *LocalCommander) run(ctx context.Context, proc *exec.Cmd) error {
+	if err := proc.Start(); err != nil {
+		return err
+	}
+	stop := abortOnDone(ctx, func() {
+		proc.Process.Signal(syscall.SIGTERM)
+	})
+	err := proc.Wait()
+	if cerr := stop(); cerr != nil {
+		err = cerr
+	}
+	return err
+}
+
+func (local *LocalCommander) Load(target string, here io.Writer) error {
+	proc, err := local.command(fmt.Sprint("cat ", Quote(target)))
+	if err != nil {
+		return err
+	}
+	proc.Stdout = here
+	return local.run(context.Background(), proc)
+}
+
+func (local *LocalCommander) LoadFile(target, here string, mode os.FileMode) error {
+	buf := new(bytes.Buffer)
+	err := local.Load(target, buf)
+	if err != nil {
+		return err
+	}
+	file, err := os.OpenFile(here, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, mode)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	_, err = io.Copy(file, buf)
+	return err
+}
+
+func (local *LocalCommander) Copy(src io.Reader, size int64, dst string, mode os.FileMode) error {
+	return local.CopyContext(context.Background(), src, size, dst, mode)
+}
+
+func (local *LocalCommander) CopyContext(ctx context.Context, src io.Reader, size int64, dst string, mode os.FileMode) error {
+	if !mode.IsRegular() {
+		return ErrCopyNotRegular
+	}
+	if err := local.Mkdir(filepath.Dir(dst)); err != nil {
+		return err
+	}
+	proc, err := local.command(fmt.Sprintf("cat > %s && chmod %o %s", Quote(dst), mode.Perm(), Quote(dst)))
+	if err != nil {
+		return err
+	}
+	proc.Stdin = io.LimitReader(src, size)
+	return local.run(ctx, proc)
+}
+
+func (local *LocalCommander) CopyFile(src, dst string, mode os.FileMode) error {
+	file, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	return local.Copy(file, info.Size(), dst, mode)
+}
+
+// transfer copies file or directory tree src to dst with cp(1), preserving
+// modes and mtimes.  Progress is reported once per transfer.
+func (local *LocalCommander) transfer(src, dst string, opts TransferOptions) error {
+	var flags = "-RPp"
+	if opts.FollowSymlinks {
+		flags = "-RLp"
+	}
+	info, err := os.Stat(src)
+	if err != nil {
+		return err
+	}
+	var cmd string
+	if info.IsDir() {
+		cmd = fmt.Sprintf("mkdir -p %s && cp %s %s/. %s", Quote(dst), flags, Quote(src), Quote(dst))
+	} else {
+		cmd = fmt.Sprintf("mkdir -p %s && cp %s %s %s", Quote(filepath.Dir(dst)), flags, Quote(src), Quote(dst))
+	}
+	proc, err := local.command(cmd)
+	if err != nil {
+		return err
+	}
+	if err = local.run(context.Background(), proc); err != nil {
+		return err
+	}
+	if opts.Decrypt {
+		if err = local.decrypt(src, dst, opts.FollowSymlinks); err != nil {
+			return err
+		}
+	}
+	if opts.Progress != nil {
+		opts.Progress(dst, info.Size(), info.Size())
+	}
+	return nil
+}
+
+// decrypt replaces copies of vault encrypted files under src that cp(1)
+// left in dst with their content decrypted, readable only by owner
+func (local *LocalCommander) decrypt(src, dst string, follow bool) error {
+	return filepath.Walk(src, func(file string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if follow && info.Mode()&os.ModeSymlink != 0 {
+			if info, err = os.Stat(file); err != nil {
+				return err
+			}
+		}
+		if !info.Mode().IsRegular() || !vault.IsEncryptedFile(file) {
+			return nil
+		}
+		content, err := readLocal(file)
+		if err != nil {
+			return err
+		}
+		rel, _ := filepath.Rel(src, file)
+		target, mode := filepath.Join(dst, rel), localMode(file, info.Mode().Perm())
+		// Restrict mode before writing so content is never readable by others
+		if err = local.RunQuiet(fmt.Sprintf("chmod %o %s", mode, Quote(target))); err != nil {
+			return err
+		}
+		return local.Copy(bytes.NewReader(content), int64(len(content)), target, mode)
+	})
+}
+
+func (local *LocalCommander) Upload(src, dst string, opts TransferOptions) error {
+	return local.transfer(src, dst, opts)
+}
+
+func (local *LocalCommander) Download(src, dst string, opts TransferOptions) error {
+	return local.transfer(src, dst, opts)
+}
+
+func (local *LocalCommander) Mkdir(path string) error {
+	proc, err := local.command(fmt.Sprint("mkdir -p ", Quote(path)))
+	if err != nil {
+		return err
+	}
+	return local.run(context.Background(), proc)
+}
+
+func (local *LocalCommander) Run(cmd string) (string, error) {
+	return local.RunContext(context.Background(), cmd)
+}
+
+func (local *LocalCommander) RunContext(ctx context.Context, cmd string) (output string, err error) {
+	var b buffer
+	proc, err := local.command(cmd)
+	if err != nil {
+		return "", err
+	}
+	proc.Stdout = &b
+	proc.Stderr = &b
+	err = local.run(ctx, proc)
+	output = b.buf.String()
+	return
+}
+
+func (local *LocalCommander) RunQuiet(cmd string) error {
+	proc, err := local.command(cmd)
+	if err != nil {
+		return err
+	}
+	return local.run(context.Background(), proc)
+}
+
+func (local *LocalCommander) Shell() error {
+	return local.ShellContext(context.Background())
+}
+
+func (local *LocalCommander) ShellContext(ctx context.Context) error {
+	proc := exec.Command(userShell(), "-l")
+	if local.sudo {
+		if local.become != "" && local.become != BecomeSudo {
+			return ErrLocalBecome
+		}
+		proc = local.sudoArgs("-i")
+	}
+	proc.Stdin = os.Stdin
+	proc.Stdout = os.Stdout
+	proc.Stderr = os.Stderr
+	return local.run(ctx, proc)
+}
+
+func (local *LocalCommander) Stream(cmd string) (<-chan Response, error) {
+	return local.StreamContext(context.Background(), cmd)
+}
+
+func (local *LocalCommander) StreamContext(ctx context.Context, cmd string) (<-chan Response, error) {
+	proc, err := local.command(cmd)
+	if err != nil {
+		return nil, err
+	}
+	stdout, err := proc.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	stderr, err := proc.StderrPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err = proc.Start(); err != nil {
+		return nil, err
+	}
+	output := make(chan Response)
+	stop := abortOnDone(ctx, func() {
+		proc.Process.Signal(syscall.SIGTERM)
+	})
+	go func() {
+		defer close(output)
+		relayLines(stdout, stderr, output)
+		err := proc.Wait()
+		if cerr := stop(); cerr != nil {
+			output <- Response{err: cerr}
+		} else {
+			output <- localExitResponse(err)
+		}
+	}()
+	return output, nil
+}
+
+func (local *LocalCommander) Close() error {
+	return local.CleanTempDir()
+}
+
+// NewLocal creates Commander acting on the control machine
+func NewLocal() Commander {
+	return &LocalCommander{}
+}
+
+// NewLocalBecome creates Commander acting on the control machine, escalating
+// through method.  Only sudo is supported; with any other method elevated
+// steps fail with ErrLocalBecome.
+func NewLocalBecome(method string) Commander {
+	return &LocalCommander{become: method}
+}
+
+// localExitResponse builds the terminal response out of exec.Cmd.Wait()
+// result, in the same terms as SSH exit-status and exit-signal
+func localExitResponse(err error) Response {
+	exitErr, ok := err.(*exec.ExitError)
+	if !ok {
+		return exitResponse(err)
+	}
+	ws, ok := exitErr.Sys().(syscall.WaitStatus)
+	if !ok {
+		return Response{err: err}
+	}
+	status := &ExitStatus{Code: ws.ExitStatus()}
+	if ws.Signaled() {
+		if status.Signal = signalNames[ws.Signal()]; status.Signal == "" {
+			status.Signal = strings.ToUpper(ws.Signal().String())
+		}
+	}
+	return Response{status: status, err: err}
+}
@@ -0,0 +1,827 @@
+package ssh
+
+import (
+	"golang.org/x/net/context"
+
+	"bytes"
+	"fmt"
+	"os"
+	"path"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+const (
+	// Last line printed by module script that changed something
+	MODULE_CHANGED = "machine-changed"
+
+	// Line printed by module script ahead of its diff
+	MODULE_DIFF = "machine-diff"
+)
+
+// Module is a declarative Action: it looks at the state of remote host first
+// and changes only what differs, so that running it again is safe
+type Module interface {
+	// Describe module for output
+	String() string
+
+	// Bring remote host to the declared state, reporting whether anything
+	// had to change along with diff of file content and commands run for
+	// it.  In check mode nothing is changed, only reported.
+	Apply(ctx context.Context, cmdr Commander, vars map[string]interface{}, check bool) (changed bool, diff string, err error)
+}
+
+// Modules of an Action, at most one is set
+type Modules struct {
+	File       *FileModule       `yaml:"file,omitempty"`
+	Copy       *CopyModule       `yaml:"copy,omitempty"`
+	LineInFile *LineInFileModule `yaml:"lineinfile,omitempty"`
+	Apt        *PackageModule    `yaml:"apt,omitempty"`
+	Yum        *PackageModule    `yaml:"yum,omitempty"`
+	Service    *ServiceModule    `yaml:"service,omitempty"`
+	User       *UserModule       `yaml:"user,omitempty"`
+	Sysctl     *SysctlModule     `yaml:"sysctl,omitempty"`
+	Mount      *MountModule      `yaml:"mount,omitempty"`
+}
+
+// TemplateSpec is `template` of an Action: true on a script to expand its
+// content as text/template, or a mapping as for copy to render a template
+// file onto remote host
+type TemplateSpec struct {
+	Script bool
+	Module *CopyModule
+}
+
+func (t *TemplateSpec) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	if err := unmarshal(&t.Script); err == nil {
+		return nil
+	}
+	t.Module = &CopyModule{template: true}
+	return unmarshal(t.Module)
+}
+
+// Names is a list of names, given in YAML as a list or a comma separated
+// string
+type Names []string
+
+func (n *Names) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	list, err := unmarshalList(unmarshal)
+	*n = list
+	return err
+}
+
+// Module reports module this Action runs, nil for cmd and script
+func (a Action) Module() Module {
+	if a.Template.Module != nil {
+		return a.Template.Module
+	}
+	var mods = reflect.ValueOf(a.Modules)
+	for idx := 0; idx < mods.NumField(); idx++ {
+		if field := mods.Field(idx); !field.IsNil() {
+			switch spec := field.Interface().(type) {
+			case *PackageModule:
+				return packageModule{spec, strings.Split(mods.Type().Field(idx).Tag.Get("yaml"), ",")[0]}
+			case Module:
+				return spec
+			}
+		}
+	}
+	return nil
+}
+
+// Apply runs module of this Action, elevated when asked to, see CheckMode
+func (a Action) Apply(ctx context.Context, cmdr Commander) (changed bool, diff string, err error) {
+	var mod = a.Module()
+	if mod == nil {
+		return false, "", ErrNoModule
+	}
+	if a.Sudo || a.BecomeUser != "" {
+		defer cmdr.SudoAs(a.BecomeUser).StepDown()
+	}
+	return mod.Apply(ctx, cmdr, a.vars, a.check)
+}
+
+// CheckMode returns copy of Action whose module only reports what it would
+// change
+func (a Action) CheckMode() Action {
+	a.check = true
+	return a
+}
+
+// renderModules expands every string of the module set as text/template
+func (a *Action) renderModules(vars map[string]interface{}) error {
+	var mods = reflect.ValueOf(&a.Modules).Elem()
+	for idx := 0; idx < mods.NumField(); idx++ {
+		if field := mods.Field(idx); !field.IsNil() {
+			rendered, err := renderStruct(field.Interface(), vars)
+			if err != nil {
+				return err
+			}
+			field.Set(reflect.ValueOf(rendered))
+		}
+	}
+	if a.Template.Module != nil {
+		rendered, err := renderStruct(a.Template.Module, vars)
+		if err != nil {
+			return err
+		}
+		a.Template.Module = rendered.(*CopyModule)
+	}
+	return nil
+}
+
+// renderStruct returns copy of struct pointed to by spec with its string and
+// string list fields expanded as text/template
+func renderStruct(spec interface{}, vars map[string]interface{}) (interface{}, error) {
+	var (
+		orig = reflect.ValueOf(spec).Elem()
+		dup  = reflect.New(orig.Type()).Elem()
+	)
+	dup.Set(orig)
+	for idx := 0; idx < dup.NumField(); idx++ {
+		var (
+			field = dup.Field(idx)
+			name  = strings.Split(dup.Type().Field(idx).Tag.Get("yaml"), ",")[0]
+		)
+		if !field.CanSet() {
+			continue
+		}
+		switch {
+		case field.Kind() == reflect.String:
+			text, err := render(name, field.String(), vars)
+			if err != nil {
+				return nil, fmt.Errorf("Unable to render %s: %v", name, err)
+			}
+			field.SetString(text)
+		case field.Kind() == reflect.Slice && field.Type().Elem().Kind() == reflect.String:
+			list := reflect.MakeSlice(field.Type(), field.Len(), field.Len())
+			for jdx := 0; jdx < field.Len(); jdx++ {
+				text, err := render(name, field.Index(jdx).String(), vars)
+				if err != nil {
+					return nil, fmt.Errorf("Unable to render %s: %v", name, err)
+				}
+				list.Index(jdx).SetString(text)
+			}
+			field.Set(list)
+		}
+	}
+	return dup.Addr().Interface(), nil
+}
+
+// moduleFuncs are shell functions for module script: apply runs command
+// unless in check mode, and commit puts content of $tmp at file, each noting
+// what it does for the diff
+const moduleFuncs = `work=$(mktemp -d); trap 'rm -rf "$work"' EXIT
+tmp="$work/content"; : > "$work/diff"
+apply() { printf '%s\n' "$*" >> "$work/diff"; [ -n "$check" ] || "$@"; }
+commit() {
+	from="$1"; [ -e "$1" ] || from=/dev/null
+	diff -u -L "$1" -L "$1" "$from" "$tmp" >> "$work/diff" || true
+	[ -n "$check" ] || cat "$tmp" > "$1"
+}
+`
+
+// runModule runs shell script body on remote host.  body sets changed=1 once
+// it made a change, and fails on the first failing command.  Changes go
+// through apply and commit of moduleFuncs, skipped in check mode.
+func runModule(ctx context.Context, cmdr Commander, body string, check bool) (changed bool, diff string, err error) {
+	var script = "set -e\nchanged=\ncheck=\n"
+	if check {
+		script = "set -e\nchanged=\ncheck=1\n"
+	}
+	script += moduleFuncs + body + "\necho " + MODULE_DIFF + "; cat \"$work/diff\"\n" +
+		"if [ -n \"$changed\" ]; then echo " + MODULE_CHANGED + "; fi\n"
+	output, err := cmdr.RunContext(ctx, "sh -c "+Quote(script))
+	if err != nil {
+		if output = strings.TrimRight(output, "\n"); output != "" {
+			return false, "", fmt.Errorf("%v - %s", err, output)
+		}
+		return false, "", err
+	}
+	if idx := strings.LastIndex(output, MODULE_DIFF+"\n"); idx >= 0 {
+		output = output[idx+len(MODULE_DIFF)+1:]
+	}
+	if strings.HasSuffix(output, MODULE_CHANGED+"\n") {
+		changed, output = true, strings.TrimSuffix(output, MODULE_CHANGED+"\n")
+	}
+	return changed, output, nil
+}
+
+// quoteList quotes each item for shell
+func quoteList(items []string) string {
+	var quoted = make([]string, len(items))
+	for idx, item := range items {
+		quoted[idx] = Quote(item)
+	}
+	return strings.Join(quoted, " ")
+}
+
+// parseMode reads octal permission such as "0644", formatted as stat -c %a
+// reports it
+func parseMode(mode string) (string, error) {
+	perm, err := strconv.ParseUint(mode, 8, 32)
+	if err != nil || perm > 07777 {
+		return "", fmt.Errorf("Invalid mode %q", mode)
+	}
+	return strconv.FormatUint(perm, 8), nil
+}
+
+// attrScript brings mode, owner and group of file p in line, each when given
+func attrScript(p, mode, owner, group string) (string, error) {
+	var b bytes.Buffer
+	if mode != "" {
+		perm, err := parseMode(mode)
+		if err != nil {
+			return "", err
+		}
+		fmt.Fprintf(&b, "[ \"$(stat -c %%a %s)\" = %s ] || { apply chmod %s %s; changed=1; }\n", Quote(p), perm, perm, Quote(p))
+	}
+	if owner != "" {
+		fmt.Fprintf(&b, "[ \"$(stat -c %%U %s)\" = %s ] || { apply chown %s %s; changed=1; }\n", Quote(p), Quote(owner), Quote(owner), Quote(p))
+	}
+	if group != "" {
+		fmt.Fprintf(&b, "[ \"$(stat -c %%G %s)\" = %s ] || { apply chgrp %s %s; changed=1; }\n", Quote(p), Quote(group), Quote(group), Quote(p))
+	}
+	return b.String(), nil
+}
+
+// FileModule makes sure path is a file, directory or link, or is absent,
+// with given mode and ownership
+type FileModule struct {
+	Path string `yaml:"path"`
+
+	// file (default), directory, touch, link or absent
+	State string `yaml:"state,omitempty"`
+
+	// Where link points to
+	Src string `yaml:"src,omitempty"`
+
+	Mode  string `yaml:"mode,omitempty"`
+	Owner string `yaml:"owner,omitempty"`
+	Group string `yaml:"group,omitempty"`
+}
+
+func (m *FileModule) String() string {
+	return fmt.Sprintf("file %s state=%s", m.Path, m.state())
+}
+
+func (m *FileModule) state() string {
+	if m.State == "" {
+		return "file"
+	}
+	return m.State
+}
+
+func (m *FileModule) script() (string, error) {
+	var (
+		p    = Quote(m.Path)
+		body string
+	)
+	switch m.state() {
+	case "file":
+		body = fmt.Sprintf("[ -f %s ] || { echo %s >&2; exit 1; }\n", p, Quote(m.Path+" is not a file"))
+	case "directory":
+		body = fmt.Sprintf("[ -d %s ] || { apply mkdir -p %s; changed=1; }\n", p, p)
+	case "touch":
+		body = fmt.Sprintf("[ -e %s ] || { apply touch %s; changed=1; }\n", p, p)
+	case "link":
+		if m.Src == "" {
+			return "", fmt.Errorf("file %s: link needs src", m.Path)
+		}
+		return fmt.Sprintf("[ \"$(readlink %s)\" = %s ] || { apply ln -sfn %s %s; changed=1; }\n", p, Quote(m.Src), Quote(m.Src), p), nil
+	case "absent":
+		return fmt.Sprintf("if [ -e %s ] || [ -L %s ]; then apply rm -rf %s; changed=1; fi\n", p, p, p), nil
+	default:
+		return "", fmt.Errorf("file %s: unknown state %q", m.Path, m.State)
+	}
+	attrs, err := attrScript(m.Path, m.Mode, m.Owner, m.Group)
+	return body + attrs, err
+}
+
+func (m *FileModule) Apply(ctx context.Context, cmdr Commander, vars map[string]interface{}, check bool) (bool, string, error) {
+	body, err := m.script()
+	if err != nil {
+		return false, "", err
+	}
+	return runModule(ctx, cmdr, body, check)
+}
+
+// CopyModule puts local file src, or content, at dest on remote host when
+// their checksums differ.  Used as template, src is expanded as
+// text/template first.
+type CopyModule struct {
+	Src     string `yaml:"src,omitempty"`
+	Content string `yaml:"content,omitempty"`
+
+	// Remote file, or directory to put src into when ending with "/"
+	Dest string `yaml:"dest"`
+
+	Mode  string `yaml:"mode,omitempty"`
+	Owner string `yaml:"owner,omitempty"`
+	Group string `yaml:"group,omitempty"`
+
+	template bool
+}
+
+func (m *CopyModule) String() string {
+	var kind = "copy"
+	if m.template {
+		kind = "template"
+	}
+	if m.Src == "" {
+		return fmt.Sprintf("%s content %s", kind, m.dest())
+	}
+	return fmt.Sprintf("%s %s %s", kind, m.Src, m.dest())
+}
+
+func (m *CopyModule) dest() string {
+	if strings.HasSuffix(m.Dest, "/") && m.Src != "" {
+		return path.Join(m.Dest, path.Base(m.Src))
+	}
+	return m.Dest
+}
+
+// content reports what dest should hold
+func (m *CopyModule) content(vars map[string]interface{}) ([]byte, error) {
+	switch {
+	case m.Src == "":
+		return []byte(m.Content), nil
+	case m.template:
+		return renderFile(m.Src, vars)
+	default:
+		return readLocal(m.Src)
+	}
+}
+
+func (m *CopyModule) Apply(ctx context.Context, cmdr Commander, vars map[string]interface{}, check bool) (bool, string, error) {
+	var (
+		dest = m.dest()
+		mode = os.FileMode(0644)
+	)
+	if dest == "" {
+		return false, "", fmt.Errorf("%s: dest is required", m)
+	}
+	if m.Src != "" {
+		mode = localMode(m.Src, mode)
+	}
+	content, err := m.content(vars)
+	if err != nil {
+		return false, "", err
+	}
+	if m.Mode != "" {
+		perm, err := strconv.ParseUint(m.Mode, 8, 32)
+		if err != nil {
+			return false, "", fmt.Errorf("Invalid mode %q", m.Mode)
+		}
+		mode = os.FileMode(perm)
+	}
+	changed, diff, err := checkFile(ctx, cmdr, dest, content)
+	if err != nil {
+		return false, "", err
+	}
+	if m.Src != "" {
+		diff = hideDiff(m.Src, dest, diff)
+	}
+	if changed && !check {
+		if err = cmdr.CopyContext(ctx, bytes.NewReader(content), int64(len(content)), dest, mode); err != nil {
+			return false, diff, err
+		}
+	}
+	attrs, err := attrScript(dest, m.Mode, m.Owner, m.Group)
+	if err != nil || attrs == "" {
+		return changed, diff, err
+	}
+	attrChanged, attrDiff, err := runModule(ctx, cmdr, attrs, check)
+	return changed || attrChanged, diff + attrDiff, err
+}
+
+// LineInFileModule makes sure line is in file at path, replacing the last
+// line matching regexp, or that no such line is there
+type LineInFileModule struct {
+	Path   string `yaml:"path"`
+	Line   string `yaml:"line,omitempty"`
+	Regexp string `yaml:"regexp,omitempty"`
+
+	// present (default) or absent
+	State string `yaml:"state,omitempty"`
+
+	// Create file when missing
+	Create bool `yaml:"create,omitempty"`
+}
+
+func (m *LineInFileModule) String() string {
+	if m.State == "absent" {
+		return fmt.Sprintf("lineinfile %s absent %q", m.Path, m.Regexp+m.Line)
+	}
+	return fmt.Sprintf("lineinfile %s %q", m.Path, m.Line)
+}
+
+func (m *LineInFileModule) script() (string, error) {
+	var (
+		b bytes.Buffer
+		p = Quote(m.Path)
+	)
+	fmt.Fprintf(&b, "MACHINE_LINE=%s MACHINE_RE=%s; export MACHINE_LINE MACHINE_RE\n", Quote(m.Line), Quote(m.Regexp))
+	switch m.State {
+	case "", "present":
+		if !m.Create {
+			fmt.Fprintf(&b, "[ -e %s ] || { echo %s >&2; exit 1; }\n", p, Quote(m.Path+" does not exist"))
+		}
+		fmt.Fprintf(&b, `if [ -e %[1]s ] && grep -qxF -- "$MACHINE_LINE" %[1]s; then
+	:
+elif [ -e %[1]s ] && [ -n "$MACHINE_RE" ] && grep -qE -- "$MACHINE_RE" %[1]s; then
+	awk '$0 ~ ENVIRON["MACHINE_RE"] { n = NR } { l[NR] = $0 } END { for (i = 1; i <= NR; i++) print (i == n ? ENVIRON["MACHINE_LINE"] : l[i]) }' %[1]s > "$tmp"
+	commit %[1]s; changed=1
+else
+	if [ -e %[1]s ]; then
+		cat %[1]s
+		if [ -n "$(tail -c1 %[1]s)" ]; then echo; fi
+	fi > "$tmp"
+	printf '%%s\n' "$MACHINE_LINE" >> "$tmp"
+	commit %[1]s; changed=1
+fi
+`, p)
+	case "absent":
+		var match = `-xF -- "$MACHINE_LINE"`
+		if m.Regexp != "" {
+			match = `-E -- "$MACHINE_RE"`
+		}
+		fmt.Fprintf(&b, `if [ -e %[1]s ] && grep -q %[2]s %[1]s; then
+	grep -v %[2]s %[1]s > "$tmp" || true
+	commit %[1]s; changed=1
+fi
+`, p, match)
+	default:
+		return "", fmt.Errorf("lineinfile %s: unknown state %q", m.Path, m.State)
+	}
+	return b.String(), nil
+}
+
+func (m *LineInFileModule) Apply(ctx context.Context, cmdr Commander, vars map[string]interface{}, check bool) (bool, string, error) {
+	body, err := m.script()
+	if err != nil {
+		return false, "", err
+	}
+	return runModule(ctx, cmdr, body, check)
+}
+
+// PackageModule makes sure packages are installed, up to date or removed,
+// through apt or yum
+type PackageModule struct {
+	Name Names `yaml:"name"`
+
+	// present (default), latest or absent
+	State string `yaml:"state,omitempty"`
+
+	// Refresh package index first, apt only
+	UpdateCache bool `yaml:"update_cache,omitempty"`
+}
+
+// packageModule is PackageModule bound to its package manager
+type packageModule struct {
+	*PackageModule
+	manager string
+}
+
+func (m packageModule) String() string {
+	var state = m.State
+	if state == "" {
+		state = "present"
+	}
+	return fmt.Sprintf("%s %s state=%s", m.manager, strings.Join(m.Name, ","), state)
+}
+
+func (m packageModule) script() (string, error) {
+	var (
+		b    bytes.Buffer
+		pkgs = quoteList(m.Name)
+	)
+	if m.manager == "apt" {
+		b.WriteString("DEBIAN_FRONTEND=noninteractive; export DEBIAN_FRONTEND\n")
+		b.WriteString("installed() { dpkg-query -W -f='${Status}' \"$1\" 2>/dev/null | grep -q 'ok installed'; }\n")
+		b.WriteString("outdated() { apt-get -s install \"$1\" 2>/dev/null | grep -q '^Inst '; }\n")
+		b.WriteString("pkg_install() { apply apt-get install -y -q \"$@\"; }\n")
+		b.WriteString("pkg_remove() { apply apt-get remove -y -q \"$@\"; }\n")
+		if m.UpdateCache {
+			b.WriteString("apply apt-get update -q >/dev/null\n")
+		}
+	} else {
+		b.WriteString("installed() { rpm -q \"$1\" >/dev/null 2>&1; }\n")
+		b.WriteString("outdated() { rc=0; yum -q check-update \"$1\" >/dev/null 2>&1 || rc=$?; [ $rc -eq 100 ]; }\n")
+		b.WriteString("pkg_install() { apply yum install -y -q \"$@\"; }\n")
+		b.WriteString("pkg_remove() { apply yum remove -y -q \"$@\"; }\n")
+	}
+	b.WriteString("pending=\n")
+	switch m.State {
+	case "", "present":
+		fmt.Fprintf(&b, "for pkg in %s; do installed \"$pkg\" || pending=\"$pending $pkg\"; done\n", pkgs)
+		b.WriteString("if [ -n \"$pending\" ]; then pkg_install $pending; changed=1; fi\n")
+	case "latest":
+		fmt.Fprintf(&b, "for pkg in %s; do if ! installed \"$pkg\" || outdated \"$pkg\"; then pending=\"$pending $pkg\"; fi; done\n", pkgs)
+		b.WriteString("if [ -n \"$pending\" ]; then pkg_install $pending; changed=1; fi\n")
+	case "absent":
+		fmt.Fprintf(&b, "for pkg in %s; do if installed \"$pkg\"; then pending=\"$pending $pkg\"; fi; done\n", pkgs)
+		b.WriteString("if [ -n \"$pending\" ]; then pkg_remove $pending; changed=1; fi\n")
+	default:
+		return "", fmt.Errorf("%s: unknown state %q", m.manager, m.State)
+	}
+	return b.String(), nil
+}
+
+func (m packageModule) Apply(ctx context.Context, cmdr Commander, vars map[string]interface{}, check bool) (bool, string, error) {
+	body, err := m.script()
+	if err != nil {
+		return false, "", err
+	}
+	return runModule(ctx, cmdr, body, check)
+}
+
+// ServiceModule makes sure service is running or not, and whether it starts
+// on boot, through systemd or sysvinit
+type ServiceModule struct {
+	Name string `yaml:"name"`
+
+	// started, stopped, restarted or reloaded
+	State string `yaml:"state,omitempty"`
+
+	// Start on boot, left alone when not given
+	Enabled *bool `yaml:"enabled,omitempty"`
+}
+
+func (m *ServiceModule) String() string {
+	var desc = "service " + m.Name
+	if m.State != "" {
+		desc += " state=" + m.State
+	}
+	if m.Enabled != nil {
+		desc += fmt.Sprintf(" enabled=%v", *m.Enabled)
+	}
+	return desc
+}
+
+const serviceFuncs = `if [ -d /run/systemd/system ]; then
+	svc_active() { systemctl is-active --quiet "$svc"; }
+	svc_ctl() { apply systemctl "$1" "$svc"; }
+	svc_enabled() { systemctl is-enabled --quiet "$svc"; }
+	svc_enable() { apply systemctl enable "$svc"; }
+	svc_disable() { apply systemctl disable "$svc"; }
+else
+	svc_active() { service "$svc" status >/dev/null 2>&1; }
+	svc_ctl() { apply service "$svc" "$1"; }
+	svc_enabled() { ls /etc/rc[2345].d/S??"$svc" /etc/rc.d/rc[2345].d/S??"$svc" >/dev/null 2>&1; }
+	if command -v update-rc.d >/dev/null 2>&1; then
+		svc_enable() { apply update-rc.d "$svc" defaults; }
+		svc_disable() { apply update-rc.d -f "$svc" remove; }
+	else
+		svc_enable() { apply chkconfig "$svc" on; }
+		svc_disable() { apply chkconfig "$svc" off; }
+	fi
+fi
+`
+
+func (m *ServiceModule) script() (string, error) {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "svc=%s\n", Quote(m.Name))
+	b.WriteString(serviceFuncs)
+	switch m.State {
+	case "":
+	case "started":
+		b.WriteString("svc_active || { svc_ctl start; changed=1; }\n")
+	case "stopped":
+		b.WriteString("if svc_active; then svc_ctl stop; changed=1; fi\n")
+	case "restarted":
+		b.WriteString("svc_ctl restart; changed=1\n")
+	case "reloaded":
+		b.WriteString("svc_ctl reload; changed=1\n")
+	default:
+		return "", fmt.Errorf("service %s: unknown state %q", m.Name, m.State)
+	}
+	if m.Enabled != nil {
+		if *m.Enabled {
+			b.WriteString("svc_enabled || { svc_enable; changed=1; }\n")
+		} else {
+			b.WriteString("if svc_enabled; then svc_disable; changed=1; fi\n")
+		}
+	}
+	return b.String(), nil
+}
+
+func (m *ServiceModule) Apply(ctx context.Context, cmdr Commander, vars map[string]interface{}, check bool) (bool, string, error) {
+	body, err := m.script()
+	if err != nil {
+		return false, "", err
+	}
+	return runModule(ctx, cmdr, body, check)
+}
+
+// UserModule makes sure user account exists with shell, home and
+// supplementary groups, or is removed
+type UserModule struct {
+	Name string `yaml:"name"`
+
+	// present (default) or absent
+	State string `yaml:"state,omitempty"`
+
+	// Supplementary groups to add user to, others are left alone
+	Groups Names  `yaml:"groups,omitempty"`
+	Shell  string `yaml:"shell,omitempty"`
+	Home   string `yaml:"home,omitempty"`
+	System bool   `yaml:"system,omitempty"`
+
+	// Remove home directory along with absent user
+	Remove bool `yaml:"remove,omitempty"`
+}
+
+func (m *UserModule) String() string {
+	var state = m.State
+	if state == "" {
+		state = "present"
+	}
+	return fmt.Sprintf("user %s state=%s", m.Name, state)
+}
+
+func (m *UserModule) script() (string, error) {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "u=%s\n", Quote(m.Name))
+	switch m.State {
+	case "", "present":
+		var opts = "-m"
+		if m.System {
+			opts = "-r"
+		}
+		if m.Shell != "" {
+			opts += " -s " + Quote(m.Shell)
+		}
+		if m.Home != "" {
+			opts += " -d " + Quote(m.Home)
+		}
+		if len(m.Groups) > 0 {
+			opts += " -G " + Quote(strings.Join(m.Groups, ","))
+		}
+		fmt.Fprintf(&b, "if ! id -u \"$u\" >/dev/null 2>&1; then apply useradd %s \"$u\"; changed=1; fi\n", opts)
+		if m.Shell != "" {
+			fmt.Fprintf(&b, "[ \"$(getent passwd \"$u\" | cut -d: -f7)\" = %s ] || { apply usermod -s %s \"$u\"; changed=1; }\n", Quote(m.Shell), Quote(m.Shell))
+		}
+		if m.Home != "" {
+			fmt.Fprintf(&b, "[ \"$(getent passwd \"$u\" | cut -d: -f6)\" = %s ] || { apply usermod -d %s -m \"$u\"; changed=1; }\n", Quote(m.Home), Quote(m.Home))
+		}
+		if len(m.Groups) > 0 {
+			fmt.Fprintf(&b, "for g in %s; do id -nG \"$u\" | tr ' ' '\\n' | grep -qx \"$g\" || { apply usermod -aG \"$g\" \"$u\"; changed=1; }; done\n", quoteList(m.Groups))
+		}
+	case "absent":
+		var opts string
+		if m.Remove {
+			opts = "-r "
+		}
+		fmt.Fprintf(&b, "if id -u \"$u\" >/dev/null 2>&1; then apply userdel %s\"$u\"; changed=1; fi\n", opts)
+	default:
+		return "", fmt.Errorf("user %s: unknown state %q", m.Name, m.State)
+	}
+	return b.String(), nil
+}
+
+func (m *UserModule) Apply(ctx context.Context, cmdr Commander, vars map[string]interface{}, check bool) (bool, string, error) {
+	body, err := m.script()
+	if err != nil {
+		return false, "", err
+	}
+	return runModule(ctx, cmdr, body, check)
+}
+
+// SysctlModule keeps kernel parameter in sysctl file and, unless told not
+// to, sets it on the running kernel
+type SysctlModule struct {
+	Name  string `yaml:"name"`
+	Value string `yaml:"value,omitempty"`
+
+	// present (default) or absent
+	State string `yaml:"state,omitempty"`
+
+	// File to keep setting in, /etc/sysctl.conf by default
+	File string `yaml:"sysctl_file,omitempty"`
+
+	// Set value on running kernel too, true by default
+	Reload *bool `yaml:"reload,omitempty"`
+}
+
+func (m *SysctlModule) String() string {
+	if m.State == "absent" {
+		return fmt.Sprintf("sysctl %s absent", m.Name)
+	}
+	return fmt.Sprintf("sysctl %s = %s", m.Name, m.Value)
+}
+
+func (m *SysctlModule) script() (string, error) {
+	var file = m.File
+	if file == "" {
+		file = "/etc/sysctl.conf"
+	}
+	line := LineInFileModule{
+		Path:   file,
+		Line:   m.Name + " = " + m.Value,
+		Regexp: "^[[:space:]]*" + regexp.QuoteMeta(m.Name) + "[[:space:]]*=",
+		State:  m.State,
+		Create: true,
+	}
+	body, err := line.script()
+	if err != nil || m.State == "absent" || (m.Reload != nil && !*m.Reload) {
+		return body, err
+	}
+	body += fmt.Sprintf("[ \"$(sysctl -n %s | tr -s ' \\t' ' ')\" = \"$(echo %s | tr -s ' \\t' ' ')\" ] || { apply sysctl -q -w %s >/dev/null; changed=1; }\n",
+		Quote(m.Name), Quote(m.Value), Quote(m.Name+"="+m.Value))
+	return body, nil
+}
+
+func (m *SysctlModule) Apply(ctx context.Context, cmdr Commander, vars map[string]interface{}, check bool) (bool, string, error) {
+	body, err := m.script()
+	if err != nil {
+		return false, "", err
+	}
+	return runModule(ctx, cmdr, body, check)
+}
+
+// MountModule keeps file system in fstab and mounts or unmounts it; swap is
+// turned on instead of mounted
+type MountModule struct {
+	Path   string `yaml:"path"`
+	Src    string `yaml:"src"`
+	Fstype string `yaml:"fstype"`
+	Opts   string `yaml:"opts,omitempty"`
+	Dump   string `yaml:"dump,omitempty"`
+	Passno string `yaml:"passno,omitempty"`
+
+	// mounted (default), present, unmounted or absent
+	State string `yaml:"state,omitempty"`
+
+	// /etc/fstab by default
+	Fstab string `yaml:"fstab,omitempty"`
+}
+
+func (m *MountModule) String() string {
+	var state = m.State
+	if state == "" {
+		state = "mounted"
+	}
+	return fmt.Sprintf("mount %s %s state=%s", m.Src, m.Path, state)
+}
+
+func (m *MountModule) script() (string, error) {
+	var (
+		fstab = m.Fstab
+		entry = []string{m.Src, m.Path, m.Fstype, m.Opts, m.Dump, m.Passno}
+	)
+	if fstab == "" {
+		fstab = "/etc/fstab"
+	}
+	for idx, def := range []string{"", "", "", "defaults", "0", "0"} {
+		if entry[idx] == "" {
+			entry[idx] = def
+		}
+	}
+	line := LineInFileModule{
+		Path:   fstab,
+		Line:   strings.Join(entry, " "),
+		Regexp: "^[^#[:space:]]+[[:space:]]+" + regexp.QuoteMeta(m.Path) + "[[:space:]]",
+	}
+	mounted := fmt.Sprintf("MACHINE_PATH=%s; export MACHINE_PATH\n", Quote(m.Path)) +
+		"is_mounted() { awk '$2 == ENVIRON[\"MACHINE_PATH\"] { found = 1 } END { exit !found }' /proc/mounts; }\n"
+	mount := "apply mkdir -p \"$MACHINE_PATH\"; apply mount \"$MACHINE_PATH\""
+	umount := "apply umount \"$MACHINE_PATH\""
+	if m.Fstype == "swap" {
+		// swap shares mount point "none", tell entries apart by device
+		line.Regexp = "^" + regexp.QuoteMeta(m.Src) + "[[:space:]]"
+		mounted = fmt.Sprintf("MACHINE_PATH=%s; export MACHINE_PATH\n", Quote(m.Src)) +
+			"is_mounted() { awk '$1 == ENVIRON[\"MACHINE_PATH\"] { found = 1 } END { exit !found }' /proc/swaps; }\n"
+		mount, umount = "apply swapon \"$MACHINE_PATH\"", "apply swapoff \"$MACHINE_PATH\""
+	}
+
+	switch m.State {
+	case "", "mounted", "present":
+		if m.Src == "" || m.Fstype == "" {
+			return "", fmt.Errorf("mount %s: src and fstype are required", m.Path)
+		}
+		body, err := line.script()
+		if err != nil || m.State == "present" {
+			return body, err
+		}
+		return body + mounted + "is_mounted || { " + mount + "; changed=1; }\n", nil
+	case "unmounted":
+		return mounted + "if is_mounted; then " + umount + "; changed=1; fi\n", nil
+	case "absent":
+		line.State = "absent"
+		body, err := line.script()
+		return mounted + "if is_mounted; then " + umount + "; changed=1; fi\n" + body, err
+	default:
+		return "", fmt.Errorf("mount %s: unknown state %q", m.Path, m.State)
+	}
+}
+
+func (m *MountModule) Apply(ctx context.Context, cmdr Commander, vars map[string]interface{}, check bool) (bool, string, error) {
+	body, err := m.script()
+	if err != nil {
+		return false, "", err
+	}
+	return runModule(ctx, cmdr, body, check)
+}
@@ -0,0 +1,194 @@
+package ssh
+
+import (
+	"github.com/jeffjen/yaml"
+	"golang.org/x/net/context"
+
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// applyTwice applies a and reports whether each of two runs changed anything
+func applyTwice(t *testing.T, cmdr Commander, a Action) (first, second bool) {
+	var err error
+	if first, _, err = a.Apply(context.Background(), cmdr); err != nil {
+		t.Fatalf("%s: %v", a.Command(), err)
+	}
+	if second, _, err = a.Apply(context.Background(), cmdr); err != nil {
+		t.Fatalf("%s: %v", a.Command(), err)
+	}
+	return
+}
+
+func TestModuleDecode(t *testing.T) {
+	var actions []Action
+	err := yaml.Unmarshal([]byte(`
+- apt: {name: "curl, jq", state: latest}
+- template: {src: app.conf.tmpl, dest: /etc/app.conf}
+- script: setup
+  template: true
+- service: {name: docker, state: started, enabled: true}
+`), &actions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := actions[0].Command(); got != "apt curl,jq state=latest" {
+		t.Errorf("unexpected apt module %q", got)
+	}
+	if got := actions[1].Command(); got != "template app.conf.tmpl /etc/app.conf" {
+		t.Errorf("unexpected template module %q", got)
+	}
+	if !actions[2].Template.Script || actions[2].Module() != nil {
+		t.Errorf("expected script marked as template, got %+v", actions[2].Template)
+	}
+	if got := actions[3].Command(); got != "service docker state=started enabled=true" {
+		t.Errorf("unexpected service module %q", got)
+	}
+}
+
+func TestFileModule(t *testing.T) {
+	dir, err := ioutil.TempDir("", "module")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	cmdr := NewLocal()
+
+	data := filepath.Join(dir, "data")
+	if first, second := applyTwice(t, cmdr, Action{Modules: Modules{File: &FileModule{Path: data, State: "directory", Mode: "0750"}}}); !first || second {
+		t.Errorf("expected change on first run only, got %v, %v", first, second)
+	}
+	if info, err := os.Stat(data); err != nil || !info.IsDir() || info.Mode().Perm() != 0750 {
+		t.Errorf("unexpected directory %v, %v", info, err)
+	}
+	link := filepath.Join(dir, "current")
+	if first, second := applyTwice(t, cmdr, Action{Modules: Modules{File: &FileModule{Path: link, State: "link", Src: data}}}); !first || second {
+		t.Errorf("expected change on first run only, got %v, %v", first, second)
+	}
+	if first, second := applyTwice(t, cmdr, Action{Modules: Modules{File: &FileModule{Path: link, State: "absent"}}}); !first || second {
+		t.Errorf("expected change on first run only, got %v, %v", first, second)
+	}
+	if _, _, err := (Action{Modules: Modules{File: &FileModule{Path: link}}}).Apply(context.Background(), cmdr); err == nil {
+		t.Error("expected missing file to fail")
+	}
+}
+
+func TestCopyModule(t *testing.T) {
+	dir, err := ioutil.TempDir("", "module")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	cmdr := NewLocal()
+
+	src := filepath.Join(dir, "app.conf.tmpl")
+	ioutil.WriteFile(src, []byte("port={{.port}}\n"), 0644)
+	dest := filepath.Join(dir, "etc", "app.conf")
+
+	steps, err := (Action{Template: TemplateSpec{Module: &CopyModule{Src: src, Dest: dest, Mode: "0600", template: true}}}).Expand(map[string]interface{}{"port": 8080})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first, second := applyTwice(t, cmdr, steps[0]); !first || second {
+		t.Errorf("expected change on first run only, got %v, %v", first, second)
+	}
+	if data, _ := ioutil.ReadFile(dest); string(data) != "port=8080\n" {
+		t.Errorf("unexpected content %q", data)
+	}
+	if info, _ := os.Stat(dest); info.Mode().Perm() != 0600 {
+		t.Errorf("unexpected mode %v", info.Mode())
+	}
+
+	// Copying the template as is differs from what was rendered
+	if first, second := applyTwice(t, cmdr, Action{Modules: Modules{Copy: &CopyModule{Src: src, Dest: dest}}}); !first || second {
+		t.Errorf("expected change on first run only, got %v, %v", first, second)
+	}
+	if data, _ := ioutil.ReadFile(dest); string(data) != "port={{.port}}\n" {
+		t.Errorf("unexpected content %q", data)
+	}
+}
+
+func TestLineInFileModule(t *testing.T) {
+	dir, err := ioutil.TempDir("", "module")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	cmdr := NewLocal()
+
+	fstab := filepath.Join(dir, "fstab")
+	ioutil.WriteFile(fstab, []byte("# static\n/dev/sda1 / ext4 defaults 0 1\n/dev/old /data ext4 ro 0 0"), 0644)
+
+	mount := Action{Modules: Modules{Mount: &MountModule{Path: "/data", Src: "/dev/mapper/data-docker", Fstype: "ext4", Opts: "rw", State: "present", Fstab: fstab}}}
+	if first, second := applyTwice(t, cmdr, mount); !first || second {
+		t.Errorf("expected change on first run only, got %v, %v", first, second)
+	}
+	swap := Action{Modules: Modules{Mount: &MountModule{Path: "none", Src: "/swapfile", Fstype: "swap", Opts: "sw", State: "present", Fstab: fstab}}}
+	if first, second := applyTwice(t, cmdr, swap); !first || second {
+		t.Errorf("expected change on first run only, got %v, %v", first, second)
+	}
+	want := "# static\n/dev/sda1 / ext4 defaults 0 1\n/dev/mapper/data-docker /data ext4 rw 0 0\n/swapfile none swap sw 0 0\n"
+	if data, _ := ioutil.ReadFile(fstab); string(data) != want {
+		t.Errorf("unexpected fstab %q", data)
+	}
+
+	absent := Action{Modules: Modules{LineInFile: &LineInFileModule{Path: fstab, Regexp: "^/swapfile ", State: "absent"}}}
+	if first, second := applyTwice(t, cmdr, absent); !first || second {
+		t.Errorf("expected change on first run only, got %v, %v", first, second)
+	}
+	if data, _ := ioutil.ReadFile(fstab); strings.Contains(string(data), "swapfile") {
+		t.Errorf("line not removed %q", data)
+	}
+
+	conf := filepath.Join(dir, "sysctl.conf")
+	reload := false
+	sysctl := Action{Modules: Modules{Sysctl: &SysctlModule{Name: "net.ipv4.tcp_rmem", Value: "4096 4096 16777216", File: conf, Reload: &reload}}}
+	if first, second := applyTwice(t, cmdr, sysctl); !first || second {
+		t.Errorf("expected change on first run only, got %v, %v", first, second)
+	}
+	sysctl.Sysctl.Value = "4096 8192 16777216"
+	if first, second := applyTwice(t, cmdr, sysctl); !first || second {
+		t.Errorf("expected change on first run only, got %v, %v", first, second)
+	}
+	if data, _ := ioutil.ReadFile(conf); string(data) != "net.ipv4.tcp_rmem = 4096 8192 16777216\n" {
+		t.Errorf("unexpected sysctl.conf %q", data)
+	}
+
+	missing := Action{Modules: Modules{LineInFile: &LineInFileModule{Path: filepath.Join(dir, "missing"), Line: "x"}}}
+	if _, _, err := missing.Apply(context.Background(), cmdr); err == nil {
+		t.Error("expected missing file to fail without create")
+	}
+}
+
+func TestModuleScript(t *testing.T) {
+	enabled := true
+	cases := []struct {
+		mod interface {
+			script() (string, error)
+		}
+		want []string
+	}{
+		{packageModule{&PackageModule{Name: Names{"curl", "jq"}, UpdateCache: true}, "apt"}, []string{"apt-get update", "dpkg-query", "for pkg in 'curl' 'jq'", "pkg_install $pending"}},
+		{packageModule{&PackageModule{Name: Names{"docker"}, State: "absent"}, "yum"}, []string{"rpm -q", "pkg_remove $pending"}},
+		{&ServiceModule{Name: "docker", State: "started", Enabled: &enabled}, []string{"svc='docker'", "svc_active || { svc_ctl start", "svc_enabled || { svc_enable"}},
+		{&UserModule{Name: "deploy", Groups: Names{"docker"}, Shell: "/bin/bash"}, []string{"useradd -m -s '/bin/bash' -G 'docker'", "usermod -aG", "usermod -s"}},
+		{&MountModule{Path: "/data", Src: "/dev/xvdb", Fstype: "ext4"}, []string{"/dev/xvdb /data ext4 defaults 0 0", "mount \"$MACHINE_PATH\""}},
+	}
+	for _, c := range cases {
+		script, err := c.mod.script()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, want := range c.want {
+			if !strings.Contains(script, want) {
+				t.Errorf("expected %q in script:\n%s", want, script)
+			}
+		}
+	}
+	if _, err := (&ServiceModule{Name: "docker", State: "bogus"}).script(); err == nil {
+		t.Error("expected error for unknown state")
+	}
+}
@@ -1,9 +1,16 @@
 package ssh
 
 import (
+	"github.com/poddworks/machine/lib/vault"
+
+	"golang.org/x/net/context"
+
+	"bytes"
 	"fmt"
+	"os"
 	path "path/filepath"
 	"strings"
+	"time"
 )
 
 const (
@@ -13,6 +20,104 @@ const (
 type Recipe struct {
 	Archive   []Archive   `yaml:"archive,omitempty"`
 	Provision []Provision `yaml:"provision"`
+
+	// Sections run at the end, each once and only when notified, see Notify
+	Handlers []Provision `yaml:"handlers,omitempty"`
+
+	// Roles whose sections run ahead of Provision, see LoadPlaybook
+	Roles []Role `yaml:"roles,omitempty"`
+
+	// Documents of this playbook file stand in for this one
+	Import string `yaml:"import,omitempty"`
+
+	// Run on this machine instead of remote hosts when set to "local"
+	Connection string `yaml:"connection,omitempty"`
+
+	// Variables for rendering, see Render
+	Vars map[string]interface{} `yaml:"vars,omitempty"`
+
+	// Run on hosts matched by these patterns only, see Patterns
+	Hosts Patterns `yaml:"hosts,omitempty"`
+
+	// Gather facts of each host before running, true when not given
+	GatherFacts *bool `yaml:"gather_facts,omitempty"`
+
+	// Run on hosts in rolling batches of this many, or percentage such as
+	// "25%", see BatchSize
+	Serial string `yaml:"serial,omitempty"`
+
+	// Stop batches after one where more than this percentage of hosts
+	// failed, see Aborts
+	MaxFailPercentage *int `yaml:"max_fail_percentage,omitempty"`
+
+	// Variables given to Render, updated as actions register results
+	vars map[string]interface{}
+}
+
+// CheckNotify makes sure every handler notified in Recipe is defined
+func (r Recipe) CheckNotify() error {
+	var defined = make(map[string]bool)
+	for _, h := range r.Handlers {
+		defined[h.Name] = true
+	}
+	var notify []string
+	for _, a := range r.Archive {
+		notify = append(notify, a.Notify...)
+	}
+	for _, p := range append(append([]Provision{}, r.Provision...), r.Handlers...) {
+		for _, a := range p.Archive {
+			notify = append(notify, a.Notify...)
+		}
+		for _, a := range p.Action {
+			notify = append(notify, a.Notify...)
+		}
+	}
+	for _, name := range notify {
+		if !defined[name] {
+			return fmt.Errorf("Notify %q: %v", name, ErrNoHandler)
+		}
+	}
+	return nil
+}
+
+// NextHandler returns the first handler listed that was notified and has
+// not run yet.  Handlers may notify others, so ask again after each run.
+func (r Recipe) NextHandler(notified, ran map[string]bool) (Provision, bool) {
+	for _, h := range r.Handlers {
+		if notified[h.Name] && !ran[h.Name] {
+			return h, true
+		}
+	}
+	return Provision{}, false
+}
+
+// Patterns name hosts by instance or inventory name, group, or label
+// selector key=value.  Given in YAML as a list or a comma separated string.
+type Patterns []string
+
+func (p *Patterns) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	list, err := unmarshalList(unmarshal)
+	*p = list
+	return err
+}
+
+// unmarshalList decodes YAML list of strings, or string of comma separated
+// items
+func unmarshalList(unmarshal func(interface{}) error) ([]string, error) {
+	var list []string
+	if err := unmarshal(&list); err == nil {
+		return list, nil
+	}
+	var spec string
+	if err := unmarshal(&spec); err != nil {
+		return nil, err
+	}
+	for _, item := range strings.Split(spec, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list, nil
 }
 
 type Archive struct {
@@ -22,6 +127,21 @@ type Archive struct {
 	Dir     string `yaml:"dir"`
 	Sudo    bool   `yaml:"sudo"`
 	Skip    bool   `yaml:"skip"`
+
+	// Copy what symbolic links point to when sending a directory
+	Follow bool `yaml:"follow"`
+
+	// Send as this user instead of root, implies sudo
+	BecomeUser string `yaml:"become_user,omitempty"`
+
+	// Expand file content as text/template before sending
+	Template bool `yaml:"template"`
+
+	// Handlers to run once sending changed anything
+	Notify Names `yaml:"notify,omitempty"`
+
+	// Variables given to Render, for expanding content
+	vars map[string]interface{}
 }
 
 func (a Archive) Source(cmdr Commander) string {
@@ -42,8 +162,14 @@ func (a Archive) Dest() string {
 }
 
 func (a Archive) Send(cmdr Commander) error {
-	if a.Sudo {
-		defer cmdr.Sudo().StepDown()
+	return a.SendProgress(cmdr, nil)
+}
+
+// SendProgress is Send reporting bytes sent so far of each file to progress,
+// see TransferOptions
+func (a Archive) SendProgress(cmdr Commander, progress func(name string, done, size int64)) error {
+	if a.Sudo || a.BecomeUser != "" {
+		defer cmdr.SudoAs(a.BecomeUser).StepDown()
 	}
 	if a.Perhost {
 		host, _ := cmdr.Host()
@@ -53,7 +179,40 @@ func (a Archive) Send(cmdr Commander) error {
 		a.Dst = path.Base(a.Src)
 	}
 	dst := path.Join(a.Dir, a.Dst)
-	return cmdr.CopyFile(a.Src, dst, 0644)
+	if info, err := os.Stat(a.Src); err != nil {
+		return err
+	} else if info.IsDir() {
+		if a.Template {
+			return ErrTemplateDir
+		}
+		return cmdr.Upload(a.Src, dst, TransferOptions{FollowSymlinks: a.Follow, Progress: progress, Decrypt: true})
+	}
+	if a.Template || vault.IsEncryptedFile(a.Src) {
+		var (
+			content []byte
+			err     error
+		)
+		if a.Template {
+			content, err = renderFile(a.Src, a.vars)
+		} else {
+			content, err = readLocal(a.Src)
+		}
+		if err != nil {
+			return err
+		}
+		size := int64(len(content))
+		return cmdr.Copy(withProgress(bytes.NewReader(content), dst, size, progress), size, dst, localMode(a.Src, 0644))
+	}
+	file, err := os.Open(a.Src)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	return cmdr.Copy(withProgress(file, dst, info.Size(), progress), info.Size(), dst, 0644)
 }
 
 type Provision struct {
@@ -62,56 +221,231 @@ type Provision struct {
 	Ok2fail bool      `yaml:"ok2fail"`
 	Action  []Action  `yaml:"action"`
 	Skip    bool      `yaml:"skip"`
+
+	// Go through this section only when this text/template pipeline is true
+	When string `yaml:"when,omitempty"`
+
+	// Variables for this section only, over those of the host
+	Vars map[string]interface{} `yaml:"vars,omitempty"`
+
+	// Sections listed in this file stand in for this one, see LoadPlaybook
+	Include string `yaml:"include,omitempty"`
+
+	// Conditions of include or role this section came from
+	conditions []string
 }
 
 func (p Provision) Clean(cmdr Commander) {
+	if local, ok := cmdr.(*LocalCommander); ok {
+		local.CleanTempDir() // owned by us, no need to escalate
+		return
+	}
 	defer cmdr.Sudo().StepDown()
 	cmdr.RunQuiet(fmt.Sprintf("rm -rf %s", TMP_REMOTE_DIR))
 }
 
+// scriptPath is where script is uploaded to for cmdr to run: TMP_REMOTE_DIR
+// on remote, a private directory on local host
+func scriptPath(cmdr Commander, script string) (string, error) {
+	var dir = TMP_REMOTE_DIR
+	if local, ok := cmdr.(*LocalCommander); ok {
+		var err error
+		if dir, err = local.TempDir(); err != nil {
+			return "", err
+		}
+	}
+	return path.Join(dir, path.Base(script)), nil
+}
+
 type Action struct {
 	Cmd    string `yaml:"cmd,omitempty"`
 	Script string `yaml:"script,omitempty"`
 	Shell  bool   `yaml:"shell"`
 	Sudo   bool   `yaml:"sudo"`
 	Skip   bool   `yaml:"skip"`
+
+	// Exit codes besides 0 to count as success
+	Okcodes []int `yaml:"okcodes,omitempty"`
+
+	// Abort action running longer than this duration, e.g. 10m
+	Timeout string `yaml:"timeout,omitempty"`
+
+	// Run as this user instead of root, implies sudo
+	BecomeUser string `yaml:"become_user,omitempty"`
+
+	// Expand script content as text/template before sending, see
+	// TemplateSpec
+	Template TemplateSpec `yaml:"template,omitempty"`
+
+	// Declarative action instead of cmd or script, see Module
+	Modules `yaml:",inline"`
+
+	// Run only when this text/template pipeline is true, see Eval
+	When string `yaml:"when,omitempty"`
+
+	// Run once for each item, bound to .item
+	Loop      []interface{} `yaml:"loop,omitempty"`
+	WithItems []interface{} `yaml:"with_items,omitempty"`
+
+	// Save Result under this variable name for later actions
+	Register string `yaml:"register,omitempty"`
+
+	// Handlers to run once this action reported a change
+	Notify Names `yaml:"notify,omitempty"`
+
+	// Run again up to Retries times, Delay apart, until action succeeds or
+	// Until is true
+	Retries int    `yaml:"retries,omitempty"`
+	Delay   string `yaml:"delay,omitempty"`
+	Until   string `yaml:"until,omitempty"`
+
+	// Variables given to Expand, for expanding content
+	vars map[string]interface{}
+
+	// Report what module would change without changing it, see CheckMode
+	check bool
+}
+
+// Accept reports whether status counts as success for this Action
+func (a Action) Accept(status ExitStatus) bool {
+	if status.Signal != "" {
+		return false
+	}
+	if status.Code == 0 {
+		return true
+	}
+	for _, code := range a.Okcodes {
+		if code == status.Code {
+			return true
+		}
+	}
+	return false
 }
 
 func (a Action) Command() (cmd string) {
+	if mod := a.Module(); mod != nil {
+		return mod.String()
+	}
 	switch {
 	case a.Cmd != "":
 		cmd = a.Cmd
 		break
 	case a.Script != "":
 		dst := path.Join(TMP_REMOTE_DIR, path.Base(a.Script))
-		cmd = fmt.Sprintf("bash %s", dst)
+		cmd = "bash " + Quote(dst)
 		break
 	}
 	return
 }
 
 func (a Action) Act(cmdr Commander) (output <-chan Response, err error) {
+	return a.ActContext(context.Background(), cmdr)
+}
+
+// ActContext runs Action, terminating it when ctx is done or Timeout expires
+func (a Action) ActContext(ctx context.Context, cmdr Commander) (output <-chan Response, err error) {
+	if a.Timeout != "" {
+		timeout, perr := time.ParseDuration(a.Timeout)
+		if perr != nil {
+			return nil, perr
+		}
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer func() {
+			if err != nil || output == nil {
+				cancel()
+			} else {
+				output = cancelOnDrain(output, cancel)
+			}
+		}()
+	}
 	switch {
 	case a.Cmd != "":
-		if a.Sudo {
-			defer cmdr.Sudo().StepDown()
+		if a.Sudo || a.BecomeUser != "" {
+			defer cmdr.SudoAs(a.BecomeUser).StepDown()
 		}
 		if a.Shell {
-			output, err = cmdr.Stream(fmt.Sprintf("bash -c '%s'", a.Cmd))
+			output, err = cmdr.StreamContext(ctx, "bash -c "+Quote(a.Cmd))
 		} else {
-			output, err = cmdr.Stream(a.Cmd)
+			output, err = cmdr.StreamContext(ctx, a.Cmd)
 		}
 		break
 	case a.Script != "":
-		dst := path.Join(TMP_REMOTE_DIR, path.Base(a.Script))
-		err = cmdr.CopyFile(a.Script, dst, 0644)
+		var dst string
+		if dst, err = scriptPath(cmdr, a.Script); err != nil {
+			return nil, err
+		}
+		if a.Template.Script || vault.IsEncryptedFile(a.Script) {
+			var content []byte
+			if a.Template.Script {
+				content, err = renderFile(a.Script, a.vars)
+			} else {
+				content, err = readLocal(a.Script)
+			}
+			if err == nil {
+				err = cmdr.CopyContext(ctx, bytes.NewReader(content), int64(len(content)), dst, localMode(a.Script, 0644))
+			}
+		} else {
+			err = copyFileContext(ctx, cmdr, a.Script, dst, 0644)
+		}
 		if err == nil {
-			if a.Sudo {
-				defer cmdr.Sudo().StepDown()
+			if a.Sudo || a.BecomeUser != "" {
+				defer cmdr.SudoAs(a.BecomeUser).StepDown()
 			}
-			output, err = cmdr.Stream(fmt.Sprintf("bash %s", dst))
+			output, err = cmdr.StreamContext(ctx, "bash "+Quote(dst))
+		}
+		break
+	case a.Module() != nil:
+		var (
+			changed bool
+			diff    string
+		)
+		if changed, diff, err = a.Apply(ctx, cmdr); err != nil {
+			return nil, err
 		}
+		// Report diff line by line, then outcome as the last line of output
+		var (
+			lines  = splitLines([]byte(diff))
+			stream = make(chan Response, len(lines)+2)
+			text   = "ok"
+		)
+		for _, line := range lines {
+			stream <- Response{text: strings.TrimSuffix(line, "\n"), source: STDOUT}
+		}
+		if changed {
+			text = "changed"
+		}
+		stream <- Response{text: text, source: STDOUT}
+		stream <- Response{status: &ExitStatus{}}
+		close(stream)
+		output = stream
 		break
 	}
 	return
 }
+
+// cancelOnDrain relays responses and calls cancel once input is exhausted
+func cancelOnDrain(input <-chan Response, cancel context.CancelFunc) <-chan Response {
+	var output = make(chan Response)
+	go func() {
+		defer cancel()
+		defer close(output)
+		for resp := range input {
+			output <- resp
+		}
+	}()
+	return output
+}
+
+func copyFileContext(ctx context.Context, cmdr Commander, src, dst string, mode os.FileMode) error {
+	file, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	return cmdr.CopyContext(ctx, file, info.Size(), dst, mode)
+}
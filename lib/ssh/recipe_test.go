@@ -0,0 +1,367 @@
+package ssh
+
+import (
+	"github.com/jeffjen/yaml"
+
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestArchiveSend(t *testing.T) {
+	srv, cmdr := newTestCommander(t)
+	defer srv.Close()
+	defer cmdr.Close()
+
+	src, err := ioutil.TempDir("", "archive")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(src)
+	ioutil.WriteFile(filepath.Join(src, "single.txt"), []byte("single"), 0644)
+	os.MkdirAll(filepath.Join(src, "tree", "sub"), 0755)
+	ioutil.WriteFile(filepath.Join(src, "tree", "sub", "leaf.txt"), []byte("leaf"), 0644)
+
+	file := Archive{Src: filepath.Join(src, "single.txt"), Dir: filepath.Join(srv.Dir, "files")}
+	if err = file.Send(cmdr); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := ioutil.ReadFile(filepath.Join(srv.Dir, "files", "single.txt")); string(data) != "single" {
+		t.Errorf("unexpected content %q", data)
+	}
+
+	tree := Archive{Src: filepath.Join(src, "tree"), Dst: "copied", Dir: srv.Dir}
+	if err = tree.Send(cmdr); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := ioutil.ReadFile(filepath.Join(srv.Dir, "copied", "sub", "leaf.txt")); string(data) != "leaf" {
+		t.Errorf("unexpected content %q", data)
+	}
+
+	// Progress is reported for single file and each file of a tree
+	var sent = make(map[string]int64)
+	report := func(name string, done, size int64) {
+		if done > size {
+			t.Errorf("%s: reported %d of %d", name, done, size)
+		}
+		sent[name] = done
+	}
+	if err = file.SendProgress(cmdr, report); err != nil {
+		t.Fatal(err)
+	}
+	if err = tree.SendProgress(cmdr, report); err != nil {
+		t.Fatal(err)
+	}
+	if n := sent[filepath.Join(srv.Dir, "files", "single.txt")]; n != int64(len("single")) {
+		t.Errorf("expected whole file reported sent, got %d: %v", n, sent)
+	}
+	if n := sent[filepath.Join(srv.Dir, "copied", "sub", "leaf.txt")]; n != int64(len("leaf")) {
+		t.Errorf("expected whole file reported sent, got %d: %v", n, sent)
+	}
+}
+
+func TestActionAct(t *testing.T) {
+	srv, cmdr := newTestCommander(t)
+	defer srv.Close()
+	defer cmdr.Close()
+
+	output, err := Action{Cmd: "echo $((1 + 2))", Shell: true}.Act(cmdr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stdout, _, _ := collect(output); strings.Join(stdout, ",") != "3" {
+		t.Errorf("unexpected output %q", stdout)
+	}
+
+	script := filepath.Join(srv.Dir, "script.sh")
+	ioutil.WriteFile(script, []byte("echo from script\nexit 3\n"), 0644)
+	action := Action{Script: script, Sudo: true, Okcodes: []int{3}}
+	if output, err = action.Act(cmdr); err != nil {
+		t.Fatal(err)
+	}
+	stdout, _, last := collect(output)
+	if strings.Join(stdout, ",") != "from script" {
+		t.Errorf("unexpected output %q", stdout)
+	}
+	if status, ok := last.Exit(); !ok || !action.Accept(status) {
+		t.Errorf("expected exit status 3 accepted, got %+v (%v)", status, ok)
+	}
+	if cmdr.sudo {
+		t.Error("expected sudo to step down after Act")
+	}
+
+	output, err = Action{Cmd: `echo "$SUDO_TEST_USER" 'quoted'`, Shell: true, BecomeUser: "deploy"}.Act(cmdr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stdout, _, _ = collect(output); strings.Join(stdout, ",") != "deploy quoted" {
+		t.Errorf("unexpected output as become_user %q", stdout)
+	}
+
+	if output, err = (Action{Cmd: "sleep 10", Timeout: "100ms"}).Act(cmdr); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, last = collect(output); last.err == nil {
+		t.Error("expected action to time out")
+	}
+	if _, err = (Action{Cmd: "true", Timeout: "soon"}).Act(cmdr); err == nil {
+		t.Error("expected error for bad timeout")
+	}
+}
+
+func TestProvisionClean(t *testing.T) {
+	srv, cmdr := newTestCommander(t)
+	defer srv.Close()
+	defer cmdr.Close()
+
+	if err := cmdr.Mkdir(TMP_REMOTE_DIR); err != nil {
+		t.Fatal(err)
+	}
+	Provision{Name: "clean"}.Clean(cmdr)
+	if _, err := os.Stat(TMP_REMOTE_DIR); !os.IsNotExist(err) {
+		t.Errorf("expected %s removed, got %v", TMP_REMOTE_DIR, err)
+	}
+	commands := srv.Commands()
+	if last := commands[len(commands)-1]; last != becomeCommand(BecomeSudo, "", "rm -rf "+TMP_REMOTE_DIR) {
+		t.Errorf("unexpected clean command %q", last)
+	}
+}
+
+// stubSudo puts sudo(8) recording its arguments to the returned file ahead
+// in PATH until restore is called, so that tests never escalate for real
+func stubSudo(t *testing.T) (record string, restore func()) {
+	dir, err := ioutil.TempDir("", "sudo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	record = filepath.Join(dir, "record")
+	stub := "#!/bin/sh\necho \"$@\" >> " + Quote(record) + "\nexit 1\n"
+	if err = ioutil.WriteFile(filepath.Join(dir, "sudo"), []byte(stub), 0755); err != nil {
+		t.Fatal(err)
+	}
+	oldPath := os.Getenv("PATH")
+	os.Setenv("PATH", dir+string(os.PathListSeparator)+oldPath)
+	return record, func() {
+		os.Setenv("PATH", oldPath)
+		os.RemoveAll(dir)
+	}
+}
+
+func TestProvisionCleanLocal(t *testing.T) {
+	record, restore := stubSudo(t)
+	defer restore()
+
+	src, err := ioutil.TempDir("", "script")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(src)
+	script := filepath.Join(src, "where.sh")
+	ioutil.WriteFile(script, []byte("dirname \"$0\"\n"), 0644)
+
+	cmdr := NewLocal().(*LocalCommander)
+	defer cmdr.Close()
+	output, err := Action{Script: script}.Act(cmdr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout, _, _ := collect(output)
+	dir := strings.Join(stdout, ",")
+	if dir == TMP_REMOTE_DIR || dir != cmdr.tmpDir {
+		t.Errorf("expected script run from private directory, got %q", dir)
+	}
+	if info, err := os.Stat(dir); err != nil || info.Mode().Perm() != 0711 {
+		t.Errorf("unexpected private directory %v: %v", info, err)
+	}
+
+	Provision{Name: "clean"}.Clean(cmdr)
+	if _, err = os.Stat(dir); !os.IsNotExist(err) {
+		t.Errorf("expected %s removed, got %v", dir, err)
+	}
+	if called, _ := ioutil.ReadFile(record); len(called) > 0 {
+		t.Errorf("expected clean without sudo, got sudo %s", called)
+	}
+}
+
+func TestLocalBecomeSu(t *testing.T) {
+	record, restore := stubSudo(t)
+	defer restore()
+
+	cmdr := NewLocalBecome(BecomeSu)
+	if _, err := (Action{Cmd: "id -u", Sudo: true}).Act(cmdr); err != ErrLocalBecome {
+		t.Errorf("expected %v, got %v", ErrLocalBecome, err)
+	}
+	if called, _ := ioutil.ReadFile(record); len(called) > 0 {
+		t.Errorf("expected nothing run, got sudo %s", called)
+	}
+	if output, err := (Action{Cmd: "echo plain"}).Act(cmdr); err != nil {
+		t.Errorf("expected unelevated action to run, got %v", err)
+	} else if stdout, _, _ := collect(output); strings.Join(stdout, ",") != "plain" {
+		t.Errorf("unexpected output %q", stdout)
+	}
+}
+
+func TestRecipeRender(t *testing.T) {
+	srv, cmdr := newTestCommander(t)
+	defer srv.Close()
+	defer cmdr.Close()
+
+	src, err := ioutil.TempDir("", "template")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(src)
+	ioutil.WriteFile(filepath.Join(src, "app.conf"), []byte("listen {{.Host}}:{{.port}}\n"), 0644)
+
+	recipe := Recipe{
+		Archive: []Archive{
+			{Src: filepath.Join(src, "app.conf"), Dst: "{{.Name}}.conf", Dir: srv.Dir, Template: true},
+		},
+		Provision: []Provision{{
+			Name:   "setup {{.Name}}",
+			Action: []Action{{Cmd: "echo {{.port}}"}},
+		}},
+	}
+	vars := map[string]interface{}{"Name": "web", "Host": "10.0.0.1", "port": "8080"}
+	rendered, err := recipe.Render(vars)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if recipe.Provision[0].Name != "setup {{.Name}}" {
+		t.Errorf("Render modified original recipe: %q", recipe.Provision[0].Name)
+	}
+	if got := rendered.Provision[0].Name; got != "setup web" {
+		t.Errorf("unexpected provision name %q", got)
+	}
+	steps, err := rendered.Provision[0].Action[0].Expand(rendered.Variables())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := steps[0].Cmd; len(steps) != 1 || got != "echo 8080" {
+		t.Errorf("unexpected cmd %q", got)
+	}
+
+	if err = rendered.Archive[0].Send(cmdr); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := ioutil.ReadFile(filepath.Join(srv.Dir, "web.conf")); string(data) != "listen 10.0.0.1:8080\n" {
+		t.Errorf("unexpected content %q", data)
+	}
+
+	if _, err = recipe.Provision[0].Action[0].Expand(map[string]interface{}{"Name": "web"}); err == nil {
+		t.Error("expected error for missing variable")
+	}
+	if _, err = recipe.Render(map[string]interface{}{"Host": "10.0.0.1"}); err == nil {
+		t.Error("expected error for missing variable")
+	}
+}
+
+func TestEval(t *testing.T) {
+	vars := map[string]interface{}{
+		"role": "manager",
+		"web":  NewResult([]string{"ready"}, nil, &ExitStatus{Code: 3}, nil),
+	}
+	cases := []struct {
+		expr string
+		want bool
+	}{
+		{"", true},
+		{`eq .role "manager"`, true},
+		{`ne .role "manager"`, false},
+		{"eq .web.rc 3", true},
+		{`contains .web.stdout "read"`, true},
+		{".web.failed", false},
+		{"{{.role}}", true},
+		{`{{if eq .role "worker"}}yes{{end}}`, false},
+	}
+	for _, c := range cases {
+		if got, err := Eval(c.expr, vars); err != nil || got != c.want {
+			t.Errorf("Eval(%q) = %v, %v; want %v", c.expr, got, err, c.want)
+		}
+	}
+	if _, err := Eval(".missing", vars); err == nil {
+		t.Error("expected error for undefined variable")
+	}
+}
+
+func TestActionExpand(t *testing.T) {
+	a := Action{
+		Cmd:      "apt-get install -y {{.item}}",
+		When:     `ne .item "skip"`,
+		Loop:     []interface{}{"curl", "skip"},
+		Register: "pkgs",
+	}
+	steps, err := a.Expand(map[string]interface{}{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(steps) != 2 || steps[0].Cmd != "apt-get install -y curl" || steps[1].Cmd != "apt-get install -y skip" {
+		t.Fatalf("unexpected steps %+v", steps)
+	}
+	if ok, _ := steps[0].Applies(); !ok {
+		t.Error("expected first step to apply")
+	}
+	if ok, _ := steps[1].Applies(); ok {
+		t.Error("expected second step not to apply")
+	}
+	registered := a.Registered([]Result{NewResult(nil, nil, &ExitStatus{}, nil), SkippedResult()})
+	if registered.Failed() || registered.Skipped() || len(registered["results"].([]Result)) != 2 {
+		t.Errorf("unexpected registered result %v", registered)
+	}
+
+	// Commands of recipe not rendered are left alone
+	if steps, _ = (Action{Cmd: "docker ps --format {{.ID}}"}).Expand(nil); steps[0].Cmd != "docker ps --format {{.ID}}" {
+		t.Errorf("unexpected cmd %q", steps[0].Cmd)
+	}
+}
+
+func TestActionDone(t *testing.T) {
+	a := Action{Cmd: "docker info", Until: `contains .up.stdout "Server"`, Register: "up"}
+	if retries, delay, err := a.RetryPolicy(); err != nil || retries != DEFAULT_RETRIES || delay != DEFAULT_RETRY_DELAY {
+		t.Errorf("unexpected retry policy %d, %v, %v", retries, delay, err)
+	}
+	if done, _ := a.Done(NewResult([]string{"Client:"}, nil, &ExitStatus{}, nil)); done {
+		t.Error("expected more retries while condition is not met")
+	}
+	if done, _ := a.Done(NewResult([]string{"Server:"}, nil, &ExitStatus{}, nil)); !done {
+		t.Error("expected done once condition is met")
+	}
+	failing := Action{Cmd: "false", Retries: 2, Delay: "1s"}
+	if done, _ := failing.Done(NewResult(nil, nil, &ExitStatus{Code: 1}, ErrUntilNotMet)); done {
+		t.Error("expected retry of failed step")
+	}
+}
+
+func TestRecipeBatches(t *testing.T) {
+	var r Recipe
+	if err := yaml.Unmarshal([]byte("serial: 2\nmax_fail_percentage: 25\n"), &r); err != nil {
+		t.Fatal(err)
+	}
+	cases := []struct {
+		serial      string
+		total, want int
+	}{
+		{"", 7, 7},
+		{"2", 7, 2},
+		{"10", 7, 7},
+		{"30%", 10, 3},
+		{"10%", 5, 1},
+	}
+	for _, c := range cases {
+		if got, err := (Recipe{Serial: c.serial}).BatchSize(c.total); err != nil || got != c.want {
+			t.Errorf("BatchSize(%q, %d) = %d, %v; want %d", c.serial, c.total, got, err, c.want)
+		}
+	}
+	if _, err := (Recipe{Serial: "half"}).BatchSize(4); err != ErrBadSerial {
+		t.Errorf("expected ErrBadSerial, got %v", err)
+	}
+
+	if r.Serial != "2" || r.Aborts(1, 4) || !r.Aborts(2, 4) {
+		t.Errorf("unexpected abort policy for %+v", r)
+	}
+	if (Recipe{}).Aborts(1, 2) || !(Recipe{}).Aborts(2, 2) {
+		t.Error("expected batches to stop only when every host failed")
+	}
+}
@@ -0,0 +1,272 @@
+package ssh
+
+import (
+	"github.com/poddworks/machine/lib/vault"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+)
+
+const (
+	// Locate sftp-server for running the subsystem under sudo
+	SFTP_SERVER_CMD = `sh -c 'for p in /usr/lib/openssh/sftp-server /usr/libexec/openssh/sftp-server /usr/lib/ssh/sftp-server /usr/libexec/sftp-server; do [ -x $p ] && exec $p; done; exit 127'`
+)
+
+// TransferOptions tunes Upload and Download
+type TransferOptions struct {
+	// Copy content symbolic links point to instead of recreating the link
+	FollowSymlinks bool
+
+	// Report bytes transferred so far for file being copied
+	Progress func(name string, done, size int64)
+
+	// Upload vault encrypted files decrypted, readable only by owner
+	Decrypt bool
+}
+
+// progress counts bytes passing through and reports to TransferOptions
+type progress struct {
+	name  string
+	done  int64
+	size  int64
+	since func(name string, done, size int64)
+}
+
+func (p *progress) count(n int) {
+	p.done += int64(n)
+	if p.since != nil {
+		p.since(p.name, p.done, p.size)
+	}
+}
+
+type progressReader struct {
+	io.Reader
+	*progress
+}
+
+func (r progressReader) Read(b []byte) (n int, err error) {
+	n, err = r.Reader.Read(b)
+	r.count(n)
+	return
+}
+
+// withProgress counts what is read from r as transfer of name to report,
+// if any
+func withProgress(r io.Reader, name string, size int64, report func(name string, done, size int64)) io.Reader {
+	if report == nil {
+		return r
+	}
+	return progressReader{r, &progress{name, 0, size, report}}
+}
+
+type progressWriter struct {
+	io.Writer
+	*progress
+}
+
+func (w progressWriter) Write(b []byte) (n int, err error) {
+	n, err = w.Writer.Write(b)
+	w.count(n)
+	return
+}
+
+type sftpClient struct {
+	*sftp.Client
+
+	session *ssh.Session
+}
+
+func newSFTPClient(session *ssh.Session, stdin io.WriteCloser, stdout io.Reader) (*sftpClient, error) {
+	client, err := sftp.NewClientPipe(stdout, stdin)
+	if err != nil {
+		return nil, err
+	}
+	return &sftpClient{Client: client, session: session}, nil
+}
+
+func (c *sftpClient) Close() error {
+	c.Client.Close()
+	return c.session.Close()
+}
+
+func (c *sftpClient) mkdirAll(name string, perm os.FileMode) error {
+	info, err := c.Stat(name)
+	if err == nil {
+		if !info.IsDir() {
+			return fmt.Errorf("%s - not a directory", name)
+		}
+		return nil
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+	if parent := path.Dir(name); parent != name {
+		if err = c.mkdirAll(parent, 0755); err != nil {
+			return err
+		}
+	}
+	if err = c.Mkdir(name); err != nil {
+		return err
+	}
+	return c.Chmod(name, perm)
+}
+
+func (c *sftpClient) upload(src, dst string, opts TransferOptions) error {
+	var (
+		info os.FileInfo
+		err  error
+	)
+	if opts.FollowSymlinks {
+		info, err = os.Stat(src)
+	} else {
+		info, err = os.Lstat(src)
+	}
+	if err != nil {
+		return err
+	}
+	switch mode := info.Mode(); {
+	case mode&os.ModeSymlink != 0:
+		target, err := os.Readlink(src)
+		if err != nil {
+			return err
+		}
+		c.Remove(dst)
+		return c.Symlink(target, dst)
+	case mode.IsDir():
+		if err = c.mkdirAll(dst, mode.Perm()); err != nil {
+			return err
+		}
+		entries, err := ioutil.ReadDir(src)
+		if err != nil {
+			return err
+		}
+		for _, entry := range entries {
+			if err = c.upload(filepath.Join(src, entry.Name()), path.Join(dst, entry.Name()), opts); err != nil {
+				return err
+			}
+		}
+		// Apply directory attributes last so its mtime survives
+		if err = c.Chmod(dst, mode.Perm()); err != nil {
+			return err
+		}
+		return c.Chtimes(dst, info.ModTime(), info.ModTime())
+	case mode.IsRegular():
+		return c.put(src, dst, info, opts)
+	default:
+		return ErrCopyNotRegular
+	}
+}
+
+func (c *sftpClient) put(src, dst string, info os.FileInfo, opts TransferOptions) error {
+	var (
+		origin io.Reader
+		size   = info.Size()
+		mode   = info.Mode().Perm()
+	)
+	if opts.Decrypt && vault.IsEncryptedFile(src) {
+		content, err := readLocal(src)
+		if err != nil {
+			return err
+		}
+		origin, size, mode = bytes.NewReader(content), int64(len(content)), localMode(src, mode)
+	} else {
+		file, err := os.Open(src)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		origin = file
+	}
+	file, err := c.Create(dst)
+	if err != nil {
+		return err
+	}
+	// Restrict mode before writing so content is never readable by others
+	if err = c.Chmod(dst, mode); err != nil {
+		file.Close()
+		return err
+	}
+	_, err = io.Copy(file, progressReader{origin, &progress{dst, 0, size, opts.Progress}})
+	if cerr := file.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	return c.Chtimes(dst, info.ModTime(), info.ModTime())
+}
+
+func (c *sftpClient) download(src, dst string, opts TransferOptions) error {
+	var (
+		info os.FileInfo
+		err  error
+	)
+	if opts.FollowSymlinks {
+		info, err = c.Stat(src)
+	} else {
+		info, err = c.Lstat(src)
+	}
+	if err != nil {
+		return err
+	}
+	switch mode := info.Mode(); {
+	case mode&os.ModeSymlink != 0:
+		target, err := c.ReadLink(src)
+		if err != nil {
+			return err
+		}
+		os.Remove(dst)
+		return os.Symlink(target, dst)
+	case mode.IsDir():
+		if err = os.MkdirAll(dst, mode.Perm()|0700); err != nil {
+			return err
+		}
+		entries, err := c.ReadDir(src)
+		if err != nil {
+			return err
+		}
+		for _, entry := range entries {
+			if err = c.download(path.Join(src, entry.Name()), filepath.Join(dst, entry.Name()), opts); err != nil {
+				return err
+			}
+		}
+		if err = os.Chmod(dst, mode.Perm()); err != nil {
+			return err
+		}
+		return os.Chtimes(dst, info.ModTime(), info.ModTime())
+	case mode.IsRegular():
+		return c.get(src, dst, info, opts)
+	default:
+		return ErrCopyNotRegular
+	}
+}
+
+func (c *sftpClient) get(src, dst string, info os.FileInfo, opts TransferOptions) error {
+	file, err := c.Open(src)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	origin, err := os.OpenFile(dst, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, info.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(progressWriter{origin, &progress{dst, 0, info.Size(), opts.Progress}}, file)
+	if cerr := origin.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	if err = os.Chmod(dst, info.Mode().Perm()); err != nil {
+		return err
+	}
+	return os.Chtimes(dst, info.ModTime(), info.ModTime())
+}
@@ -0,0 +1,283 @@
+package ssh
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	osuser "os/user"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+const (
+	// Nesting limit for Include directive, same as OpenSSH
+	MAX_INCLUDE_DEPTH = 16
+)
+
+var (
+	// OpenSSH client config consulted when resolving Config
+	UserConfigFile = filepath.Join(os.Getenv("HOME"), ".ssh", "config")
+
+	// Match criteria warned about, so that each is reported once per run
+	unknownCriteria     = make(map[string]bool)
+	unknownCriteriaLock sync.Mutex
+)
+
+// sshConfigLookup collects options applying to host, logging in as user
+// when given, from OpenSSH client config.  As with ssh(1), the first
+// obtained value for each keyword wins, except for IdentityFile which
+// accumulates.
+type sshConfigLookup struct {
+	host    string
+	user    string
+	options map[string][]string
+}
+
+func newSSHConfigLookup(host, user string) *sshConfigLookup {
+	return &sshConfigLookup{host: host, user: user, options: make(map[string][]string)}
+}
+
+// remoteUser is who to log in as from what is known so far
+func (l *sshConfigLookup) remoteUser() string {
+	if l.user != "" {
+		return l.user
+	} else if user := l.get("user"); user != "" {
+		return user
+	}
+	return localUser()
+}
+
+func localUser() string {
+	if current, err := osuser.Current(); err == nil {
+		return current.Username
+	}
+	return os.Getenv("USER")
+}
+
+func (l *sshConfigLookup) get(keyword string) string {
+	if values := l.options[keyword]; len(values) > 0 {
+		return values[0]
+	}
+	return ""
+}
+
+func (l *sshConfigLookup) parse(file string, depth int) error {
+	origin, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer origin.Close()
+
+	var (
+		active = true // options before first Host apply to all
+
+		lnr  = bufio.NewScanner(origin)
+		line = 0
+	)
+	for lnr.Scan() {
+		line++
+		keyword, args := splitConfigLine(lnr.Text())
+		switch keyword {
+		case "":
+			// NOOP
+		case "host":
+			active = matchHostPatterns(args, l.host)
+		case "match":
+			if active, err = l.match(file, line, args); err != nil {
+				return fmt.Errorf("%s line %d: %v", file, line, err)
+			}
+		case "include":
+			if !active {
+				continue
+			}
+			if depth >= MAX_INCLUDE_DEPTH {
+				return fmt.Errorf("%s line %d: %v", file, line, ErrIncludeDepth)
+			}
+			for _, pattern := range args {
+				pattern = expandHome(pattern)
+				if !filepath.IsAbs(pattern) {
+					pattern = filepath.Join(filepath.Dir(UserConfigFile), pattern)
+				}
+				matches, err := filepath.Glob(pattern)
+				if err != nil {
+					return fmt.Errorf("%s line %d: %v", file, line, err)
+				}
+				for _, included := range matches {
+					if err = l.parse(included, depth+1); err != nil {
+						return err
+					}
+				}
+			}
+		case "identityfile":
+			if active && len(args) > 0 {
+				l.options[keyword] = append(l.options[keyword], args[0])
+			}
+		default:
+			if _, ok := l.options[keyword]; active && !ok && len(args) > 0 {
+				l.options[keyword] = args
+			}
+		}
+	}
+	return lnr.Err()
+}
+
+// match evaluates criteria of Match directive.  "all", "host" (or
+// "originalhost", the same before canonicalization), "user" and "localuser"
+// are understood; other criteria, e.g. exec, are taken as not matching with
+// a warning, so that blocks meant for ssh(1) alone leave machine be.
+func (l *sshConfigLookup) match(file string, line int, args []string) (bool, error) {
+	if len(args) == 0 {
+		return false, ErrMatchCriteria
+	}
+	if len(args) == 1 && strings.EqualFold(args[0], "all") {
+		return true, nil
+	}
+	var matched = true
+	for len(args) > 0 {
+		var criteria = strings.ToLower(args[0])
+		switch criteria {
+		case "canonical", "final":
+			warnCriteria(file, line, criteria)
+			matched, args = false, args[1:]
+			continue
+		}
+		if len(args) < 2 {
+			return false, fmt.Errorf("%v: %s needs argument", ErrMatchCriteria, criteria)
+		}
+		switch patterns := strings.Split(args[1], ","); criteria {
+		case "host", "originalhost":
+			matched = matched && matchHostPatterns(patterns, l.host)
+		case "user":
+			matched = matched && matchHostPatterns(patterns, l.remoteUser())
+		case "localuser":
+			matched = matched && matchHostPatterns(patterns, localUser())
+		default:
+			warnCriteria(file, line, criteria)
+			matched = false
+		}
+		args = args[2:]
+	}
+	return matched, nil
+}
+
+// warnCriteria reports Match criteria taken as not matching, once each
+func warnCriteria(file string, line int, criteria string) {
+	unknownCriteriaLock.Lock()
+	defer unknownCriteriaLock.Unlock()
+	if !unknownCriteria[criteria] {
+		unknownCriteria[criteria] = true
+		fmt.Fprintf(os.Stderr, "%s line %d: Match %s is not supported, taken as not matching\n", file, line, criteria)
+	}
+}
+
+// splitConfigLine breaks line into lower cased keyword and its arguments,
+// accepting both "Keyword value" and "Keyword=value"
+func splitConfigLine(line string) (keyword string, args []string) {
+	line = strings.TrimSpace(line)
+	if line == "" || line[0] == '#' {
+		return
+	}
+	end := strings.IndexAny(line, " \t=")
+	if end == -1 {
+		return strings.ToLower(line), nil
+	}
+	keyword = strings.ToLower(line[:end])
+	rest := strings.TrimLeft(line[end:], " \t")
+	if strings.HasPrefix(rest, "=") {
+		rest = rest[1:]
+	}
+	for rest = strings.TrimSpace(rest); rest != ""; rest = strings.TrimSpace(rest) {
+		if rest[0] == '"' {
+			if end = strings.IndexByte(rest[1:], '"'); end != -1 {
+				args = append(args, rest[1:end+1])
+				rest = rest[end+2:]
+				continue
+			}
+		}
+		if end = strings.IndexAny(rest, " \t"); end == -1 {
+			end = len(rest)
+		}
+		args = append(args, rest[:end])
+		rest = rest[end:]
+	}
+	return
+}
+
+func matchHostPatterns(patterns []string, host string) (matched bool) {
+	host = strings.ToLower(host)
+	for _, pattern := range patterns {
+		pattern = strings.ToLower(pattern)
+		if strings.HasPrefix(pattern, "!") {
+			if matchPattern(pattern[1:], host) {
+				return false // negated pattern wins
+			}
+		} else if matchPattern(pattern, host) {
+			matched = true
+		}
+	}
+	return
+}
+
+// expandHome replaces leading ~ with user home directory
+func expandHome(file string) string {
+	if file == "~" || strings.HasPrefix(file, "~/") {
+		return os.Getenv("HOME") + file[1:]
+	}
+	return file
+}
+
+// expandTokens substitutes the subset of ssh_config(5) tokens known before
+// connecting
+func expandTokens(value, host string) string {
+	return strings.NewReplacer(
+		"%%", "%",
+		"%d", os.Getenv("HOME"),
+		"%h", host,
+		"%u", os.Getenv("USER"),
+	).Replace(expandHome(value))
+}
+
+// resolve fills fields of cfg left empty from OpenSSH client config entries
+// matching Server, so that explicit settings take precedence
+func (cfg Config) resolve() Config {
+	if cfg.resolved {
+		return cfg
+	}
+	cfg.resolved = true
+
+	// Missing config leaves cfg as is; one that cannot be understood fails
+	// connecting, see SSHCommander.dial
+	l := newSSHConfigLookup(cfg.Server, cfg.User)
+	if err := l.parse(UserConfigFile, 0); err != nil && !os.IsNotExist(err) {
+		cfg.resolveErr = err
+		return cfg
+	}
+
+	var alias = cfg.Server
+	if hostname := l.get("hostname"); hostname != "" {
+		cfg.Server = expandTokens(hostname, alias)
+	}
+	if cfg.User == "" {
+		cfg.User = l.get("user")
+	}
+	if cfg.Port == "" {
+		cfg.Port = l.get("port")
+	}
+	if identities := l.options["identityfile"]; len(identities) > 0 {
+		var files []string
+		for _, identity := range identities {
+			files = append(files, expandTokens(identity, cfg.Server))
+		}
+		if cfg.Key == "" {
+			cfg.Key, files = files[0], files[1:]
+		}
+		if len(cfg.Identities) == 0 {
+			cfg.Identities = files
+		}
+	}
+	if jump := l.get("proxyjump"); len(cfg.Jump) == 0 && jump != "" && !strings.EqualFold(jump, "none") {
+		cfg.Jump, _ = ParseProxyJump(jump)
+	}
+	return cfg
+}
@@ -0,0 +1,236 @@
+package ssh
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// withUserConfig points UserConfigFile at config written to a temporary
+// directory along with files, for the duration of fn.  {{dir}} in config
+// stands for that directory.
+func withUserConfig(t *testing.T, config string, files map[string]string, fn func()) {
+	dir, err := ioutil.TempDir("", "sshconfig")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	writeFiles(t, dir, files)
+	writeFiles(t, dir, map[string]string{"config": strings.Replace(config, "{{dir}}", dir, -1)})
+
+	defer func(file string) { UserConfigFile = file }(UserConfigFile)
+	UserConfigFile = filepath.Join(dir, "config")
+	fn()
+}
+
+func TestMatchHostPatterns(t *testing.T) {
+	var cases = []struct {
+		patterns []string
+		host     string
+		matched  bool
+	}{
+		{[]string{"*"}, "web-1", true},
+		{[]string{"web-?"}, "web-1", true},
+		{[]string{"web-?"}, "web-12", false},
+		{[]string{"*.example.com"}, "DB.Example.COM", true},
+		{[]string{"db", "web-*"}, "web-1", true},
+		{[]string{"*", "!bastion"}, "bastion", false},
+		{[]string{"!bastion", "*"}, "bastion", false},
+		{[]string{"!bastion"}, "web-1", false},
+	}
+	for _, c := range cases {
+		if matched := matchHostPatterns(c.patterns, c.host); matched != c.matched {
+			t.Errorf("%q on %s: expected %v, got %v", c.patterns, c.host, c.matched, matched)
+		}
+	}
+}
+
+func TestSplitConfigLine(t *testing.T) {
+	var cases = []struct {
+		line    string
+		keyword string
+		args    []string
+	}{
+		{"  # comment", "", nil},
+		{"HostName 10.0.0.1", "hostname", []string{"10.0.0.1"}},
+		{"Port=2222", "port", []string{"2222"}},
+		{"User = admin", "user", []string{"admin"}},
+		{`IdentityFile "~/My Keys/id_rsa"`, "identityfile", []string{"~/My Keys/id_rsa"}},
+		{"Host web-* !web-9", "host", []string{"web-*", "!web-9"}},
+	}
+	for _, c := range cases {
+		keyword, args := splitConfigLine(c.line)
+		if keyword != c.keyword || !reflect.DeepEqual(args, c.args) {
+			t.Errorf("%q: unexpected %q %q", c.line, keyword, args)
+		}
+	}
+}
+
+func TestConfigResolve(t *testing.T) {
+	var home = os.Getenv("HOME")
+	var cases = []struct {
+		name   string
+		config string
+		files  map[string]string
+		given  Config
+		expect Config
+	}{
+		{
+			name: "first value wins",
+			config: `
+Host web-*
+  User deploy
+  Port 2200
+Host *
+  User nobody
+  Port 22
+  HostName %h.internal
+`,
+			given:  Config{Server: "web-1"},
+			expect: Config{Server: "web-1.internal", User: "deploy", Port: "2200"},
+		},
+		{
+			name:   "given settings take precedence",
+			config: "Host *\n  User deploy\n  Port 2200\n  IdentityFile ~/.ssh/id_rsa\n",
+			given:  Config{Server: "web-1", User: "admin", Port: "22", Key: "given.pem"},
+			expect: Config{Server: "web-1", User: "admin", Port: "22", Key: "given.pem", Identities: []string{home + "/.ssh/id_rsa"}},
+		},
+		{
+			name:   "negated host",
+			config: "Host * !bastion\n  User deploy\n",
+			given:  Config{Server: "bastion"},
+			expect: Config{Server: "bastion"},
+		},
+		{
+			name: "identity files accumulate",
+			config: `
+Host web-1
+  IdentityFile ~/.ssh/%h.pem
+Host *
+  IdentityFile %d/.ssh/id_ed25519
+  IdentityFile ~/.ssh/id_rsa
+`,
+			given: Config{Server: "web-1"},
+			expect: Config{
+				Server:     "web-1",
+				Key:        home + "/.ssh/web-1.pem",
+				Identities: []string{home + "/.ssh/id_ed25519", home + "/.ssh/id_rsa"},
+			},
+		},
+		{
+			name:   "match all",
+			config: "Host other\n  User other\nMatch all\n  User deploy\n",
+			given:  Config{Server: "web-1"},
+			expect: Config{Server: "web-1", User: "deploy"},
+		},
+		{
+			name:   "match host",
+			config: "Match host db-*,!db-9 originalhost db-?\n  User dba\nMatch host web-*\n  User deploy\n",
+			given:  Config{Server: "db-1"},
+			expect: Config{Server: "db-1", User: "dba"},
+		},
+		{
+			name:   "match user given",
+			config: "Match user admin,root\n  Port 2200\nMatch user deploy\n  Port 2222\n",
+			given:  Config{Server: "web-1", User: "deploy"},
+			expect: Config{Server: "web-1", User: "deploy", Port: "2222"},
+		},
+		{
+			name:   "match user from config",
+			config: "Host web-*\n  User deploy\nMatch user deploy\n  Port 2222\n",
+			given:  Config{Server: "web-1"},
+			expect: Config{Server: "web-1", User: "deploy", Port: "2222"},
+		},
+		{
+			name:   "match localuser",
+			config: "Match localuser " + localUser() + "\n  User deploy\nMatch localuser !" + localUser() + ",*\n  Port 2200\n",
+			given:  Config{Server: "web-1"},
+			expect: Config{Server: "web-1", User: "deploy"},
+		},
+		{
+			name:   "unsupported criteria do not match",
+			config: "Match host web-* exec \"gpg-connect-agent updatestartuptty /bye\"\n  User agent\nMatch canonical\n  Port 2200\nHost *\n  User deploy\n",
+			given:  Config{Server: "web-1"},
+			expect: Config{Server: "web-1", User: "deploy"},
+		},
+		{
+			name:   "include relative and glob",
+			config: "Include conf.d/*.conf\nHost *\n  User nobody\n",
+			files: map[string]string{
+				"conf.d/10-web.conf": "Host web-*\n  User deploy\n",
+				"conf.d/20-all.conf": "Host *\n  Port 2200\n  User other\n",
+				"conf.d/ignored.txt": "Host *\n  Port 9999\n",
+			},
+			given:  Config{Server: "web-1"},
+			expect: Config{Server: "web-1", User: "deploy", Port: "2200"},
+		},
+		{
+			name:   "include only under matching host",
+			config: "Host db-*\n  Include db.conf\nHost *\n  User nobody\n",
+			files:  map[string]string{"db.conf": "User dba\n"},
+			given:  Config{Server: "web-1"},
+			expect: Config{Server: "web-1", User: "nobody"},
+		},
+		{
+			name:   "include absolute",
+			config: "Include {{dir}}/extra/web.conf\n",
+			files:  map[string]string{"extra/web.conf": "Host *\n  ProxyJump jump@bastion:2222\n"},
+			given:  Config{Server: "web-1"},
+			expect: Config{Server: "web-1", Jump: []Hop{{User: "jump", Server: "bastion", Port: "2222"}}},
+		},
+	}
+	for _, c := range cases {
+		withUserConfig(t, c.config, c.files, func() {
+			got := c.given.resolve()
+			if got.resolveErr != nil {
+				t.Errorf("%s: %v", c.name, got.resolveErr)
+				return
+			}
+			if got.resolved = false; !reflect.DeepEqual(got, c.expect) {
+				t.Errorf("%s: expected %+v, got %+v", c.name, c.expect, got)
+			}
+		})
+	}
+}
+
+func TestConfigResolveErrors(t *testing.T) {
+	var cases = []struct {
+		name   string
+		config string
+		files  map[string]string
+		err    error
+	}{
+		{"match without criteria", "Match\n", nil, ErrMatchCriteria},
+		{"match without argument", "Host *\n  Port 22\nMatch user\n", nil, ErrMatchCriteria},
+		{"include loop", "Include loop.conf\n", map[string]string{"loop.conf": "Include loop.conf\n"}, ErrIncludeDepth},
+	}
+	for _, c := range cases {
+		withUserConfig(t, c.config, c.files, func() {
+			got := Config{Server: "web-1"}.resolve()
+			if got.resolveErr == nil || !strings.Contains(got.resolveErr.Error(), c.err.Error()) {
+				t.Errorf("%s: expected %v, got %v", c.name, c.err, got.resolveErr)
+				return
+			}
+			// Connecting fails with it rather than ignoring config
+			if _, err := newSSHCommander(Config{Server: "web-1"}).dial(); err == nil || err.Error() != got.resolveErr.Error() {
+				t.Errorf("%s: expected dial to fail with %v, got %v", c.name, got.resolveErr, err)
+			}
+		})
+	}
+
+	// Nesting below limit is fine
+	var files = make(map[string]string)
+	for n := 1; n < MAX_INCLUDE_DEPTH; n++ {
+		files[fmt.Sprintf("%d.conf", n)] = fmt.Sprintf("Include %d.conf\n", n+1)
+	}
+	files[fmt.Sprintf("%d.conf", MAX_INCLUDE_DEPTH)] = "User deep\n"
+	withUserConfig(t, "Include 1.conf\n", files, func() {
+		if got := (Config{Server: "web-1"}).resolve(); got.resolveErr != nil || got.User != "deep" {
+			t.Errorf("expected nested includes applied, got %+v", got)
+		}
+	})
+}
@@ -0,0 +1,526 @@
+// Package sshtest provides an in-process SSH server for exercising
+// Commander implementations without a remote host.
+package sshtest
+
+import (
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+
+	"bufio"
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+const (
+	// Stand-in for sudo(8) placed ahead in PATH, runs command as current
+	// user.  When SUDO_TEST_PASSWORD is set it asks for it like sudo -S,
+	// allowing one retry.  Target user is exported as SUDO_TEST_USER.
+	FAKE_SUDO = `#!/bin/sh
+prompt="[sudo] password: "
+user=root
+while [ $# -gt 0 ]; do
+	case "$1" in
+	-p) prompt="$2"; shift 2 ;;
+	-u) user="$2"; shift 2 ;;
+	-S|-s|-i|-E|-n|-H) shift ;;
+	--) shift; break ;;
+	*) break ;;
+	esac
+done
+[ -n "$SUDO_TEST_NOISE" ] && echo "$SUDO_TEST_NOISE" >&2
+if [ -n "$SUDO_TEST_PASSWORD" ]; then
+	for try in 1 2; do
+		printf '%s' "$prompt" >&2
+		read -r answer || { echo "sudo: no password was provided" >&2; exit 1; }
+		[ "$answer" = "$SUDO_TEST_PASSWORD" ] && break
+		echo "Sorry, try again." >&2
+		[ $try = 2 ] && exit 1
+	done
+fi
+export SUDO_TEST_USER="$user"
+exec "$@"
+`
+)
+
+var (
+	// Signal named in SSH signal request, see RFC 4254 6.9
+	signals = map[string]syscall.Signal{
+		"HUP":  syscall.SIGHUP,
+		"INT":  syscall.SIGINT,
+		"KILL": syscall.SIGKILL,
+		"QUIT": syscall.SIGQUIT,
+		"TERM": syscall.SIGTERM,
+		"USR1": syscall.SIGUSR1,
+		"USR2": syscall.SIGUSR2,
+	}
+)
+
+// Server accepts SSH connections on loopback, running exec requests with
+// sh(1) inside a sandbox directory.  "scp -t" is served in process, as is
+// the sftp subsystem and port forwarding.
+type Server struct {
+	// Directory commands run in, removed on Close
+	Dir string
+
+	// Credentials accepted by password authentication
+	User     string
+	Password string
+
+	// Keys accepted by public key authentication for User
+	AuthorizedKeys []ssh.PublicKey
+
+	// Public half of the key server presents
+	HostKey ssh.PublicKey
+
+	// Password fake sudo asks for, none when empty
+	SudoPassword string
+
+	// Line fake sudo prints on stderr before anything else, none when empty
+	SudoNoise string
+
+	root     string
+	listener net.Listener
+	config   *ssh.ServerConfig
+
+	lock     sync.Mutex
+	commands []string
+}
+
+// NewServer starts Server listening on a random loopback port
+func NewServer() (*Server, error) {
+	root, err := ioutil.TempDir("", "sshtest")
+	if err != nil {
+		return nil, err
+	}
+	srv := &Server{
+		Dir:      filepath.Join(root, "sandbox"),
+		User:     "machine",
+		Password: "machine",
+		root:     root,
+	}
+	if err = srv.setup(); err != nil {
+		os.RemoveAll(root)
+		return nil, err
+	}
+	go srv.serve()
+	return srv, nil
+}
+
+func (srv *Server) setup() (err error) {
+	if err = os.MkdirAll(srv.Dir, 0755); err != nil {
+		return
+	}
+	if err = os.MkdirAll(filepath.Join(srv.root, "bin"), 0755); err != nil {
+		return
+	}
+	if err = ioutil.WriteFile(filepath.Join(srv.root, "bin", "sudo"), []byte(FAKE_SUDO), 0755); err != nil {
+		return
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return
+	}
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		return
+	}
+	srv.HostKey = signer.PublicKey()
+	srv.config = &ssh.ServerConfig{
+		PasswordCallback: func(conn ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+			if conn.User() == srv.User && string(password) == srv.Password {
+				return nil, nil
+			}
+			return nil, fmt.Errorf("password rejected for %s", conn.User())
+		},
+		PublicKeyCallback: func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			srv.lock.Lock()
+			defer srv.lock.Unlock()
+			for _, authorized := range srv.AuthorizedKeys {
+				if conn.User() == srv.User && bytes.Equal(authorized.Marshal(), key.Marshal()) {
+					return nil, nil
+				}
+			}
+			return nil, fmt.Errorf("public key rejected for %s", conn.User())
+		},
+	}
+	srv.config.AddHostKey(signer)
+	srv.listener, err = net.Listen("tcp", "127.0.0.1:0")
+	return
+}
+
+// Authorize adds key to those accepted for User
+func (srv *Server) Authorize(key ssh.PublicKey) {
+	srv.lock.Lock()
+	defer srv.lock.Unlock()
+	srv.AuthorizedKeys = append(srv.AuthorizedKeys, key)
+}
+
+// Host reports address server listens on
+func (srv *Server) Host() (host, port string) {
+	host, port, _ = net.SplitHostPort(srv.listener.Addr().String())
+	return
+}
+
+// Commands reports command line of every exec request received, in order
+func (srv *Server) Commands() []string {
+	srv.lock.Lock()
+	defer srv.lock.Unlock()
+	return append([]string(nil), srv.commands...)
+}
+
+// Close stops accepting connections and removes sandbox
+func (srv *Server) Close() error {
+	err := srv.listener.Close()
+	os.RemoveAll(srv.root)
+	return err
+}
+
+func (srv *Server) serve() {
+	for {
+		conn, err := srv.listener.Accept()
+		if err != nil {
+			return // listener closed
+		}
+		go srv.handle(conn)
+	}
+}
+
+func (srv *Server) handle(conn net.Conn) {
+	sshConn, chans, reqs, err := ssh.NewServerConn(conn, srv.config)
+	if err != nil {
+		conn.Close()
+		return
+	}
+	defer sshConn.Close()
+	go srv.globalRequests(sshConn, reqs)
+	for newChan := range chans {
+		switch newChan.ChannelType() {
+		case "session":
+			ch, requests, err := newChan.Accept()
+			if err != nil {
+				continue
+			}
+			go srv.session(ch, requests)
+		case "direct-tcpip", "direct-streamlocal@openssh.com":
+			go srv.direct(newChan)
+		default:
+			newChan.Reject(ssh.UnknownChannelType, "unsupported channel type")
+		}
+	}
+}
+
+// direct connects channel opened for port forwarding to its destination
+func (srv *Server) direct(newChan ssh.NewChannel) {
+	var network, addr string
+	if newChan.ChannelType() == "direct-tcpip" {
+		var msg struct {
+			Host       string
+			Port       uint32
+			OriginHost string
+			OriginPort uint32
+		}
+		if err := ssh.Unmarshal(newChan.ExtraData(), &msg); err != nil {
+			newChan.Reject(ssh.ConnectionFailed, err.Error())
+			return
+		}
+		network, addr = "tcp", net.JoinHostPort(msg.Host, fmt.Sprint(msg.Port))
+	} else {
+		var msg struct {
+			Path      string
+			Reserved0 string
+			Reserved1 uint32
+		}
+		if err := ssh.Unmarshal(newChan.ExtraData(), &msg); err != nil {
+			newChan.Reject(ssh.ConnectionFailed, err.Error())
+			return
+		}
+		network, addr = "unix", msg.Path
+	}
+	conn, err := net.Dial(network, addr)
+	if err != nil {
+		newChan.Reject(ssh.ConnectionFailed, err.Error())
+		return
+	}
+	ch, requests, err := newChan.Accept()
+	if err != nil {
+		conn.Close()
+		return
+	}
+	go ssh.DiscardRequests(requests)
+	pipe(ch, conn)
+}
+
+// globalRequests serves "tcpip-forward", opening "forwarded-tcpip" channel
+// back to client for each connection accepted
+func (srv *Server) globalRequests(sshConn *ssh.ServerConn, reqs <-chan *ssh.Request) {
+	var listeners []net.Listener
+	defer func() {
+		for _, ln := range listeners {
+			ln.Close()
+		}
+	}()
+	for req := range reqs {
+		if req.Type != "tcpip-forward" {
+			if req.WantReply {
+				req.Reply(false, nil)
+			}
+			continue
+		}
+		var msg struct {
+			Addr string
+			Port uint32
+		}
+		if err := ssh.Unmarshal(req.Payload, &msg); err != nil {
+			req.Reply(false, nil)
+			continue
+		}
+		ln, err := net.Listen("tcp", net.JoinHostPort(msg.Addr, fmt.Sprint(msg.Port)))
+		if err != nil {
+			req.Reply(false, nil)
+			continue
+		}
+		listeners = append(listeners, ln)
+		port := uint32(ln.Addr().(*net.TCPAddr).Port)
+		req.Reply(true, ssh.Marshal(&struct{ Port uint32 }{port}))
+		go func(ln net.Listener, addr string, port uint32) {
+			for {
+				conn, err := ln.Accept()
+				if err != nil {
+					return
+				}
+				origin := conn.RemoteAddr().(*net.TCPAddr)
+				ch, requests, err := sshConn.OpenChannel("forwarded-tcpip", ssh.Marshal(&struct {
+					Addr       string
+					Port       uint32
+					OriginAddr string
+					OriginPort uint32
+				}{addr, port, origin.IP.String(), uint32(origin.Port)}))
+				if err != nil {
+					conn.Close()
+					continue
+				}
+				go ssh.DiscardRequests(requests)
+				go pipe(ch, conn)
+			}
+		}(ln, msg.Addr, port)
+	}
+}
+
+// pipe copies between channel and conn until both sides are done
+func pipe(ch ssh.Channel, conn net.Conn) {
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		io.Copy(ch, conn)
+		ch.CloseWrite()
+	}()
+	go func() {
+		defer wg.Done()
+		io.Copy(conn, ch)
+		if cw, ok := conn.(interface {
+			CloseWrite() error
+		}); ok {
+			cw.CloseWrite()
+		}
+	}()
+	wg.Wait()
+	ch.Close()
+	conn.Close()
+}
+
+func (srv *Server) session(ch ssh.Channel, requests <-chan *ssh.Request) {
+	var (
+		env  []string
+		proc *exec.Cmd
+	)
+	defer ch.Close()
+	for req := range requests {
+		switch req.Type {
+		case "env":
+			var kv struct{ Name, Value string }
+			ssh.Unmarshal(req.Payload, &kv)
+			env = append(env, kv.Name+"="+kv.Value)
+			req.Reply(true, nil)
+		case "pty-req":
+			req.Reply(true, nil)
+		case "exec", "shell":
+			var cmd struct{ Command string }
+			if req.Type == "exec" {
+				ssh.Unmarshal(req.Payload, &cmd)
+			} else {
+				cmd.Command = "sh"
+			}
+			srv.lock.Lock()
+			srv.commands = append(srv.commands, cmd.Command)
+			srv.lock.Unlock()
+			req.Reply(true, nil)
+			if dst, ok := scpSink(cmd.Command); ok {
+				go srv.exit(ch, srv.scp(ch, dst), nil)
+			} else {
+				proc = srv.command(cmd.Command, env, ch)
+				if err := proc.Start(); err != nil {
+					go srv.exit(ch, 127, nil)
+					continue
+				}
+				go func(proc *exec.Cmd) {
+					err := proc.Wait()
+					srv.exit(ch, exitCode(err), proc.ProcessState)
+				}(proc)
+			}
+		case "subsystem":
+			var sub struct{ Name string }
+			ssh.Unmarshal(req.Payload, &sub)
+			if sub.Name != "sftp" {
+				req.Reply(false, nil)
+				continue
+			}
+			req.Reply(true, nil)
+			go func() {
+				server, err := sftp.NewServer(ch)
+				if err == nil {
+					server.Serve()
+				}
+				srv.exit(ch, 0, nil)
+			}()
+		case "signal":
+			var sig struct{ Signal string }
+			ssh.Unmarshal(req.Payload, &sig)
+			if s, ok := signals[sig.Signal]; ok && proc != nil {
+				syscall.Kill(-proc.Process.Pid, s)
+			}
+		default:
+			if req.WantReply {
+				req.Reply(false, nil)
+			}
+		}
+	}
+	// Client went away, make sure nothing is left running
+	if proc != nil {
+		syscall.Kill(-proc.Process.Pid, syscall.SIGKILL)
+	}
+}
+
+func (srv *Server) command(cmd string, env []string, ch ssh.Channel) *exec.Cmd {
+	proc := exec.Command("sh", "-c", cmd)
+	proc.Dir = srv.Dir
+	proc.Env = append(os.Environ(), env...)
+	proc.Env = append(proc.Env, "PATH="+filepath.Join(srv.root, "bin")+":"+os.Getenv("PATH"))
+	proc.Env = append(proc.Env, "SUDO_TEST_PASSWORD="+srv.SudoPassword)
+	proc.Env = append(proc.Env, "SUDO_TEST_NOISE="+srv.SudoNoise)
+	proc.Stdin = ch
+	proc.Stdout = ch
+	proc.Stderr = ch.Stderr()
+	// Own process group so signals reach whatever sh spawned
+	proc.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	return proc
+}
+
+// exit reports exit-status, or exit-signal when state shows process was
+// killed, then closes ch
+func (srv *Server) exit(ch ssh.Channel, code int, state *os.ProcessState) {
+	if state != nil {
+		if ws, ok := state.Sys().(syscall.WaitStatus); ok && ws.Signaled() {
+			var name string
+			for n, s := range signals {
+				if s == ws.Signal() {
+					name = n
+				}
+			}
+			ch.SendRequest("exit-signal", false, ssh.Marshal(struct {
+				Signal     string
+				CoreDumped bool
+				Error      string
+				Lang       string
+			}{Signal: name}))
+			ch.Close()
+			return
+		}
+	}
+	ch.SendRequest("exit-status", false, ssh.Marshal(struct{ Status uint32 }{uint32(code)}))
+	ch.Close()
+}
+
+func exitCode(err error) int {
+	switch e := err.(type) {
+	case nil:
+		return 0
+	case *exec.ExitError:
+		if ws, ok := e.Sys().(syscall.WaitStatus); ok {
+			return ws.ExitStatus()
+		}
+		return 1
+	default:
+		return 127
+	}
+}
+
+// scpSink reports destination of "scp -t" command, possibly run under sudo
+func scpSink(cmd string) (dst string, ok bool) {
+	for strings.HasPrefix(cmd, "sudo ") {
+		fields := strings.Fields(cmd)
+		cmd = strings.Join(fields[1:], " ")
+		for strings.HasPrefix(cmd, "-") {
+			cmd = strings.TrimSpace(cmd[strings.Index(cmd+" ", " "):])
+		}
+	}
+	if !strings.HasPrefix(cmd, "scp -t ") {
+		return "", false
+	}
+	return strings.Trim(strings.TrimPrefix(cmd, "scp -t "), `'" `), true
+}
+
+// scp receives one file with the sink side of scp protocol, reporting exit
+// code as scp(1) would
+func (srv *Server) scp(ch ssh.Channel, dst string) int {
+	var (
+		r = bufio.NewReader(ch)
+
+		mode uint32
+		size int64
+		name string
+	)
+	if !filepath.IsAbs(dst) {
+		dst = filepath.Join(srv.Dir, dst)
+	}
+	ch.Write([]byte{0})
+	header, err := r.ReadString('\n')
+	if err != nil {
+		return 1
+	}
+	if _, err = fmt.Sscanf(header, "C%o %d %s", &mode, &size, &name); err != nil {
+		fmt.Fprintln(ch.Stderr(), "scp: protocol error:", header)
+		return 1
+	}
+	ch.Write([]byte{0})
+	if info, err := os.Stat(dst); err == nil && info.IsDir() {
+		dst = filepath.Join(dst, name)
+	}
+	file, err := os.OpenFile(dst, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, os.FileMode(mode))
+	if err != nil {
+		fmt.Fprintln(ch.Stderr(), "scp:", err)
+		return 1
+	}
+	defer file.Close()
+	if _, err = io.CopyN(file, r, size); err != nil {
+		fmt.Fprintln(ch.Stderr(), "scp:", err)
+		return 1
+	}
+	if b, err := r.ReadByte(); err != nil || b != 0 {
+		return 1
+	}
+	ch.Write([]byte{0})
+	return 0
+}
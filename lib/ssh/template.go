@@ -0,0 +1,128 @@
+package ssh
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"text/template"
+)
+
+// Functions available to templates besides the builtin ones
+var funcs = template.FuncMap{
+	"contains":  strings.Contains,
+	"hasPrefix": strings.HasPrefix,
+	"hasSuffix": strings.HasSuffix,
+}
+
+// render expands text as template against vars; text without actions is
+// returned as is
+func render(name, text string, vars map[string]interface{}) (string, error) {
+	if !strings.Contains(text, "{{") {
+		return text, nil
+	}
+	tmpl, err := template.New(name).Option("missingkey=error").Funcs(funcs).Parse(text)
+	if err != nil {
+		return "", err
+	}
+	var buf bytes.Buffer
+	if err = tmpl.Execute(&buf, vars); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+// renderFile reads file and expands its content as template against vars
+func renderFile(file string, vars map[string]interface{}) ([]byte, error) {
+	content, err := readLocal(file)
+	if err != nil {
+		return nil, err
+	}
+	text, err := render(file, string(content), vars)
+	if err != nil {
+		return nil, err
+	}
+	return []byte(text), nil
+}
+
+// renderFields expands each field in place, stopping at the first error
+func renderFields(vars map[string]interface{}, fields map[string]*string) error {
+	for name, field := range fields {
+		text, err := render(name, *field, vars)
+		if err != nil {
+			return fmt.Errorf("Unable to render %s: %v", name, err)
+		}
+		*field = text
+	}
+	return nil
+}
+
+func (a Archive) render(vars map[string]interface{}) (Archive, error) {
+	a.vars = vars
+	return a, renderFields(vars, map[string]*string{
+		"src": &a.Src,
+		"dst": &a.Dst,
+		"dir": &a.Dir,
+	})
+}
+
+func (a Action) render(vars map[string]interface{}) (Action, error) {
+	a.vars = vars
+	if err := a.renderModules(vars); err != nil {
+		return a, err
+	}
+	return a, renderFields(vars, map[string]*string{
+		"cmd":    &a.Cmd,
+		"script": &a.Script,
+	})
+}
+
+// Render returns copy of Recipe with src, dst and dir of every Archive and
+// name of every Provision and handler expanded as text/template against vars.  Actions
+// are expanded as they are run, see Expand, for they may refer to results
+// of earlier ones.  Archive and script marked as template have their
+// content expanded as they are sent.
+func (r Recipe) Render(vars map[string]interface{}) (*Recipe, error) {
+	var (
+		rendered = r
+		err      error
+	)
+	rendered.vars = vars
+	rendered.Archive = make([]Archive, len(r.Archive))
+	for idx, a := range r.Archive {
+		if rendered.Archive[idx], err = a.render(vars); err != nil {
+			return nil, err
+		}
+	}
+	if rendered.Provision, err = renderProvisions(r.Provision, vars); err != nil {
+		return nil, err
+	}
+	if rendered.Handlers, err = renderProvisions(r.Handlers, vars); err != nil {
+		return nil, err
+	}
+	return &rendered, nil
+}
+
+// renderProvisions returns copy of sections with name and archives rendered
+func renderProvisions(sections []Provision, vars map[string]interface{}) (rendered []Provision, err error) {
+	rendered = make([]Provision, len(sections))
+	for idx, p := range sections {
+		var scope = p.Variables(vars)
+		if p.Name, err = render("name", p.Name, scope); err != nil {
+			return nil, fmt.Errorf("Unable to render name: %v", err)
+		}
+		archive := make([]Archive, len(p.Archive))
+		for jdx, a := range p.Archive {
+			if archive[jdx], err = a.render(scope); err != nil {
+				return nil, err
+			}
+		}
+		p.Archive = archive
+		rendered[idx] = p
+	}
+	return rendered, nil
+}
+
+// Variables given to Render, nil when Recipe is not rendered
+func (r Recipe) Variables() map[string]interface{} {
+	return r.vars
+}
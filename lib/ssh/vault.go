@@ -0,0 +1,36 @@
+package ssh
+
+import (
+	"github.com/poddworks/machine/lib/vault"
+
+	"fmt"
+	"os"
+)
+
+var (
+	// Decrypts vault encrypted local files named by archives, scripts and
+	// copy or template modules; such files are refused while nil
+	Vault *vault.Vault
+)
+
+// readLocal reads local file, decrypting it in memory when vault encrypted
+func readLocal(file string) ([]byte, error) {
+	return Vault.ReadFile(file)
+}
+
+// localMode is mode to give remote copy of local file: mode unless file is
+// vault encrypted, in which case only the owner may read it
+func localMode(file string, mode os.FileMode) os.FileMode {
+	if vault.IsEncryptedFile(file) {
+		return 0600
+	}
+	return mode
+}
+
+// hideDiff keeps content of vault encrypted file out of diff
+func hideDiff(file, dst, diff string) string {
+	if diff == "" || !vault.IsEncryptedFile(file) {
+		return diff
+	}
+	return fmt.Sprintf("Content of %s hidden, from vault encrypted %s\n", dst, file)
+}
@@ -0,0 +1,117 @@
+package ssh
+
+import (
+	"github.com/poddworks/machine/lib/vault"
+
+	"golang.org/x/net/context"
+
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestArchiveVault(t *testing.T) {
+	dir, err := ioutil.TempDir("", "vault")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer func(v *vault.Vault) { Vault = v }(Vault)
+	cmdr := NewLocal()
+
+	Vault = vault.New(func() ([]byte, error) { return []byte("secret"), nil })
+	content, err := Vault.Encrypt([]byte("password=hunter22\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	src, dst := filepath.Join(dir, "app.env"), filepath.Join(dir, "remote", "app.env")
+	ioutil.WriteFile(src, content, 0644)
+	os.MkdirAll(filepath.Dir(dst), 0755)
+	ioutil.WriteFile(dst, []byte("password=changeme\n"), 0644)
+
+	archive := Archive{Src: src, Dst: dst}
+	changed, diff, err := archive.Check(context.Background(), cmdr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !changed || strings.Contains(diff, "hunter22") || strings.Contains(diff, "changeme") {
+		t.Errorf("unexpected check %v:\n%s", changed, diff)
+	}
+
+	if err = archive.Send(cmdr); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := ioutil.ReadFile(dst); string(data) != "password=hunter22\n" {
+		t.Errorf("unexpected content %q", data)
+	}
+	if info, err := os.Stat(dst); err != nil || info.Mode().Perm() != 0600 {
+		t.Errorf("expected decrypted copy readable by owner only, got %v %v", info.Mode(), err)
+	}
+
+	Vault = nil
+	if err = archive.Send(cmdr); err == nil || !strings.Contains(err.Error(), vault.ErrNoVault.Error()) {
+		t.Errorf("expected %v, got %v", vault.ErrNoVault, err)
+	}
+}
+
+func TestArchiveVaultTree(t *testing.T) {
+	dir, err := ioutil.TempDir("", "vault")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer func(v *vault.Vault) { Vault = v }(Vault)
+	srv, sshCmdr := newTestCommander(t)
+	defer srv.Close()
+	defer sshCmdr.Close()
+
+	Vault = vault.New(func() ([]byte, error) { return []byte("secret"), nil })
+	content, err := Vault.Encrypt([]byte("password=hunter22\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	src := filepath.Join(dir, "conf")
+	os.MkdirAll(src, 0755)
+	ioutil.WriteFile(filepath.Join(src, "app.env"), content, 0644)
+	ioutil.WriteFile(filepath.Join(src, "app.conf"), []byte("port=80\n"), 0644)
+
+	for _, test := range []struct {
+		name string
+		cmdr Commander
+		dst  string
+	}{
+		{"local", NewLocal(), filepath.Join(dir, "local")},
+		{"ssh", sshCmdr, filepath.Join(srv.Dir, "remote")},
+	} {
+		os.MkdirAll(test.dst, 0755)
+		ioutil.WriteFile(filepath.Join(test.dst, "app.env"), []byte("password=changeme\n"), 0644)
+
+		archive := Archive{Src: src, Dst: test.dst}
+		changed, diff, err := archive.Check(context.Background(), test.cmdr)
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		if !changed || strings.Contains(diff, "hunter22") || strings.Contains(diff, "changeme") || !strings.Contains(diff, "hidden") {
+			t.Errorf("%s: unexpected check %v:\n%s", test.name, changed, diff)
+		}
+
+		if err = archive.Send(test.cmdr); err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		dst := filepath.Join(test.dst, "app.env")
+		if data, _ := ioutil.ReadFile(dst); string(data) != "password=hunter22\n" {
+			t.Errorf("%s: unexpected content %q", test.name, data)
+		}
+		if info, err := os.Stat(dst); err != nil || info.Mode().Perm() != 0600 {
+			t.Errorf("%s: expected decrypted copy readable by owner only, got %v %v", test.name, info.Mode(), err)
+		}
+		if info, err := os.Stat(filepath.Join(test.dst, "app.conf")); err != nil || info.Mode().Perm() != 0644 {
+			t.Errorf("%s: expected plain copy to keep its mode, got %v %v", test.name, info.Mode(), err)
+		}
+		if changed, diff, err = archive.Check(context.Background(), test.cmdr); err != nil || changed {
+			t.Errorf("%s: expected no change after send, got %v %v:\n%s", test.name, changed, err, diff)
+		}
+	}
+}
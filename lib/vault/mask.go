@@ -0,0 +1,73 @@
+package vault
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
+
+const (
+	// Stands in for a secret in output
+	MASK = "********"
+
+	// Shorter values are too common to mask without garbling output
+	MIN_SECRET_LEN = 4
+)
+
+// Masker replaces known secrets in text with MASK; the zero value knows no
+// secrets
+type Masker struct {
+	lock    sync.RWMutex
+	secrets []string
+}
+
+// Add learns secrets, ignoring those shorter than MIN_SECRET_LEN
+func (m *Masker) Add(secrets ...string) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	for _, secret := range secrets {
+		if len(secret) >= MIN_SECRET_LEN {
+			m.secrets = append(m.secrets, secret)
+		}
+	}
+	// Longest first, so that a secret containing another is masked whole
+	sort.Slice(m.secrets, func(i, j int) bool { return len(m.secrets[i]) > len(m.secrets[j]) })
+}
+
+// AddValues learns every string and number found in value, e.g. variables
+// loaded from an encrypted vars file
+func (m *Masker) AddValues(value interface{}) {
+	switch v := value.(type) {
+	case nil, bool:
+	case string:
+		m.Add(v)
+	case map[string]interface{}:
+		for _, item := range v {
+			m.AddValues(item)
+		}
+	case map[interface{}]interface{}:
+		for _, item := range v {
+			m.AddValues(item)
+		}
+	case []interface{}:
+		for _, item := range v {
+			m.AddValues(item)
+		}
+	default:
+		m.Add(fmt.Sprint(v))
+	}
+}
+
+// Mask replaces every known secret in text
+func (m *Masker) Mask(text string) string {
+	if m == nil {
+		return text
+	}
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	for _, secret := range m.secrets {
+		text = strings.Replace(text, secret, MASK, -1)
+	}
+	return text
+}
@@ -0,0 +1,201 @@
+// Package vault encrypts files with AES-GCM under a key derived from a
+// password, so that secrets such as passwords and TLS keys can be kept
+// alongside playbooks, and masks secrets out of what exec prints.
+package vault
+
+import (
+	"golang.org/x/crypto/pbkdf2"
+
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+)
+
+const (
+	// First line of every encrypted file
+	HEADER = "$MACHINE_VAULT;1.0;AES256-GCM"
+
+	// Rounds of PBKDF2-HMAC-SHA256 deriving key from password
+	KDF_ITERATIONS = 100000
+
+	SALT_SIZE = 16
+	KEY_SIZE  = 32
+
+	// Width of base64 lines in encrypted file
+	LINE_WIDTH = 76
+)
+
+var (
+	ErrNotEncrypted  = errors.New("File is not vault encrypted")
+	ErrEncrypted     = errors.New("File is already vault encrypted")
+	ErrBadFormat     = errors.New("Vault encrypted content is malformed")
+	ErrBadPassword   = errors.New("Incorrect vault password, or content was altered")
+	ErrEmptyPassword = errors.New("Vault password must not be empty")
+	ErrMismatch      = errors.New("Vault passwords do not match")
+	ErrNoVault       = errors.New("Vault encrypted file given without vault password")
+)
+
+// IsEncrypted reports whether content is vault encrypted
+func IsEncrypted(content []byte) bool {
+	return bytes.HasPrefix(content, []byte(HEADER+"\n"))
+}
+
+// IsEncryptedFile reports whether file is vault encrypted, reading no more
+// than its header
+func IsEncryptedFile(file string) bool {
+	f, err := os.Open(file)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	var header = make([]byte, len(HEADER)+1)
+	if _, err = io.ReadFull(f, header); err != nil {
+		return false
+	}
+	return IsEncrypted(header)
+}
+
+// Vault encrypts and decrypts with password asked for the first time it is
+// needed
+type Vault struct {
+	lock sync.Mutex
+
+	ask      func() ([]byte, error)
+	password []byte
+}
+
+// New makes Vault getting its password from ask, e.g. reading key file or
+// prompting on terminal
+func New(ask func() ([]byte, error)) *Vault {
+	return &Vault{ask: ask}
+}
+
+func (v *Vault) secret() ([]byte, error) {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	if v.password == nil {
+		password, err := v.ask()
+		if err != nil {
+			return nil, err
+		}
+		if len(password) == 0 {
+			return nil, ErrEmptyPassword
+		}
+		v.password = password
+	}
+	return v.password, nil
+}
+
+// aead makes cipher under key derived from password and salt
+func aead(password, salt []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(pbkdf2.Key(password, salt, KDF_ITERATIONS, KEY_SIZE, sha256.New))
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// Encrypt seals plain with fresh salt and nonce
+func (v *Vault) Encrypt(plain []byte) ([]byte, error) {
+	if IsEncrypted(plain) {
+		return nil, ErrEncrypted
+	}
+	password, err := v.secret()
+	if err != nil {
+		return nil, err
+	}
+	var salt = make([]byte, SALT_SIZE)
+	if _, err = rand.Read(salt); err != nil {
+		return nil, err
+	}
+	gcm, err := aead(password, salt)
+	if err != nil {
+		return nil, err
+	}
+	var nonce = make([]byte, gcm.NonceSize())
+	if _, err = rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	payload := append(append(salt, nonce...), gcm.Seal(nil, nonce, plain, []byte(HEADER))...)
+	encoded := base64.StdEncoding.EncodeToString(payload)
+
+	var buf bytes.Buffer
+	buf.WriteString(HEADER + "\n")
+	for len(encoded) > LINE_WIDTH {
+		buf.WriteString(encoded[:LINE_WIDTH] + "\n")
+		encoded = encoded[LINE_WIDTH:]
+	}
+	buf.WriteString(encoded + "\n")
+	return buf.Bytes(), nil
+}
+
+// Decrypt opens content sealed by Encrypt
+func (v *Vault) Decrypt(content []byte) ([]byte, error) {
+	if !IsEncrypted(content) {
+		return nil, ErrNotEncrypted
+	}
+	var (
+		encoded bytes.Buffer
+		scanner = bufio.NewScanner(bytes.NewReader(content[len(HEADER)+1:]))
+	)
+	for scanner.Scan() {
+		encoded.Write(bytes.TrimSpace(scanner.Bytes()))
+	}
+	payload, err := base64.StdEncoding.DecodeString(encoded.String())
+	if err != nil {
+		return nil, ErrBadFormat
+	}
+	password, err := v.secret()
+	if err != nil {
+		return nil, err
+	}
+	if len(payload) < SALT_SIZE {
+		return nil, ErrBadFormat
+	}
+	gcm, err := aead(password, payload[:SALT_SIZE])
+	if err != nil {
+		return nil, err
+	}
+	if payload = payload[SALT_SIZE:]; len(payload) < gcm.NonceSize()+gcm.Overhead() {
+		return nil, ErrBadFormat
+	}
+	plain, err := gcm.Open(nil, payload[:gcm.NonceSize()], payload[gcm.NonceSize():], []byte(HEADER))
+	if err != nil {
+		return nil, ErrBadPassword
+	}
+	return plain, nil
+}
+
+// ReadFile reads file, decrypting it when it is vault encrypted.  A nil
+// Vault reads plain files only.
+func (v *Vault) ReadFile(file string) ([]byte, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var buf bytes.Buffer
+	if _, err = buf.ReadFrom(f); err != nil {
+		return nil, err
+	}
+	if !IsEncrypted(buf.Bytes()) {
+		return buf.Bytes(), nil
+	}
+	if v == nil {
+		return nil, fmt.Errorf("%s: %v", file, ErrNoVault)
+	}
+	plain, err := v.Decrypt(buf.Bytes())
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", file, err)
+	}
+	return plain, nil
+}
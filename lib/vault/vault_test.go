@@ -0,0 +1,126 @@
+package vault
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func password(secret string) func() ([]byte, error) {
+	return func() ([]byte, error) { return []byte(secret), nil }
+}
+
+func TestEncryptDecrypt(t *testing.T) {
+	var (
+		v     = New(password("open sesame"))
+		plain = []byte("db_password: hunter22\n")
+	)
+	content, err := v.Encrypt(plain)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !IsEncrypted(content) || bytes.Contains(content, []byte("hunter22")) {
+		t.Fatalf("unexpected encrypted content:\n%s", content)
+	}
+	if again, _ := v.Encrypt(plain); bytes.Equal(again, content) {
+		t.Error("expected fresh salt and nonce every time")
+	}
+	if _, err = v.Encrypt(content); err != ErrEncrypted {
+		t.Errorf("expected %v, got %v", ErrEncrypted, err)
+	}
+
+	decrypted, err := New(password("open sesame")).Decrypt(content)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(decrypted, plain) {
+		t.Errorf("unexpected content %q", decrypted)
+	}
+	if _, err = New(password("wrong")).Decrypt(content); err != ErrBadPassword {
+		t.Errorf("expected %v, got %v", ErrBadPassword, err)
+	}
+	if _, err = v.Decrypt(plain); err != ErrNotEncrypted {
+		t.Errorf("expected %v, got %v", ErrNotEncrypted, err)
+	}
+
+	tampered := append([]byte{}, content...)
+	idx := len(HEADER) + 10
+	tampered[idx] = map[bool]byte{true: 'B', false: 'A'}[tampered[idx] == 'A']
+	if _, err = v.Decrypt(tampered); err != ErrBadPassword {
+		t.Errorf("expected tampering to be found, got %v", err)
+	}
+	if _, err = v.Decrypt([]byte(HEADER + "\n!!!\n")); err != ErrBadFormat {
+		t.Errorf("expected %v, got %v", ErrBadFormat, err)
+	}
+	if _, err = New(password("")).Encrypt(plain); err != ErrEmptyPassword {
+		t.Errorf("expected %v, got %v", ErrEmptyPassword, err)
+	}
+}
+
+func TestVaultAsksOnce(t *testing.T) {
+	var asked int
+	v := New(func() ([]byte, error) {
+		asked++
+		return []byte("secret"), nil
+	})
+	content, _ := v.Encrypt([]byte("one"))
+	v.Decrypt(content)
+	if asked != 1 {
+		t.Errorf("expected password asked once, got %d", asked)
+	}
+
+	failed := errors.New("no terminal")
+	if _, err := New(func() ([]byte, error) { return nil, failed }).Encrypt([]byte("one")); err != failed {
+		t.Errorf("expected %v, got %v", failed, err)
+	}
+}
+
+func TestReadFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "vault")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	v := New(password("secret"))
+	content, _ := v.Encrypt([]byte("sealed"))
+	plain, sealed := filepath.Join(dir, "plain"), filepath.Join(dir, "sealed")
+	ioutil.WriteFile(plain, []byte("plain"), 0644)
+	ioutil.WriteFile(sealed, content, 0600)
+
+	if IsEncryptedFile(plain) || !IsEncryptedFile(sealed) {
+		t.Error("unexpected encrypted file check")
+	}
+	if data, err := v.ReadFile(sealed); err != nil || string(data) != "sealed" {
+		t.Errorf("unexpected content %q: %v", data, err)
+	}
+	var none *Vault
+	if data, err := none.ReadFile(plain); err != nil || string(data) != "plain" {
+		t.Errorf("unexpected content %q: %v", data, err)
+	}
+	if _, err = none.ReadFile(sealed); err == nil || !strings.Contains(err.Error(), ErrNoVault.Error()) {
+		t.Errorf("expected %v, got %v", ErrNoVault, err)
+	}
+}
+
+func TestMasker(t *testing.T) {
+	var m = new(Masker)
+	m.AddValues(map[interface{}]interface{}{
+		"user":     "admin",
+		"password": "s3cr3t",
+		"port":     5432,
+		"enabled":  true,
+		"nested":   []interface{}{"admin-s3cr3t", "ab"},
+	})
+	if text := m.Mask("login admin-s3cr3t admin s3cr3t on 5432 ab"); text != "login ******** ******** ******** on ******** ab" {
+		t.Errorf("unexpected masked text %q", text)
+	}
+	var none *Masker
+	if text := none.Mask("s3cr3t"); text != "s3cr3t" {
+		t.Errorf("unexpected masked text %q", text)
+	}
+}
@@ -3,6 +3,7 @@ package main
 import (
 	config "github.com/poddworks/machine/config"
 	mach "github.com/poddworks/machine/lib/machine"
+	"github.com/poddworks/machine/lib/ssh"
 
 	"github.com/poddworks/machine/driver/aws"
 	"github.com/poddworks/machine/driver/swarm"
@@ -21,6 +22,10 @@ const (
 	DEFAULT_ORGANIZATION_PLACEMENT_NAME = "podd.org"
 
 	DEFAULT_MACHINE_PORT = "22"
+
+	DEFAULT_HOST_KEY_MODE = "accept-new"
+
+	DEFAULT_BECOME_METHOD = "sudo"
 )
 
 func init() {
@@ -46,8 +51,12 @@ func main() {
 		IPCommand(),
 		EnvCommand(),
 		ExecCommand(),
+		FactsCommand(),
+		VaultCommand(),
 		SSHCommand(),
+		TunnelCommand(),
 		TlsCommand(),
+		SSHCACommand(),
 		DnstoolCommand(),
 		aws.NewCommand(),
 		swarm.NewCommand(),
@@ -56,14 +65,27 @@ func main() {
 	app.Flags = []cli.Flag{
 		cli.StringFlag{Name: "user", EnvVar: "MACHINE_USER", Usage: "Run command as user"},
 		cli.StringFlag{Name: "cert", EnvVar: "MACHINE_CERT_FILE", Usage: "Private key to use in Authentication"},
+		cli.StringSliceFlag{Name: "identity", EnvVar: "MACHINE_IDENTITY_FILES", Usage: "Additional private key to try in Authentication"},
 		cli.StringFlag{Name: "port", EnvVar: "MACHINE_PORT", Value: DEFAULT_MACHINE_PORT, Usage: "Connected to ssh port"},
 		cli.StringFlag{Name: "org", Value: DEFAULT_ORGANIZATION_PLACEMENT_NAME, Usage: "Organization for Self Signed CA"},
 		cli.StringFlag{Name: "confdir", Value: DEFAULT_CONFIG_DIR, Usage: "Configuration and Certificate path"},
+		cli.StringFlag{Name: "bastion", EnvVar: "MACHINE_BASTION", Usage: "Jump host chain in the form [user@]host[:port][,...]"},
+		cli.StringFlag{Name: "host-key", EnvVar: "MACHINE_HOST_KEY", Value: DEFAULT_HOST_KEY_MODE, Usage: "Host key verification [strict|accept-new|insecure]"},
+		cli.StringFlag{Name: "become", EnvVar: "MACHINE_BECOME", Value: DEFAULT_BECOME_METHOD, Usage: "Privilege escalation method [sudo|su]"},
 	}
 	app.Before = func(c *cli.Context) error {
 		if err := config.Parse(c); err != nil {
 			return cli.NewExitError("error/failed-to-parse-config", 1)
 		}
+		if !ssh.IsHostKeyMode(config.Config.HostKeyMode) {
+			return cli.NewExitError("error/invalid-host-key-mode", 1)
+		}
+		if !ssh.IsBecomeMethod(config.Config.Become) {
+			return cli.NewExitError("error/invalid-become-method", 1)
+		}
+		if _, err := ssh.ParseProxyJump(config.Config.Bastion); err != nil {
+			return cli.NewExitError("error/invalid-bastion", 1)
+		}
 		if err := mach.InstList.Load(); err != nil {
 			return cli.NewExitError("error/failed-to-load-cache-instance", 1)
 		}